@@ -0,0 +1,301 @@
+package micro
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+//服务状态(/admin/services)
+const (
+	ServiceInit     = "init"
+	ServiceStarting = "starting"
+	ServiceRunning  = "running"
+	ServiceStopped  = "stopped"
+	ServiceFailed   = "failed"
+)
+
+//注册状态(/admin/services, /admin/registry)
+const (
+	RegistryUnregistered = "unregistered"
+	RegistryRegistering  = "registering"
+	RegistryRegistered   = "registered"
+	RegistryDeregistered = "deregistered"
+	RegistryUnhealthy    = "unhealthy"
+	RegistryFailed       = "failed"
+)
+
+const (
+	redacted = "******"
+)
+
+//ServiceStatus 服务的状态
+type ServiceStatus struct {
+	Name          string                 `json:"name"`
+	Group         string                 `json:"group"`
+	IP            string                 `json:"ip"`
+	Port          uint                   `json:"port"`
+	Weight        uint32                 `json:"weight"`
+	Metadata      map[string]interface{} `json:"metadata"`
+	State         string                 `json:"state"`
+	Registry      string                 `json:"registry"`
+	Error         string                 `json:"error,omitempty"`
+	RegistryError string                 `json:"registry_error,omitempty"`
+}
+
+//DepStatus 依赖的状态
+type DepStatus struct {
+	Key     string `json:"key"`
+	Type    string `json:"type"`
+	Status  string `json:"status"` //up, down, unknown
+	Error   string `json:"error,omitempty"`
+	Latency string `json:"latency,omitempty"`
+}
+
+//RegistryStatus 注册中心的状态: 注册的实例和注册中心看到的实例
+type RegistryStatus struct {
+	Registered *ServiceStatus      `json:"registered"`
+	Instances  []*MicroServiceInfo `json:"instances"`
+	Error      string              `json:"error,omitempty"`
+}
+
+type svcState struct {
+	state       string
+	registry    string
+	err         string
+	registryErr string
+}
+
+//serviceStates RunWith中服务和注册的状态
+type serviceStates struct {
+	mu     sync.RWMutex
+	states map[MicroService]*svcState
+}
+
+func newServiceStates() *serviceStates {
+	return &serviceStates{states: make(map[MicroService]*svcState)}
+}
+
+func (c *serviceStates) load(svc MicroService) *svcState {
+	v, ok := c.states[svc]
+	if !ok {
+		v = &svcState{state: ServiceInit, registry: RegistryUnregistered}
+		c.states[svc] = v
+	}
+	return v
+}
+
+func errString(err error) string {
+	if err == nil || err == context.Canceled {
+		return ""
+	}
+	return err.Error()
+}
+
+func (c *serviceStates) setState(svc MicroService, state string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v := c.load(svc)
+	v.state = state
+	v.err = errString(err)
+}
+
+func (c *serviceStates) setRegistry(svc MicroService, registry string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v := c.load(svc)
+	v.registry = registry
+	v.registryErr = errString(err)
+}
+
+func (c *serviceStates) status(svc MicroService) *ServiceStatus {
+	c.mu.RLock()
+	v, ok := c.states[svc]
+	if !ok {
+		v = &svcState{state: ServiceInit, registry: RegistryUnregistered}
+	}
+	s := *v
+	c.mu.RUnlock()
+	ip, port := svc.Discovery()
+	return &ServiceStatus{
+		Name:          svc.Name(),
+		Group:         svc.Group(),
+		IP:            ip,
+		Port:          port,
+		Weight:        svc.Weight(),
+		Metadata:      svc.Metadata(),
+		State:         s.state,
+		Registry:      s.registry,
+		Error:         s.err,
+		RegistryError: s.registryErr,
+	}
+}
+
+//Services 获取注册的微服务和状态
+func (c *MSManager) Services() []*ServiceStatus {
+	v := make([]*ServiceStatus, 0, len(c.svcs))
+	for _, svc := range c.svcs {
+		v = append(v, c.states.status(svc))
+	}
+	return v
+}
+
+//Registry 获取注册的实例和注册中心看到的实例
+func (c *MSManager) Registry(ctx context.Context) []*RegistryStatus {
+	v := make([]*RegistryStatus, 0, len(c.svcs))
+	for _, svc := range c.svcs {
+		r := &RegistryStatus{Registered: c.states.status(svc)}
+		instances, err := c.svcCenter.ServiceInstances(ctx, svc.Name(), svc.Group())
+		if err != nil {
+			r.Error = err.Error()
+		}
+		r.Instances = instances
+		v = append(v, r)
+	}
+	return v
+}
+
+//addDeps 记录ParseConfig创建的依赖(/admin/deps)
+func (c *MSManager) addDeps(d *Deps) {
+	c.depsMu.Lock()
+	defer c.depsMu.Unlock()
+	c.deps = append(c.deps, d)
+}
+
+//DepsStatus 检查ParseConfig创建的依赖
+func (c *MSManager) DepsStatus(ctx context.Context) []*DepStatus {
+	v := make([]*DepStatus, 0)
+	for _, d := range c.allDeps() {
+		keys := d.Keys()
+		sort.Strings(keys)
+		for _, key := range keys {
+			v = append(v, d.status(ctx, key))
+		}
+	}
+	return v
+}
+
+var secretKeys = []string{"password", "passwd", "pwd", "secret", "token", "credential", "private", "api_key", "apikey", "access_key"}
+
+//dsnPassword mysql dsn的密码(user:password@tcp(...))
+var dsnPassword = regexp.MustCompile(`^([^:@/\s]+):[^@/\s]*@`)
+
+//redactConfig 隐藏配置中的密码等敏感信息, 同时转换yaml的map为json可以输出的map
+func redactConfig(key string, v interface{}) interface{} {
+	return redactFields(secretKeys, key, v)
+}
+
+//isSecretKey 字段名包含敏感关键字
+func isSecretKey(keys []string, key string) bool {
+	lower := strings.ToLower(key)
+	for _, s := range keys {
+		if strings.Contains(lower, s) {
+			return true
+		}
+	}
+	return false
+}
+
+//redactFields 隐藏字段名包含keys的值和连接串中的密码
+func redactFields(keys []string, key string, v interface{}) interface{} {
+	if isSecretKey(keys, key) {
+		return redacted
+	}
+	switch val := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			m[k] = redactFields(keys, k, item)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			ks := fmt.Sprint(k)
+			m[ks] = redactFields(keys, ks, item)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(val))
+		for i, item := range val {
+			s[i] = redactFields(keys, key, item)
+		}
+		return s
+	case string:
+		return redactString(val)
+	}
+	return v
+}
+
+//redactString 隐藏连接串(uri, dsn)中的密码
+func redactString(s string) string {
+	if u, err := url.Parse(s); err == nil && u.Scheme != "" && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return strings.Replace(s, u.User.String()+"@", u.User.Username()+":"+redacted+"@", 1)
+		}
+		return s
+	}
+	return dsnPassword.ReplaceAllString(s, "${1}:"+redacted+"@")
+}
+
+//AdminHandler 管理/诊断接口: pprof, expvar, 指标, 日志级别, 服务, 配置(隐藏敏感信息), 依赖, 注册中心
+func (c *MSManager) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle(defaultMetricsPath, c.metrics.handler())
+	mux.Handle(defaultLogLevelPath, c.LogLevelHandler())
+	mux.Handle(defaultLivezPath, c.livezHandler())
+	mux.Handle(defaultReadyzPath, c.readyzHandler())
+	mux.HandleFunc("/admin/services", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, c.Services())
+	})
+	mux.HandleFunc("/admin/config", func(w http.ResponseWriter, r *http.Request) {
+		v, err := c.configSnapshot(r.Context())
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, redactConfig("", v))
+	})
+	mux.HandleFunc("/admin/deps", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, c.DepsStatus(r.Context()))
+	})
+	mux.HandleFunc("/admin/registry", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, c.Registry(r.Context()))
+	})
+	return mux
+}
+
+//serveAdmin 在独立端口上提供管理/诊断接口(AdminListen)
+func (c *MSManager) serveAdmin(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:    c.options.adminListen,
+		Handler: c.AdminHandler(),
+	}
+	go func() {
+		<-ctx.Done()
+		cctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+		_ = srv.Shutdown(cctx)
+		cancel()
+	}()
+	c.log.Normal().Info("start admin server", zap.String("listen", c.options.adminListen))
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
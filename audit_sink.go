@@ -0,0 +1,135 @@
+package micro
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/whatisfaker/conf/amqp"
+	"github.com/whatisfaker/zaptrace/log"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+//AuditSink 审计记录的存储(实现io.Closer时Auditor关闭时关闭)
+type AuditSink interface {
+	Write(ctx context.Context, rec *AuditRecord) error
+}
+
+//AuditSinkFunc 函数作为存储
+type AuditSinkFunc func(ctx context.Context, rec *AuditRecord) error
+
+func (c AuditSinkFunc) Write(ctx context.Context, rec *AuditRecord) error {
+	return c(ctx, rec)
+}
+
+type zapAuditSink struct {
+	log *log.Factory
+}
+
+//ZapAuditSink 写入日志
+func ZapAuditSink(logger *log.Factory) AuditSink {
+	return &zapAuditSink{log: logger}
+}
+
+func (c *zapAuditSink) Write(ctx context.Context, rec *AuditRecord) error {
+	c.log.Normal().Info("audit",
+		zap.String("name", rec.Name),
+		zap.String("service", rec.Service),
+		zap.String("protocol", rec.Protocol),
+		zap.String("path", rec.Path),
+		zap.String("operation", rec.Operation),
+		zap.String("request_id", rec.RequestID),
+		zap.String("user", rec.User),
+		zap.Int64("uid", rec.UID),
+		zap.Int("status", rec.Status),
+		zap.Int64("duration_ms", rec.Duration),
+		zap.String("remote_addr", rec.RemoteAddr),
+		zap.String("real_ip", rec.RealIP),
+		zap.String("condition", rec.Condition),
+		zap.String("result", rec.Result),
+		zap.String("error", rec.Error),
+		zap.String("ext1", rec.Ext1),
+		zap.String("ext2", rec.Ext2),
+		zap.Int("ext_int1", rec.ExtInt1),
+		zap.Int("ext_int2", rec.ExtInt2),
+	)
+	return nil
+}
+
+type fileAuditSink struct {
+	mu sync.Mutex
+	w  *lumberjack.Logger
+}
+
+//FileAuditSink 按行写入json文件, 超过maxSizeMB时轮转, 保留maxBackups个/maxAgeDays天(0不限制)
+func FileAuditSink(path string, maxSizeMB int, maxBackups int, maxAgeDays int) AuditSink {
+	return &fileAuditSink{
+		w: &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    maxSizeMB,
+			MaxBackups: maxBackups,
+			MaxAge:     maxAgeDays,
+			LocalTime:  true,
+		},
+	}
+}
+
+func (c *fileAuditSink) Write(ctx context.Context, rec *AuditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = c.w.Write(append(b, '\n'))
+	return err
+}
+
+func (c *fileAuditSink) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.w.Close()
+}
+
+type rabbitMQAuditSink struct {
+	client amqp.Client
+	queue  string
+}
+
+//RabbitMQAuditSink 以json发送到rabbitmq队列(例如deps.GetRabbitMQ(key))
+func RabbitMQAuditSink(client amqp.Client, queue string) AuditSink {
+	return &rabbitMQAuditSink{client: client, queue: queue}
+}
+
+func (c *rabbitMQAuditSink) Write(ctx context.Context, rec *AuditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return c.client.Produce(ctx, c.queue, b)
+}
+
+type mongoAuditSink struct {
+	collection *mongo.Collection
+}
+
+//MongoAuditSink 写入mongo的集合(例如deps.GetMongoDB(key))
+func MongoAuditSink(client *mongo.Client, database string, collection string) AuditSink {
+	return &mongoAuditSink{collection: client.Database(database).Collection(collection)}
+}
+
+func (c *mongoAuditSink) Write(ctx context.Context, rec *AuditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	doc := make(map[string]interface{})
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+	doc["create_time"] = rec.CreateTime
+	_, err = c.collection.InsertOne(ctx, doc)
+	return err
+}
@@ -1,19 +1,491 @@
 package micro
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/gin-gonic/gin"
 	auditlog "github.com/whatisfaker/gin-contrib/audit"
 	"github.com/whatisfaker/zaptrace/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	//auditLogKey 同gin-contrib/audit, auditlog.Customize().Do(ctx)可以继续使用
+	auditLogKey   = "auditlogcontextkey"
+	auditorKey    = "micro:auditor"
+	auditFuncKey  = "micro:auditfunc"
+	auditSvcKey   = "micro:auditservice"
+	truncatedMark = "...(truncated)"
+
+	//defaultAuditBodyLimit 默认记录的请求/响应内容大小
+	defaultAuditBodyLimit = 4096
+	defaultAuditQueueSize = 1024
+	defaultAuditTimeout   = 5 * time.Second
 )
 
-type audit struct {
-	log *log.Factory
+//AuditRecord 审计记录(包含gin-contrib/audit的AuditLog字段)
+type AuditRecord struct {
+	*auditlog.AuditLog
+	Service   string `json:"service"`
+	Protocol  string `json:"protocol"` //http, grpc
+	RequestID string `json:"request_id"`
+	User      string `json:"user"`
+	Status    int    `json:"status"` //http状态码, grpc状态码
+	Error     string `json:"error,omitempty"`
+	Duration  int64  `json:"duration_ms"`
+	Truncated bool   `json:"truncated"`
+}
+
+//AuditOption 审计的设置
+type AuditOption interface {
+	apply(*Auditor)
+}
+
+type auditOption struct {
+	f func(*Auditor)
+}
+
+func (c *auditOption) apply(o *Auditor) {
+	c.f(o)
+}
+
+func newAuditOption(f func(*Auditor)) *auditOption {
+	return &auditOption{
+		f: f,
+	}
+}
+
+//AuditSinks 审计记录的存储(ZapAuditSink, FileAuditSink, RabbitMQAuditSink, MongoAuditSink)
+func AuditSinks(sinks ...AuditSink) AuditOption {
+	return newAuditOption(func(o *Auditor) {
+		o.sinks = append(o.sinks, sinks...)
+	})
+}
+
+//AuditBodyLimit 记录的请求/响应内容大小(默认4096字节), 超过时截断, 0不记录内容
+func AuditBodyLimit(n int) AuditOption {
+	return newAuditOption(func(o *Auditor) {
+		o.bodyLimit = n
+	})
+}
+
+//AuditRedact 增加需要隐藏的字段(字段名包含即隐藏, 默认password, secret, token等)
+func AuditRedact(fields ...string) AuditOption {
+	return newAuditOption(func(o *Auditor) {
+		for _, v := range fields {
+			o.redact = append(o.redact, strings.ToLower(v))
+		}
+	})
+}
+
+//AuditQueueSize 异步写入的队列大小(默认1024), 队列满时丢弃并打印日志
+func AuditQueueSize(n int) AuditOption {
+	return newAuditOption(func(o *Auditor) {
+		o.queueSize = n
+	})
+}
+
+//Auditor 审计管道: 采集gin/grpc的请求, 隐藏敏感字段, 异步写入存储
+type Auditor struct {
+	sinks     []AuditSink
+	bodyLimit int
+	redact    []string
+	queueSize int
+	pattern   *regexp.Regexp
+	log       *log.Factory
+	mu        sync.RWMutex
+	closed    bool
+	queue     chan *AuditRecord
+	done      chan struct{}
+}
+
+//NewAuditor 创建审计管道(ParamAudit设置到服务), RunWith结束时关闭
+func (c *MSManager) NewAuditor(opts ...AuditOption) *Auditor {
+	a := newAuditor(c.audit.log, opts...)
+	c.auditMu.Lock()
+	c.auditors = append(c.auditors, a)
+	c.auditMu.Unlock()
+	return a
+}
+
+func newAuditor(log *log.Factory, opts ...AuditOption) *Auditor {
+	c := &Auditor{
+		bodyLimit: defaultAuditBodyLimit,
+		redact:    append([]string{}, secretKeys...),
+		queueSize: defaultAuditQueueSize,
+		log:       log,
+		done:      make(chan struct{}),
+	}
+	for _, o := range opts {
+		o.apply(c)
+	}
+	keys := make([]string, len(c.redact))
+	for i, v := range c.redact {
+		keys[i] = regexp.QuoteMeta(v)
+	}
+	//截断的json不能解析时按"key":"value"隐藏
+	c.pattern = regexp.MustCompile(`(?i)("[^"]*(?:` + strings.Join(keys, "|") + `)[^"]*"\s*:\s*)"(?:[^"\\]|\\.)*"?`)
+	c.queue = make(chan *AuditRecord, c.queueSize)
+	go c.run()
+	return c
+}
+
+func (c *Auditor) run() {
+	defer close(c.done)
+	for rec := range c.queue {
+		for _, sink := range c.sinks {
+			ctx, cancel := context.WithTimeout(context.Background(), defaultAuditTimeout)
+			if err := sink.Write(ctx, rec); err != nil {
+				c.log.Normal().Warn("write audit record", zap.String("name", rec.Name), zap.Error(err))
+			}
+			cancel()
+		}
+	}
+}
+
+//Record 写入审计记录(异步)
+func (c *Auditor) Record(rec *AuditRecord) {
+	if len(c.sinks) == 0 {
+		return
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.queue <- rec:
+	default:
+		c.log.Normal().Warn("audit queue full, drop record", zap.String("name", rec.Name), zap.String("request_id", rec.RequestID))
+	}
+}
+
+//Close 写完队列中的记录后关闭存储
+func (c *Auditor) Close(ctx context.Context) error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	c.mu.Unlock()
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	for _, sink := range c.sinks {
+		if closer, ok := sink.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				c.log.Normal().Warn("close audit sink", zap.Error(err))
+			}
+		}
+	}
+	return nil
+}
+
+//body 截断并隐藏敏感字段
+func (c *Auditor) body(b []byte, truncated bool) string {
+	if len(b) == 0 {
+		return ""
+	}
+	var v interface{}
+	if !truncated && json.Unmarshal(b, &v) == nil {
+		if out, err := json.Marshal(redactFields(c.redact, "", v)); err == nil {
+			return string(out)
+		}
+	}
+	s := string(b)
+	if form, err := url.ParseQuery(s); err == nil && !truncated && strings.Contains(s, "=") && !strings.ContainsAny(s, "{[\" ") {
+		for k := range form {
+			if isSecretKey(c.redact, k) {
+				form[k] = []string{redacted}
+			}
+		}
+		return form.Encode()
+	}
+	s = c.pattern.ReplaceAllString(s, `${1}"`+redacted+`"`)
+	if truncated {
+		s += truncatedMark
+	}
+	return s
+}
+
+//query 隐藏查询参数中的敏感字段(同表单), 无法解析的参数丢弃
+func (c *Auditor) query(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	form, _ := url.ParseQuery(raw)
+	for k := range form {
+		if isSecretKey(c.redact, k) {
+			form[k] = []string{redacted}
+		}
+	}
+	return form.Encode()
+}
+
+//message grpc消息转换为json
+func (c *Auditor) message(m interface{}) (string, bool) {
+	if m == nil || c.bodyLimit <= 0 {
+		return "", false
+	}
+	var b []byte
+	var err error
+	if pm, ok := m.(proto.Message); ok {
+		b, err = protojson.Marshal(pm)
+	} else {
+		b, err = json.Marshal(m)
+	}
+	if err != nil {
+		return "", false
+	}
+	truncated := len(b) > c.bodyLimit
+	if truncated {
+		b = b[:c.bodyLimit]
+	}
+	return c.body(b, truncated), truncated
+}
+
+//limitedBuffer 最多保存limit字节
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (c *limitedBuffer) Write(b []byte) (int, error) {
+	if n := c.limit - c.Len(); n < len(b) {
+		c.truncated = true
+		if n > 0 {
+			c.Buffer.Write(b[:n])
+		}
+		return len(b), nil
+	}
+	return c.Buffer.Write(b)
+}
+
+type auditResponseWriter struct {
+	gin.ResponseWriter
+	body *limitedBuffer
+}
+
+func (c *auditResponseWriter) Write(b []byte) (int, error) {
+	_, _ = c.body.Write(b)
+	return c.ResponseWriter.Write(b)
 }
 
-func (c *audit) ginaudit(name string) gin.HandlerFunc {
-	return auditlog.MWAuditlog(name)
+func (c *auditResponseWriter) WriteString(s string) (int, error) {
+	_, _ = c.body.Write([]byte(s))
+	return c.ResponseWriter.WriteString(s)
 }
 
+//Gin 审计gin路由的中间件(name为操作名)
+func (c *Auditor) Gin(name string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		c.gin(ctx, name)
+	}
+}
+
+func (c *Auditor) gin(ctx *gin.Context, name string) {
+	req := ctx.Request
+	//同gin-contrib/audit, 只审计GET, PUT, POST, DELETE, PATCH
+	switch req.Method {
+	case "GET", "PUT", "POST", "DELETE", "PATCH":
+	default:
+		ctx.Next()
+		return
+	}
+	start := time.Now()
+	rec := &AuditRecord{
+		AuditLog: &auditlog.AuditLog{
+			Name:      name,
+			Path:      req.URL.Path,
+			Operation: req.Method,
+		},
+		Protocol:  "http",
+		RequestID: RequestID(ctx),
+		User:      req.Header.Get(HeaderUserID),
+	}
+	if svc, ok := ctx.Get(auditSvcKey); ok {
+		rec.Service, _ = svc.(string)
+	}
+	if req.Method == "GET" {
+		rec.Condition = c.query(req.URL.RawQuery)
+	} else if c.bodyLimit > 0 && req.Body != nil {
+		ct := req.Header.Get("Content-Type")
+		if strings.Contains(ct, "multipart/form-data") {
+			rec.Condition = "multipart/form-data"
+		} else {
+			//只读取limit字节, 剩余的内容留给处理函数
+			b, err := ioutil.ReadAll(io.LimitReader(req.Body, int64(c.bodyLimit)+1))
+			if err == nil {
+				truncated := len(b) > c.bodyLimit
+				req.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(b), req.Body), req.Body}
+				if truncated {
+					b = b[:c.bodyLimit]
+				}
+				rec.Condition = strings.TrimSpace(ct + " " + c.body(b, truncated))
+				rec.Truncated = truncated
+			}
+		}
+	}
+	rec.RemoteAddr = ctx.ClientIP()
+	rec.RealIP = req.Header.Get("X-Real-Ip")
+	if rec.RealIP == "" {
+		rec.RealIP = req.Header.Get("X-Forwarded-For")
+	}
+	if rec.RealIP == "" {
+		rec.RealIP = req.RemoteAddr
+	}
+	w := &auditResponseWriter{ResponseWriter: ctx.Writer, body: &limitedBuffer{limit: c.bodyLimit}}
+	ctx.Writer = w
+	ctx.Set(auditLogKey, rec.AuditLog)
+	ctx.Next()
+	if v, ok := ctx.Get(auditLogKey); ok {
+		if al, ok := v.(*auditlog.AuditLog); ok {
+			rec.AuditLog = al
+		}
+	}
+	if rec.Result == "" && c.bodyLimit > 0 {
+		rec.Result = c.body(w.body.Bytes(), w.body.truncated)
+		rec.Truncated = rec.Truncated || w.body.truncated
+	}
+	rec.CreateTime = time.Now()
+	rec.Duration = time.Since(start).Milliseconds()
+	rec.Status = w.Status()
+	if err := ctx.Errors.Last(); err != nil {
+		rec.Error = err.Error()
+	}
+	//ParamWebGinAuditFunc设置的处理函数
+	if f, ok := ctx.Get(auditFuncKey); ok {
+		if fn, ok := f.(func(*auditlog.AuditLog, *gin.Context)); ok {
+			fn(rec.AuditLog, ctx)
+		}
+	}
+	c.Record(rec)
+}
+
+//auditGinMiddleware 服务的审计设置(ParamAudit, ParamWebGinAuditFunc), GinAudit使用
+func auditGinMiddleware(service string, auditor *Auditor, fn func(*auditlog.AuditLog, *gin.Context)) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.Set(auditSvcKey, service)
+		if auditor != nil {
+			ctx.Set(auditorKey, auditor)
+		}
+		if fn != nil {
+			ctx.Set(auditFuncKey, fn)
+		}
+		ctx.Next()
+	}
+}
+
+func grpcAuditRecord(ctx context.Context, service string, method string) *AuditRecord {
+	rec := &AuditRecord{
+		AuditLog: &auditlog.AuditLog{
+			Name:      method,
+			Path:      method,
+			Operation: "grpc",
+		},
+		Service:   service,
+		Protocol:  "grpc",
+		RequestID: RequestID(ctx),
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		rec.RemoteAddr = p.Addr.String()
+		rec.RealIP = rec.RemoteAddr
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		rec.User = metadataValue(md, strings.ToLower(HeaderUserID))
+		if ip := metadataValue(md, "x-real-ip"); ip != "" {
+			rec.RealIP = ip
+		} else if ip := metadataValue(md, "x-forwarded-for"); ip != "" {
+			rec.RealIP = ip
+		}
+	}
+	return rec
+}
+
+func (c *Auditor) finishGRPC(rec *AuditRecord, start time.Time, err error) {
+	rec.CreateTime = time.Now()
+	rec.Duration = time.Since(start).Milliseconds()
+	rec.Status = int(status.Code(err))
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	c.Record(rec)
+}
+
+//UnaryServerInterceptor 审计grpc调用(service为服务名)
+func (c *Auditor) UnaryServerInterceptor(service string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		rec := grpcAuditRecord(ctx, service, info.FullMethod)
+		var truncated bool
+		rec.Condition, truncated = c.message(req)
+		resp, err := handler(ctx, req)
+		if err == nil {
+			var t bool
+			rec.Result, t = c.message(resp)
+			truncated = truncated || t
+		}
+		rec.Truncated = truncated
+		c.finishGRPC(rec, start, err)
+		return resp, err
+	}
+}
+
+//StreamServerInterceptor 审计grpc流(不记录消息内容)
+func (c *Auditor) StreamServerInterceptor(service string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		rec := grpcAuditRecord(ss.Context(), service, info.FullMethod)
+		err := handler(srv, ss)
+		c.finishGRPC(rec, start, err)
+		return err
+	}
+}
+
+//GinAudit 审计gin路由的中间件, 使用服务的审计管道(ParamAudit), 没有设置时使用管理器默认的审计管道(DefaultAudit)
 func (c *MSManager) GinAudit(name string) gin.HandlerFunc {
-	return c.audit.ginaudit(name)
+	return func(ctx *gin.Context) {
+		if v, ok := ctx.Get(auditorKey); ok {
+			if a, ok := v.(*Auditor); ok {
+				a.gin(ctx, name)
+				return
+			}
+		}
+		c.audit.gin(ctx, name)
+	}
+}
+
+//closeAuditors RunWith结束时写完审计记录
+func (c *MSManager) closeAuditors() {
+	c.auditMu.Lock()
+	auditors := append([]*Auditor{c.audit}, c.auditors...)
+	c.auditMu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), defaultAuditTimeout)
+	defer cancel()
+	for _, a := range auditors {
+		if err := a.Close(ctx); err != nil {
+			c.log.Normal().Warn("close auditor", zap.Error(err))
+		}
+	}
 }
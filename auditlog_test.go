@@ -0,0 +1,94 @@
+package micro
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/whatisfaker/zaptrace/log"
+)
+
+//auditGin 使用审计中间件处理一个请求, 返回写入的审计记录
+func auditGin(t *testing.T, req *http.Request, opts ...AuditOption) *AuditRecord {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	var mu sync.Mutex
+	var recs []*AuditRecord
+	sink := AuditSinkFunc(func(ctx context.Context, rec *AuditRecord) error {
+		mu.Lock()
+		defer mu.Unlock()
+		recs = append(recs, rec)
+		return nil
+	})
+	a := newAuditor(log.NewStdLogger("error"), append([]AuditOption{AuditSinks(sink)}, opts...)...)
+	r := gin.New()
+	r.Any("/login", a.Gin("login"), func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{"user": "bob", "token": "t-123"})
+	})
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	if err := a.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(recs) != 1 {
+		t.Fatalf("got %d audit records, want 1", len(recs))
+	}
+	return recs[0]
+}
+
+func TestAuditRedactJSON(t *testing.T) {
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"user":"bob","password":"p@ss","nested":{"api_key":"k"}}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := auditGin(t, req)
+	for _, secret := range []string{"p@ss", `"k"`} {
+		if strings.Contains(rec.Condition, secret) {
+			t.Fatalf("condition %q contains %s", rec.Condition, secret)
+		}
+	}
+	if !strings.Contains(rec.Condition, `"user":"bob"`) || !strings.Contains(rec.Condition, redacted) {
+		t.Fatalf("condition %q", rec.Condition)
+	}
+	if strings.Contains(rec.Result, "t-123") || !strings.Contains(rec.Result, `"token":"`+redacted+`"`) {
+		t.Fatalf("result %q", rec.Result)
+	}
+	if rec.Status != http.StatusOK || rec.Name != "login" {
+		t.Fatalf("status %d name %s", rec.Status, rec.Name)
+	}
+}
+
+func TestAuditRedactForm(t *testing.T) {
+	req := httptest.NewRequest("POST", "/login", strings.NewReader("user=bob&password=p%40ss"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := auditGin(t, req)
+	if strings.Contains(rec.Condition, "p%40ss") || !strings.Contains(rec.Condition, "user=bob") {
+		t.Fatalf("condition %q", rec.Condition)
+	}
+}
+
+func TestAuditRedactQuery(t *testing.T) {
+	rec := auditGin(t, httptest.NewRequest("GET", "/login?user=bob&access_token=abc&sign=x", nil), AuditRedact("sign"))
+	if strings.Contains(rec.Condition, "abc") || strings.Contains(rec.Condition, "sign=x") {
+		t.Fatalf("condition %q", rec.Condition)
+	}
+	if !strings.Contains(rec.Condition, "user=bob") {
+		t.Fatalf("condition %q", rec.Condition)
+	}
+}
+
+func TestAuditRedactTruncated(t *testing.T) {
+	body := `{"user":"bob","password":"p@ss","data":"` + strings.Repeat("x", 64) + `"}`
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := auditGin(t, req, AuditBodyLimit(40))
+	if !rec.Truncated || !strings.HasSuffix(rec.Condition, truncatedMark) {
+		t.Fatalf("condition %q truncated %v", rec.Condition, rec.Truncated)
+	}
+	if strings.Contains(rec.Condition, "p@ss") {
+		t.Fatalf("condition %q", rec.Condition)
+	}
+}
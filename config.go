@@ -3,6 +3,12 @@ package micro
 import (
 	"context"
 	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
 )
 
 var ErrNotApplicable = errors.New("this function is not applicable")
@@ -17,3 +23,49 @@ type ConfigCenter interface {
 	//GetConfigAndWatch 获取配置并监听
 	//GetConfigAndWatch(context.Context, string, interface{}, func(string, string, interface{}, error)) error
 }
+
+//ReloadConfig 从配置中心重新加载所有支持动态更新的配置(日志级别, 追踪采样, 限流, grpc容错, 依赖)
+func (c *MSManager) ReloadConfig(ctx context.Context) error {
+	var errs []string
+	for _, reload := range []func(context.Context) error{c.ReloadLogLevel, c.ReloadTracing, c.ReloadLimits, c.ReloadResilience, c.ReloadDeps} {
+		if err := reload(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("reload config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (c *MSManager) configSnapshot(ctx context.Context) (map[string]interface{}, error) {
+	v := make(map[string]interface{})
+	err := c.confCenter.GetConfig(ctx, &v)
+	return v, err
+}
+
+//watchConfig 定时检查配置中心, 配置变化时重新加载(WatchConfig)
+func (c *MSManager) watchConfig(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last, _ := c.configSnapshot(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			current, err := c.configSnapshot(ctx)
+			if err != nil {
+				c.log.Normal().Warn("watch config", zap.Error(err))
+				continue
+			}
+			if reflect.DeepEqual(last, current) {
+				continue
+			}
+			last = current
+			if err := c.ReloadConfig(ctx); err != nil {
+				c.log.Normal().Warn("reload config", zap.Error(err))
+			}
+		}
+	}
+}
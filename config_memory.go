@@ -0,0 +1,65 @@
+package micro
+
+import (
+	"context"
+	"sync"
+
+	"github.com/whatisfaker/zaptrace/log"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+type memoryCC struct {
+	data []byte
+	log  *log.Factory
+	mu   sync.RWMutex
+}
+
+var _ ConfigCenter = (*memoryCC)(nil)
+
+func newMemoryCC(initial interface{}, log *log.Factory) (*memoryCC, error) {
+	c := &memoryCC{
+		log: log,
+	}
+	if initial != nil {
+		b, err := yaml.Marshal(initial)
+		if err != nil {
+			return nil, err
+		}
+		c.data = b
+	}
+	return c, nil
+}
+
+func (c *memoryCC) SetConfig(ctx context.Context, cfg interface{}) error {
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		c.log.Trace(ctx).Error("SetConfig", zap.Error(err))
+		return err
+	}
+	c.mu.Lock()
+	c.data = b
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryCC) RemoveConfig(ctx context.Context, cfg interface{}) error {
+	c.mu.Lock()
+	c.data = nil
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryCC) GetConfig(ctx context.Context, cfg interface{}) error {
+	c.mu.RLock()
+	b := c.data
+	c.mu.RUnlock()
+	if len(b) == 0 {
+		return nil
+	}
+	err := yaml.Unmarshal(b, cfg)
+	if err != nil {
+		c.log.Trace(ctx).Error("GetConfig", zap.Error(err))
+	}
+	return err
+}
@@ -0,0 +1,408 @@
+package micro
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/streadway/amqp"
+	confamqp "github.com/whatisfaker/conf/amqp"
+	"github.com/whatisfaker/zaptrace/log"
+	"go.uber.org/zap"
+)
+
+const (
+	//defaultConsumerRetries 处理失败的默认重试次数
+	defaultConsumerRetries = 3
+	//defaultConsumerBackoff 第一次重试前的默认等待时间(之后加倍)
+	defaultConsumerBackoff = 200 * time.Millisecond
+	//defaultConsumerMaxBackoff 重试的最大等待时间
+	defaultConsumerMaxBackoff = 10 * time.Second
+	//consumerReceiveBackoff 接收出错(连接断开等)后重新接收的最大等待时间
+	consumerReceiveBackoff = 30 * time.Second
+)
+
+//ErrRejectMessage handler返回包装了ErrRejectMessage的错误(fmt.Errorf("%w: ...", ErrRejectMessage))时不重试, 直接发送到死信
+var ErrRejectMessage = errors.New("message rejected")
+
+//Message 消费的消息
+type Message struct {
+	Body []byte
+	//Headers 消息头(追踪从这里提取), RabbitMQ为字符串类型的消息头
+	Headers map[string]string
+	//Attempt 第几次处理(从1开始)
+	Attempt int
+}
+
+//ConsumerHandler 处理消息, 返回nil时ack, 返回错误时nack(退避重试, 超过次数后发送到死信或者丢弃)
+type ConsumerHandler func(ctx context.Context, msg *Message) error
+
+//ConsumerSource 消息来源(RabbitMQSource), RegisterConsumer按并发数并发调用Receive
+type ConsumerSource interface {
+	//Name 来源的名称(队列), 用于日志, 指标和追踪
+	Name() string
+	//Receive 阻塞接收消息直到ctx结束或者出错, 每条消息调用handle. handle返回nil时消息已经处理完成(ack, 死信或者丢弃),
+	//返回错误时没有处理完成(停止时超过等待时间), 来源可以重新投递
+	Receive(ctx context.Context, handle func(ctx context.Context, msg *Message) error) error
+	//DeadLetter 发送消息到死信队列
+	DeadLetter(ctx context.Context, queue string, msg *Message) error
+}
+
+type msConsumer struct {
+	params      *paramMap
+	name        string
+	discoveryIP string
+	source      ConsumerSource
+	handler     ConsumerHandler
+	log         *log.Factory
+	metrics     *metrics
+	started     int32
+	//base 处理消息的ctx, 停止接收后等待处理完成, Shutdown超时后取消
+	base   context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var _ MicroService = (*msConsumer)(nil)
+
+func newConsumerMicroService(name string, source ConsumerSource, handler ConsumerHandler, log *log.Factory, params ...Param) (*msConsumer, error) {
+	if source == nil || handler == nil {
+		return nil, errors.New("consumer source or handler is nil")
+	}
+	p := &paramMap{
+		enableTracer:        true,
+		metadata:            map[string]interface{}{},
+		weight:              defaultMSWeight,
+		consumerConcurrency: 1,
+		consumerRetries:     defaultConsumerRetries,
+		consumerBackoff:     defaultConsumerBackoff,
+		consumerMaxBackoff:  defaultConsumerMaxBackoff,
+	}
+	for _, v := range params {
+		v.apply(p)
+	}
+	if p.consumerConcurrency <= 0 {
+		p.consumerConcurrency = 1
+	}
+	c := &msConsumer{
+		params:  p,
+		name:    name,
+		source:  source,
+		handler: handler,
+		log:     log,
+		done:    make(chan struct{}),
+	}
+	c.base, c.cancel = context.WithCancel(withServiceLog(context.Background(), log))
+	c.discoveryIP = p.discoveryIP
+	if c.discoveryIP == "" {
+		var err error
+		c.discoveryIP, err = getOutboundIP()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *msConsumer) attach(m *MSManager) {
+	c.metrics = m.metrics
+	m.logs.register(LogConsumer, c.log)
+}
+
+//Start 按并发数接收消息, ctx结束时停止接收, 等待处理中的消息完成后返回
+func (c *msConsumer) Start(ctx context.Context) error {
+	atomic.StoreInt32(&c.started, 1)
+	defer close(c.done)
+	var wg sync.WaitGroup
+	for i := 0; i < c.params.consumerConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.receive(ctx)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+//receive 接收消息, 出错时退避后重新接收
+func (c *msConsumer) receive(ctx context.Context) {
+	wait := time.Second
+	for {
+		err := c.source.Receive(ctx, c.handle)
+		if ctx.Err() != nil {
+			return
+		}
+		c.log.Normal().Warn("consumer receive error, retry", zap.String("source", c.source.Name()), zap.Duration("backoff", wait), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > consumerReceiveBackoff {
+			wait = consumerReceiveBackoff
+		}
+	}
+}
+
+//handle 处理一条消息: 提取追踪, 失败时退避重试, 超过次数后发送到死信或者丢弃
+func (c *msConsumer) handle(rctx context.Context, msg *Message) error {
+	ctx := NewRequestContext(c.base, "", zap.String("consumer", c.name), zap.String("source", c.source.Name()))
+	var span opentracing.Span
+	if c.params.enableTracer {
+		span = c.startSpan(rctx, msg)
+		ctx = opentracing.ContextWithSpan(ctx, span)
+	}
+	if c.metrics != nil {
+		c.metrics.consumerInflight.WithLabelValues(c.name).Inc()
+		defer c.metrics.consumerInflight.WithLabelValues(c.name).Dec()
+	}
+	start := time.Now()
+	result, err := c.process(ctx, msg)
+	if span != nil {
+		span.SetTag("message.attempts", msg.Attempt)
+		span.SetTag("message.result", result)
+		if err != nil {
+			ext.Error.Set(span, true)
+			span.LogFields(otlog.Error(err))
+		}
+		span.Finish()
+	}
+	if c.metrics != nil {
+		c.metrics.consumed(c.name, result, time.Since(start))
+	}
+	if result == "nack" {
+		return err
+	}
+	return nil
+}
+
+//startSpan 客户端已经提取的追踪(ctx中的span)为父span, 否则从消息头提取
+func (c *msConsumer) startSpan(rctx context.Context, msg *Message) opentracing.Span {
+	tracer := opentracing.GlobalTracer()
+	opts := []opentracing.StartSpanOption{ext.SpanKindConsumer}
+	if parent := opentracing.SpanFromContext(rctx); parent != nil {
+		opts = append(opts, opentracing.ChildOf(parent.Context()))
+	} else if len(msg.Headers) > 0 {
+		if sc, err := tracer.Extract(opentracing.TextMap, opentracing.TextMapCarrier(msg.Headers)); err == nil {
+			opts = append(opts, opentracing.FollowsFrom(sc))
+		}
+	}
+	span := tracer.StartSpan("consume "+c.name, opts...)
+	ext.MessageBusDestination.Set(span, c.source.Name())
+	return span
+}
+
+//process 调用handler, 返回结果(ack, dead_letter, dropped, nack)
+func (c *msConsumer) process(ctx context.Context, msg *Message) (string, error) {
+	var err error
+	wait := c.params.consumerBackoff
+	for {
+		msg.Attempt++
+		err = c.call(ctx, msg)
+		if err == nil {
+			return "ack", nil
+		}
+		if errors.Is(err, ErrRejectMessage) || msg.Attempt > c.params.consumerRetries {
+			break
+		}
+		c.log.Trace(ctx).Warn("handle message error, retry", zap.Int("attempt", msg.Attempt), zap.Duration("backoff", wait), zap.Error(err))
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if wait *= 2; c.params.consumerMaxBackoff > 0 && wait > c.params.consumerMaxBackoff {
+			wait = c.params.consumerMaxBackoff
+		}
+	}
+	if queue := c.params.consumerDeadLetter; queue != "" {
+		//停止时ctx可能已经取消
+		dctx, cancel := context.WithTimeout(opentracing.ContextWithSpan(context.TODO(), opentracing.SpanFromContext(ctx)), defaultHealthTimeout)
+		defer cancel()
+		if derr := c.source.DeadLetter(dctx, queue, msg); derr != nil {
+			c.log.Trace(ctx).Error("dead letter message error", zap.String("dead_letter", queue), zap.Int("attempts", msg.Attempt), zap.NamedError("reason", err), zap.Error(derr))
+			return "nack", err
+		}
+		c.log.Trace(ctx).Warn("message dead lettered", zap.String("dead_letter", queue), zap.Int("attempts", msg.Attempt), zap.Error(err))
+		return "dead_letter", err
+	}
+	if ctx.Err() != nil {
+		return "nack", err
+	}
+	c.log.Trace(ctx).Error("message dropped", zap.Int("attempts", msg.Attempt), zap.Int("size", len(msg.Body)), zap.String("sha256", fmt.Sprintf("%x", sha256.Sum256(msg.Body))), zap.Error(err))
+	return "dropped", err
+}
+
+//call 调用handler, panic转为错误
+func (c *msConsumer) call(ctx context.Context, msg *Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("consumer %s panic: %v", c.name, r)
+		}
+	}()
+	return c.handler(ctx, msg)
+}
+
+func (c *msConsumer) Name() string {
+	return c.name
+}
+
+func (c *msConsumer) Discovery() (string, uint) {
+	return c.discoveryIP, 0
+}
+
+func (c *msConsumer) Weight() uint32 {
+	return c.params.weight
+}
+
+func (c *msConsumer) Group() string {
+	return MSGroupConsumer
+}
+
+func (c *msConsumer) Metadata() map[string]interface{} {
+	return c.params.metadata
+}
+
+//Shutdown 等待处理中的消息完成(停止接收由Start的ctx控制), ctx超时后取消处理消息的ctx
+func (c *msConsumer) Shutdown(ctx context.Context) {
+	if atomic.LoadInt32(&c.started) == 0 {
+		c.cancel()
+		return
+	}
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		c.log.Normal().Warn("consumer drain timeout", zap.String("source", c.source.Name()))
+	}
+	c.cancel()
+}
+
+//RegisterConsumer 注册消息消费的微服务(不暴露端口, 注册中心分组CONSUMER): 按并发数接收消息, handler返回nil时ack,
+//返回错误时退避重试, 超过次数后发送到死信(ParamConsumerDeadLetter)或者丢弃. 停止时不再接收, 等待处理中的消息完成
+func (c *MSManager) RegisterConsumer(name string, source ConsumerSource, handler ConsumerHandler, params ...Param) error {
+	svc, err := newConsumerMicroService(name, source, handler, c.log.With(zap.String("consumer", name)), params...)
+	if err != nil {
+		c.log.Normal().Error("register consumer", zap.Error(err), zap.String("name", name))
+		return err
+	}
+	c.Register(svc)
+	return nil
+}
+
+//RabbitMQSource RabbitMQ队列(Deps中key对应的rabbitmq依赖, 每次接收时查找, 重连和热更新后使用新的连接), 每次接收一个channel(手动ack, prefetch 1),
+//处理完成时ack, 没有处理完成时nack并重新入队, 死信使用Produce发送到队列
+func RabbitMQSource(deps *Deps, key string, queue string) ConsumerSource {
+	return &rabbitMQSource{deps: deps, key: key, queue: queue}
+}
+
+type rabbitMQSource struct {
+	deps  *Deps
+	key   string
+	queue string
+}
+
+func (c *rabbitMQSource) Name() string {
+	return c.queue
+}
+
+func (c *rabbitMQSource) dep() (*rabbitMQDep, error) {
+	client, err := c.deps.LookupRabbitMQ(c.key)
+	if err != nil {
+		return nil, err
+	}
+	dep, ok := client.(*rabbitMQDep)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not created by the builtin rabbitmq provider", ErrDepType, c.key)
+	}
+	return dep, nil
+}
+
+func (c *rabbitMQSource) Receive(ctx context.Context, handle func(context.Context, *Message) error) error {
+	dep, err := c.dep()
+	if err != nil {
+		return err
+	}
+	ch, err := dep.channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	//同amqp.Client的Produce/Consume声明
+	if _, err := ch.QueueDeclare(c.queue, true, false, false, false, nil); err != nil {
+		return err
+	}
+	if err := ch.Qos(1, 0, false); err != nil {
+		return err
+	}
+	deliveries, err := ch.Consume(c.queue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case d, ok := <-deliveries:
+			if !ok {
+				return confamqp.AMQPClosedErr
+			}
+			msg, err := rabbitMQMessage(&d)
+			if err != nil {
+				//无法解压的消息不重新入队
+				_ = d.Nack(false, false)
+				return err
+			}
+			if err := handle(ctx, msg); err != nil {
+				if err := d.Nack(false, true); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.Ack(false); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+//rabbitMQMessage 转换消息(gzip解压, 字符串的消息头用于提取追踪)
+func rabbitMQMessage(d *amqp.Delivery) (*Message, error) {
+	msg := &Message{Body: d.Body, Headers: make(map[string]string, len(d.Headers))}
+	for k, v := range d.Headers {
+		if s, ok := v.(string); ok {
+			msg.Headers[k] = s
+		}
+	}
+	if d.ContentEncoding == "gzip" {
+		r, err := gzip.NewReader(bytes.NewReader(d.Body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		if msg.Body, err = io.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+func (c *rabbitMQSource) DeadLetter(ctx context.Context, queue string, msg *Message) error {
+	dep, err := c.dep()
+	if err != nil {
+		return err
+	}
+	return dep.Produce(ctx, queue, msg.Body)
+}
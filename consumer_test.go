@@ -0,0 +1,184 @@
+package micro
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/whatisfaker/zaptrace/log"
+)
+
+//testSource 投递msgs中的消息, 记录handle的结果和死信
+type testSource struct {
+	msgs       chan *Message
+	mu         sync.Mutex
+	results    []error
+	deadLetter map[string][]*Message
+	dlqErr     error
+}
+
+func newTestSource(bodies ...string) *testSource {
+	c := &testSource{msgs: make(chan *Message, len(bodies)), deadLetter: make(map[string][]*Message)}
+	for _, b := range bodies {
+		c.msgs <- &Message{Body: []byte(b)}
+	}
+	return c
+}
+
+func (c *testSource) Name() string {
+	return "test"
+}
+
+func (c *testSource) Receive(ctx context.Context, handle func(ctx context.Context, msg *Message) error) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg := <-c.msgs:
+			err := handle(ctx, msg)
+			c.mu.Lock()
+			c.results = append(c.results, err)
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *testSource) DeadLetter(ctx context.Context, queue string, msg *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dlqErr != nil {
+		return c.dlqErr
+	}
+	c.deadLetter[queue] = append(c.deadLetter[queue], msg)
+	return nil
+}
+
+func (c *testSource) handled() ([]error, map[string][]*Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]error{}, c.results...), c.deadLetter
+}
+
+func newTestConsumer(t *testing.T, source ConsumerSource, handler ConsumerHandler, params ...Param) *msConsumer {
+	t.Helper()
+	params = append([]Param{ParamDiscoveryIP("127.0.0.1"), ParamEnableTracer(false)}, params...)
+	c, err := newConsumerMicroService("test", source, handler, log.NewStdLogger("error"), params...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestConsumerRetrySuccess(t *testing.T) {
+	source := newTestSource()
+	c := newTestConsumer(t, source, func(ctx context.Context, msg *Message) error {
+		if msg.Attempt < 3 {
+			return errors.New("busy")
+		}
+		return nil
+	}, ParamConsumerRetry(3, time.Millisecond, 0), ParamConsumerDeadLetter("dlq"))
+	msg := &Message{Body: []byte("a")}
+	if err := c.handle(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Attempt != 3 {
+		t.Fatalf("attempts %d, want 3", msg.Attempt)
+	}
+	if _, dlq := source.handled(); len(dlq["dlq"]) != 0 {
+		t.Fatalf("dead letter %v", dlq)
+	}
+}
+
+func TestConsumerDeadLetter(t *testing.T) {
+	source := newTestSource()
+	c := newTestConsumer(t, source, func(ctx context.Context, msg *Message) error {
+		return errors.New("boom")
+	}, ParamConsumerRetry(2, time.Millisecond, time.Millisecond), ParamConsumerDeadLetter("dlq"))
+	if err := c.handle(context.Background(), &Message{Body: []byte("a")}); err != nil {
+		t.Fatalf("dead lettered message not acked: %v", err)
+	}
+	_, dlq := source.handled()
+	if len(dlq["dlq"]) != 1 || dlq["dlq"][0].Attempt != 3 || string(dlq["dlq"][0].Body) != "a" {
+		t.Fatalf("dead letter %v", dlq)
+	}
+}
+
+func TestConsumerReject(t *testing.T) {
+	source := newTestSource()
+	c := newTestConsumer(t, source, func(ctx context.Context, msg *Message) error {
+		return fmt.Errorf("%w: invalid", ErrRejectMessage)
+	}, ParamConsumerRetry(3, time.Millisecond, 0), ParamConsumerDeadLetter("dlq"))
+	if err := c.handle(context.Background(), &Message{Body: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, dlq := source.handled(); len(dlq["dlq"]) != 1 || dlq["dlq"][0].Attempt != 1 {
+		t.Fatalf("rejected message retried or not dead lettered: %v", dlq)
+	}
+}
+
+func TestConsumerDeadLetterFailed(t *testing.T) {
+	source := newTestSource()
+	source.dlqErr = errors.New("dlq down")
+	c := newTestConsumer(t, source, func(ctx context.Context, msg *Message) error {
+		panic("boom")
+	}, ParamConsumerRetry(0, 0, 0), ParamConsumerDeadLetter("dlq"))
+	if err := c.handle(context.Background(), &Message{Body: []byte("a")}); err == nil {
+		t.Fatal("message acked when dead letter failed")
+	}
+}
+
+func TestConsumerDropped(t *testing.T) {
+	source := newTestSource()
+	c := newTestConsumer(t, source, func(ctx context.Context, msg *Message) error {
+		return errors.New("boom")
+	}, ParamConsumerRetry(1, time.Millisecond, 0))
+	msg := &Message{Body: []byte("a")}
+	if err := c.handle(context.Background(), msg); err != nil {
+		t.Fatalf("dropped message not acked: %v", err)
+	}
+	if msg.Attempt != 2 {
+		t.Fatalf("attempts %d, want 2", msg.Attempt)
+	}
+}
+
+func TestConsumerStart(t *testing.T) {
+	source := newTestSource("ok", "bad")
+	c := newTestConsumer(t, source, func(ctx context.Context, msg *Message) error {
+		if string(msg.Body) == "bad" {
+			return errors.New("boom")
+		}
+		return nil
+	}, ParamConsumerRetry(0, 0, 0), ParamConsumerDeadLetter("dlq"), ParamConsumerConcurrency(2))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Start(ctx)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if results, _ := source.handled(); len(results) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("messages not handled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	c.Shutdown(context.Background())
+	results, dlq := source.handled()
+	for _, err := range results {
+		if err != nil {
+			t.Fatalf("handle returned %v", err)
+		}
+	}
+	if len(dlq["dlq"]) != 1 || string(dlq["dlq"][0].Body) != "bad" {
+		t.Fatalf("dead letter %v", dlq)
+	}
+}
@@ -1,199 +1,381 @@
 package micro
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"reflect"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v7"
 	_ "github.com/influxdata/influxdb1-client" // this is important because of the bug in go mod
 	ifxclient "github.com/influxdata/influxdb1-client/v2"
 	"github.com/jinzhu/gorm"
-	"github.com/whatisfaker/conf"
 	"github.com/whatisfaker/conf/amqp"
-	"github.com/whatisfaker/gormzap"
 	"github.com/whatisfaker/zaptrace/log"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 )
 
 var ErrUnsupportedConfig = errors.New("unsupported config")
 var ErrConfigShouldPtrOrStruct = errors.New("config should be a struct or struct's pointer")
 var ErrEmptyTag = errors.New("empty tag value")
+var ErrDepNotFound = errors.New("dependency not found")
+var ErrDepType = errors.New("dependency type mismatch")
+var ErrDuplicateDep = errors.New("duplicate dependency key")
 
-func newDeps(v interface{}, structTag string, log *log.Factory) (*Deps, error) {
-	s := reflect.ValueOf(v)
-	switch s.Type().Kind() {
-	case reflect.Ptr:
-		s = s.Elem()
-		if s.Type().Kind() != reflect.Struct {
-			return nil, ErrUnsupportedConfig
-		}
-	case reflect.Struct:
-	default:
-		return nil, ErrConfigShouldPtrOrStruct
+func newDeps(v interface{}, structTag string, log *log.Factory, inst *depInstrument, init *depInit) (*Deps, error) {
+	fields, err := scanDeps(v, structTag)
+	if err != nil {
+		return nil, err
+	}
+	if init == nil {
+		init = newDepInit()
 	}
-	l := s.NumField()
 	d := &Deps{
-		deps: make(map[string]interface{}),
-		log:  log,
-	}
-	for i := 0; i < l; i++ {
-		tag := s.Type().Field(i).Tag
-		var key string
-		var ok bool
-		if key, ok = tag.Lookup(structTag); ok {
-			key = strings.Trim(key, " ")
-			if key == "" {
-				continue
+		items:    make(map[string]*depItem),
+		retiring: make(map[*depItem]*time.Timer),
+		cfgType:  reflect.Indirect(reflect.ValueOf(v)).Type(),
+		tag:      structTag,
+		init:     init,
+		inst:     inst,
+		log:      log,
+	}
+	results := d.createAll(fields)
+	if err := initError(fields, results); err != nil {
+		log.Normal().Error("init deps error", zap.Error(err))
+		for _, r := range results {
+			if r.item != nil {
+				_ = r.item.close(context.TODO())
 			}
 		}
-		f := s.Field(i).Interface()
-		switch s := f.(type) {
-		case conf.MysqlConfig:
-			dep, err := conf.MySQLClient(&s)
-			if err != nil {
-				log.Normal().Error("init mysql error", zap.String("key", key), zap.Error(err))
-				return nil, err
-			}
-			dep.SetLogger(gormzap.New(log.ZapLogger))
-			d.deps[key] = dep
-		case *conf.MysqlConfig:
-			dep, err := conf.MySQLClient(s)
-			if err != nil {
-				log.Normal().Error("init mysql error", zap.String("key", key), zap.Error(err))
-				return nil, err
-			}
-			dep.SetLogger(gormzap.New(log.ZapLogger))
-			d.deps[key] = dep
-		case conf.RedisConfig:
-			dep, err := conf.RedisClient(&s)
-			if err != nil {
-				log.Normal().Error("init redis error", zap.String("key", key), zap.Error(err))
-				return nil, err
-			}
-			d.deps[key] = dep
-		case *conf.RedisConfig:
-			dep, err := conf.RedisClient(s)
-			if err != nil {
-				log.Normal().Error("init redis error", zap.String("key", key), zap.Error(err))
-				return nil, err
-			}
-			d.deps[key] = dep
-		case conf.MongoDBConfig:
-			dep, err := conf.MongoDBClient(&s)
-			if err != nil {
-				log.Normal().Error("init mongodb error", zap.String("key", key), zap.Error(err))
-				return nil, err
-			}
-			d.deps[key] = dep
-		case *conf.MongoDBConfig:
-			dep, err := conf.MongoDBClient(s)
-			if err != nil {
-				log.Normal().Error("init mongodb error", zap.String("key", key), zap.Error(err))
-				return nil, err
-			}
-			d.deps[key] = dep
-		case conf.RabbitMQConfig:
-			dep := amqp.NewRabbitMQClient(s.Address, s.Username, s.Password, log.With(zap.String("agent", "rabbitmq")), false)
-			d.deps[key] = dep
-		case *conf.RabbitMQConfig:
-			dep := amqp.NewRabbitMQClient(s.Address, s.Username, s.Password, log.With(zap.String("agent", "rabbitmq")), false)
-			d.deps[key] = dep
-		case conf.InfluxConfig:
-			influxConfig := ifxclient.HTTPConfig{
-				Addr:     s.Addr,
-				Username: s.UserName,
-				Password: s.Password,
-				Timeout:  30 * time.Second,
-			}
-			influxClient, err := ifxclient.NewHTTPClient(influxConfig)
-			if err != nil {
-				log.Normal().Error("init influx db error", zap.String("key", key), zap.Error(err))
-				return nil, err
-			}
-			_, _, err = influxClient.Ping(2 * time.Second)
-			if err != nil {
-				log.Normal().Error("init influx db error, ping error", zap.String("key", key), zap.Error(err))
-				return nil, err
-			}
-			d.deps[key] = influxClient
-		case *conf.InfluxConfig:
-			influxConfig := ifxclient.HTTPConfig{
-				Addr:     s.Addr,
-				Username: s.UserName,
-				Password: s.Password,
-				Timeout:  30 * time.Second,
-			}
-			influxClient, err := ifxclient.NewHTTPClient(influxConfig)
-			if err != nil {
-				log.Normal().Error("init influx db error", zap.String("key", key), zap.Error(err))
-				return nil, err
-			}
-			_, _, err = influxClient.Ping(2 * time.Second)
-			if err != nil {
-				log.Normal().Error("init influx db error, ping error", zap.String("key", key), zap.Error(err))
-				return nil, err
-			}
-			d.deps[key] = influxClient
-		default:
+		return nil, err
+	}
+	for i, f := range fields {
+		r := &DepReport{Field: f.name, Key: f.key, Type: f.typ, Optional: f.optional}
+		d.report = append(d.report, r)
+		if f.provider == nil {
+			r.Result = DepUnsupported
+			continue
 		}
+		r.Type = f.provider.name
+		if f.cfg == nil {
+			r.Result = DepSkipped
+			r.Error = "nil config"
+			continue
+		}
+		if err := results[i].err; err != nil {
+			log.Normal().Warn("init optional "+f.provider.name+" error, skipped", zap.String("key", f.key), zap.Error(err))
+			r.Result = DepSkipped
+			r.Error = err.Error()
+			continue
+		}
+		d.add(f.key, results[i].item)
+		r.Result = DepCreated
 	}
+	d.logReport()
 	return d, nil
 }
 
+//depItem 创建的依赖和它的配置
+type depItem struct {
+	provider *depProvider
+	cfg      interface{}
+	//snapshot 创建时的配置(factory可能修改cfg), 检查配置变化
+	snapshot interface{}
+	dep      interface{}
+	check    HealthCheck
+}
+
+func (c *depItem) close(ctx context.Context) error {
+	if c.provider.closer == nil {
+		return nil
+	}
+	return c.provider.closer(ctx, c.dep)
+}
+
 type Deps struct {
-	deps map[string]interface{}
-	log  *log.Factory
+	mu       sync.RWMutex
+	items    map[string]*depItem
+	keys     []string
+	report   []*DepReport
+	retiring map[*depItem]*time.Timer
+	closed   bool
+	cfgType  reflect.Type
+	tag      string
+	init     *depInit
+	inst     *depInstrument
+	log      *log.Factory
 }
 
-func (c *Deps) GetMySQL(key string) *gorm.DB {
-	if v, ok := c.deps[key]; ok {
-		if r, ok := v.(*gorm.DB); ok {
-			return r
+func (c *Deps) env(ctx context.Context, key string) *DepEnv {
+	return &DepEnv{Key: key, Log: c.log, ctx: ctx, inst: c.inst}
+}
+
+//create 根据配置创建依赖
+func (c *Deps) create(ctx context.Context, f *depField) (*depItem, error) {
+	snapshot := reflect.ValueOf(f.cfg).Elem().Interface()
+	dep, err := f.provider.factory(c.env(ctx, f.key), f.cfg)
+	if err != nil {
+		return nil, err
+	}
+	v := &depItem{provider: f.provider, cfg: f.cfg, snapshot: snapshot, dep: dep}
+	if f.provider.check != nil {
+		v.check = f.provider.check(f.cfg, dep)
+	}
+	return v, nil
+}
+
+//add 记录创建的依赖(keys为创建顺序)
+func (c *Deps) add(key string, v *depItem) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[key]; !ok {
+		c.keys = append(c.keys, key)
+	}
+	c.items[key] = v
+}
+
+//item 当前的依赖(重连后替换)
+func (c *Deps) item(key string) (*depItem, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok := c.items[key]
+	return v, ok
+}
+
+//Keys 依赖的key(创建顺序)
+func (c *Deps) Keys() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v := make([]string, len(c.keys))
+	copy(v, c.keys)
+	return v
+}
+
+//Get 按key获取依赖并转换为T, 如micro.Get[*gorm.DB](deps, "db")
+func Get[T any](d *Deps, key string) (T, error) {
+	var zero T
+	item, ok := d.item(key)
+	if !ok {
+		if r := d.reportOf(key); r != nil && r.Result != DepCreated {
+			return zero, fmt.Errorf("%w: %s %s (%s)", ErrDepNotFound, key, r.Result, r.Error)
 		}
+		return zero, fmt.Errorf("%w: %s", ErrDepNotFound, key)
 	}
-	c.log.Normal().Fatal("miss gorm db key", zap.String("key", key))
-	return nil
+	r, ok := item.dep.(T)
+	if !ok {
+		return zero, fmt.Errorf("%w: %s is %T", ErrDepType, key, item.dep)
+	}
+	return r, nil
 }
 
-func (c *Deps) GetRedis(key string) redis.Cmdable {
-	if v, ok := c.deps[key]; ok {
-		if r, ok := v.(redis.Cmdable); ok {
-			return r
+//Close 按创建的逆序关闭依赖(RunWith在服务停止后自动关闭ParseConfig创建的依赖), 重复调用不会重复关闭
+func (c *Deps) Close(ctx context.Context) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	keys := make([]string, len(c.keys))
+	copy(keys, c.keys)
+	items := make([]*depItem, len(keys))
+	for i, key := range keys {
+		items[i] = c.items[key]
+	}
+	retiring := make([]*depItem, 0, len(c.retiring))
+	for item, timer := range c.retiring {
+		if timer.Stop() {
+			retiring = append(retiring, item)
+		}
+	}
+	c.retiring = make(map[*depItem]*time.Timer)
+	c.mu.Unlock()
+	var errs error
+	//配置变化后等待关闭的旧依赖
+	for _, item := range retiring {
+		if err := item.close(ctx); err != nil {
+			errs = multierr.Append(errs, err)
 		}
 	}
-	c.log.Normal().Fatal("miss redis client key", zap.String("key", key))
-	return nil
+	for i := len(items) - 1; i >= 0; i-- {
+		if err := items[i].close(ctx); err != nil {
+			c.log.Normal().Warn("close "+items[i].provider.name+" error", zap.String("key", keys[i]), zap.Error(err))
+			errs = multierr.Append(errs, fmt.Errorf("%s: %w", keys[i], err))
+		}
+	}
+	return errs
 }
 
-func (c *Deps) GetMongoDB(key string) *mongo.Client {
-	if v, ok := c.deps[key]; ok {
-		if r, ok := v.(*mongo.Client); ok {
-			return r
+//HealthChecks 依赖的连接检查(ParseConfig自动增加为管理器的就绪检查deps.<key>)
+func (c *Deps) HealthChecks() map[string]HealthCheck {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v := make(map[string]HealthCheck, len(c.items))
+	for key, item := range c.items {
+		if item.check == nil {
+			continue
 		}
+		key := key
+		//重连后检查新的依赖
+		v[key] = func(ctx context.Context) error {
+			if item, ok := c.item(key); ok && item.check != nil {
+				return item.check(ctx)
+			}
+			return nil
+		}
+	}
+	return v
+}
+
+//status 检查依赖的状态
+func (c *Deps) status(ctx context.Context, key string) *DepStatus {
+	v := &DepStatus{
+		Key:    key,
+		Status: "unknown",
+	}
+	item, ok := c.item(key)
+	if !ok {
+		return v
+	}
+	v.Type = item.provider.name
+	if item.check == nil {
+		return v
 	}
-	c.log.Normal().Fatal("miss mongo db key", zap.String("key", key))
-	return nil
+	r := (&healthCheck{name: key, check: item.check, timeout: defaultHealthTimeout}).run(ctx)
+	v.Status = r.Status
+	v.Error = r.Error
+	v.Latency = r.Latency
+	return v
+}
+
+//GetMySQL 获取依赖, 没有key或者类型不匹配时Fatal(可以降级时使用LookupMySQL), 主从配置时不能调用DB()(见MySQLRouter)
+func (c *Deps) GetMySQL(key string) *gorm.DB {
+	r, err := c.LookupMySQL(key)
+	if err != nil {
+		c.log.Normal().Fatal("miss gorm db key", zap.String("key", key), zap.Error(err))
+	}
+	return r
+}
+
+//LookupMySQL 获取依赖, 没有key(包括optional创建失败)或者类型不匹配时返回错误, 主从配置时返回读写分离的*gorm.DB(不能调用DB())
+func (c *Deps) LookupMySQL(key string) (*gorm.DB, error) {
+	if r, err := Get[*MySQLRouter](c, key); err == nil {
+		return r.DB(), nil
+	}
+	return Get[*gorm.DB](c, key)
+}
+
+//GetMySQLRouter 获取mysql读写分离的路由(MySQLClusterConfig), 没有key或者类型不匹配时Fatal
+func (c *Deps) GetMySQLRouter(key string) *MySQLRouter {
+	r, err := c.LookupMySQLRouter(key)
+	if err != nil {
+		c.log.Normal().Fatal("miss mysql router key", zap.String("key", key), zap.Error(err))
+	}
+	return r
+}
+
+//LookupMySQLRouter 获取mysql读写分离的路由(MySQLClusterConfig)
+func (c *Deps) LookupMySQLRouter(key string) (*MySQLRouter, error) {
+	return Get[*MySQLRouter](c, key)
+}
+
+//GetMySQLContext 获取绑定请求context的gorm db(调用自动成为请求的子span), 主从配置时按请求context选择(MySQLRouter.Context)
+func (c *Deps) GetMySQLContext(ctx context.Context, key string) *gorm.DB {
+	if r, err := Get[*MySQLRouter](c, key); err == nil {
+		return r.Context(ctx)
+	}
+	return MySQLWithContext(ctx, c.GetMySQL(key))
+}
+
+//GetRedis 获取依赖, 没有key或者类型不匹配时Fatal(可以降级时使用LookupRedis)
+func (c *Deps) GetRedis(key string) redis.Cmdable {
+	r, err := c.LookupRedis(key)
+	if err != nil {
+		c.log.Normal().Fatal("miss redis client key", zap.String("key", key), zap.Error(err))
+	}
+	return r
+}
+
+//LookupRedis 获取依赖, 没有key(包括optional创建失败)或者类型不匹配时返回错误
+func (c *Deps) LookupRedis(key string) (redis.Cmdable, error) {
+	return Get[redis.Cmdable](c, key)
 }
 
+//GetRedisContext 获取绑定请求context的redis客户端(调用自动成为请求的子span)
+func (c *Deps) GetRedisContext(ctx context.Context, key string) redis.Cmdable {
+	return RedisWithContext(ctx, c.GetRedis(key))
+}
+
+//GetMongoDB 获取依赖, 没有key或者类型不匹配时Fatal(可以降级时使用LookupMongoDB)
+func (c *Deps) GetMongoDB(key string) *mongo.Client {
+	r, err := c.LookupMongoDB(key)
+	if err != nil {
+		c.log.Normal().Fatal("miss mongo db key", zap.String("key", key), zap.Error(err))
+	}
+	return r
+}
+
+//LookupMongoDB 获取依赖, 没有key(包括optional创建失败)或者类型不匹配时返回错误
+func (c *Deps) LookupMongoDB(key string) (*mongo.Client, error) {
+	return Get[*mongo.Client](c, key)
+}
+
+//GetInflux 获取依赖, 没有key或者类型不匹配时Fatal(可以降级时使用LookupInflux)
 func (c *Deps) GetInflux(key string) ifxclient.Client {
-	if v, ok := c.deps[key]; ok {
-		if r, ok := v.(ifxclient.Client); ok {
-			return r
-		}
+	r, err := c.LookupInflux(key)
+	if err != nil {
+		c.log.Normal().Fatal("miss influx key", zap.String("key", key), zap.Error(err))
 	}
-	c.log.Normal().Fatal("miss influx key", zap.String("key", key))
-	return nil
+	return r
 }
 
+//LookupInflux 获取依赖, 没有key(包括optional创建失败)或者类型不匹配时返回错误
+func (c *Deps) LookupInflux(key string) (ifxclient.Client, error) {
+	return Get[ifxclient.Client](c, key)
+}
+
+//GetRabbitMQ 获取依赖, 没有key或者类型不匹配时Fatal(可以降级时使用LookupRabbitMQ)
 func (c *Deps) GetRabbitMQ(key string) amqp.Client {
-	if v, ok := c.deps[key]; ok {
-		if r, ok := v.(amqp.Client); ok {
-			return r
-		}
+	r, err := c.LookupRabbitMQ(key)
+	if err != nil {
+		c.log.Normal().Fatal("miss rabbitmq key", zap.String("key", key), zap.Error(err))
 	}
-	c.log.Normal().Fatal("miss rabbitmq key", zap.String("key", key))
-	return nil
+	return r
+}
+
+//LookupRabbitMQ 获取依赖, 没有key(包括optional创建失败)或者类型不匹配时返回错误
+func (c *Deps) LookupRabbitMQ(key string) (amqp.Client, error) {
+	return Get[amqp.Client](c, key)
+}
+
+//GetKafkaProducer 获取依赖(发送时注入追踪到消息的headers)
+func (c *Deps) GetKafkaProducer(key string) KafkaProducer {
+	r, err := c.LookupKafkaProducer(key)
+	if err != nil {
+		c.log.Normal().Fatal("miss kafka producer key", zap.String("key", key), zap.Error(err))
+	}
+	return r
+}
+
+//LookupKafkaProducer 获取依赖, 没有key(包括optional创建失败)或者类型不匹配时返回错误
+func (c *Deps) LookupKafkaProducer(key string) (KafkaProducer, error) {
+	return Get[KafkaProducer](c, key)
+}
+
+//GetKafkaConsumer 获取依赖(消费循环使用MSManager.ConsumeKafka)
+func (c *Deps) GetKafkaConsumer(key string) KafkaConsumer {
+	r, err := c.LookupKafkaConsumer(key)
+	if err != nil {
+		c.log.Normal().Fatal("miss kafka consumer key", zap.String("key", key), zap.Error(err))
+	}
+	return r
+}
+
+//LookupKafkaConsumer 获取依赖, 没有key(包括optional创建失败)或者类型不匹配时返回错误
+func (c *Deps) LookupKafkaConsumer(key string) (KafkaConsumer, error) {
+	return Get[KafkaConsumer](c, key)
 }
@@ -0,0 +1,139 @@
+package micro
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+const (
+	//defaultDepInitTimeout 每次创建依赖的默认超时
+	defaultDepInitTimeout = 30 * time.Second
+	//defaultDepInitTotal ParseConfig创建所有依赖的默认超时
+	defaultDepInitTotal = 2 * time.Minute
+	//defaultDepInitRetries 启动时创建失败的默认重试次数
+	defaultDepInitRetries = 2
+)
+
+//depInit 依赖的创建超时和重试
+type depInit struct {
+	//timeout 每次创建的超时(包括重连和热更新)
+	timeout time.Duration
+	//total 所有依赖(包括重试)的超时
+	total time.Duration
+	//retries 启动时创建失败的重试次数
+	retries     int
+	backoffBase time.Duration
+	backoffMax  time.Duration
+}
+
+func newDepInit() *depInit {
+	return &depInit{
+		timeout:     defaultDepInitTimeout,
+		total:       defaultDepInitTotal,
+		retries:     defaultDepInitRetries,
+		backoffBase: 500 * time.Millisecond,
+		backoffMax:  5 * time.Second,
+	}
+}
+
+//backoff 第attempt次重试前的等待时间
+func (c *depInit) backoff(attempt int) time.Duration {
+	d := c.backoffBase << uint(attempt)
+	if d <= 0 || (c.backoffMax > 0 && d > c.backoffMax) {
+		d = c.backoffMax
+	}
+	return d
+}
+
+type depResult struct {
+	item *depItem
+	err  error
+}
+
+//createTimeout 带超时创建依赖, 超时后才创建成功的依赖会被关闭
+func (c *Deps) createTimeout(ctx context.Context, f *depField) (*depItem, error) {
+	if c.init.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.init.timeout)
+		defer cancel()
+	}
+	ch := make(chan depResult, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				ch <- depResult{err: fmt.Errorf("init %s panic: %v", f.provider.name, r)}
+			}
+		}()
+		item, err := c.create(ctx, f)
+		ch <- depResult{item: item, err: err}
+	}()
+	select {
+	case r := <-ch:
+		return r.item, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.err == nil {
+				_ = r.item.close(context.TODO())
+			}
+		}()
+		return nil, fmt.Errorf("init %s: %w", f.provider.name, ctx.Err())
+	}
+}
+
+//createRetry 启动时创建依赖, 失败时退避重试
+func (c *Deps) createRetry(ctx context.Context, f *depField) (*depItem, error) {
+	for attempt := 0; ; attempt++ {
+		item, err := c.createTimeout(ctx, f)
+		if err == nil || attempt >= c.init.retries || ctx.Err() != nil {
+			return item, err
+		}
+		wait := c.init.backoff(attempt)
+		c.log.Normal().Warn("init "+f.provider.name+" error, retry", zap.String("key", f.key), zap.Int("attempt", attempt+1), zap.Duration("backoff", wait), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+//createAll 并发创建依赖, 返回的结果和fields的顺序相同
+func (c *Deps) createAll(fields []*depField) []depResult {
+	ctx := context.Background()
+	if c.init.total > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.init.total)
+		defer cancel()
+	}
+	results := make([]depResult, len(fields))
+	var wg sync.WaitGroup
+	for i, f := range fields {
+		if f.provider == nil || f.cfg == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, f *depField) {
+			defer wg.Done()
+			item, err := c.createRetry(ctx, f)
+			results[i] = depResult{item: item, err: err}
+		}(i, f)
+	}
+	wg.Wait()
+	return results
+}
+
+//initError 创建失败的依赖(每个key一个错误)
+func initError(fields []*depField, results []depResult) error {
+	var errs error
+	for i, r := range results {
+		if r.err != nil && !fields[i].optional {
+			errs = multierr.Append(errs, fmt.Errorf("%s: %w", fields[i].key, r.err))
+		}
+	}
+	return errs
+}
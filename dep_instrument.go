@@ -0,0 +1,378 @@
+package micro
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	ifxclient "github.com/influxdata/influxdb1-client/v2"
+	"github.com/jinzhu/gorm"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/whatisfaker/conf"
+	"github.com/whatisfaker/conf/amqp"
+	"github.com/whatisfaker/zaptrace/log"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	mongooptions "go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+const (
+	gormContextKey = "micro:context"
+	gormCallKey    = "micro:call"
+
+	//defaultSlowThreshold 默认的慢调用阈值
+	defaultSlowThreshold = 500 * time.Millisecond
+	maxStatementLen      = 1024
+)
+
+//depInstrument 依赖客户端(ParseConfig创建)的自动埋点: 追踪, 指标, 慢调用日志
+type depInstrument struct {
+	tracer  func(dep string) opentracing.Tracer
+	metrics *metrics
+	log     *log.Factory
+	slow    map[string]time.Duration
+}
+
+func (c *MSManager) depInstrument() *depInstrument {
+	return &depInstrument{
+		tracer:  c.DepTracer,
+		metrics: c.metrics,
+		log:     c.logs.with(LogDeps, zap.String("deps", "instrument")),
+		slow:    c.options.slowThresholds,
+	}
+}
+
+//depCall 一次依赖调用
+type depCall struct {
+	ctx   context.Context
+	span  opentracing.Span
+	start time.Time
+}
+
+//start 开始一次调用, ctx中没有父span(不在请求内的调用)时只统计不追踪
+func (c *depInstrument) start(ctx context.Context, dep string, op string) *depCall {
+	call := &depCall{
+		ctx:   ctx,
+		start: time.Now(),
+	}
+	if ctx == nil {
+		call.ctx = context.TODO()
+		return call
+	}
+	parent := opentracing.SpanFromContext(ctx)
+	if parent == nil {
+		return call
+	}
+	call.span = c.tracer(dep).StartSpan(dep+"."+op, opentracing.ChildOf(parent.Context()), ext.SpanKindRPCClient)
+	ext.DBType.Set(call.span, dep)
+	call.ctx = opentracing.ContextWithSpan(ctx, call.span)
+	return call
+}
+
+//finish 结束调用: 结束span, 记录指标, 超过阈值打印慢调用日志
+func (c *depInstrument) finish(call *depCall, dep string, key string, op string, statement string, err error) {
+	d := time.Since(call.start)
+	if len(statement) > maxStatementLen {
+		statement = statement[:maxStatementLen]
+	}
+	if call.span != nil {
+		if statement != "" {
+			ext.DBStatement.Set(call.span, statement)
+		}
+		if err != nil {
+			ext.Error.Set(call.span, true)
+			call.span.LogFields(otlog.Error(err))
+		}
+		call.span.Finish()
+	}
+	if c.metrics != nil {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		c.metrics.depRequests.WithLabelValues(dep, key, op, result).Inc()
+		c.metrics.depDuration.WithLabelValues(dep, key, op).Observe(d.Seconds())
+	}
+	threshold := defaultSlowThreshold
+	if v, ok := c.slow[dep]; ok {
+		threshold = v
+	}
+	if threshold > 0 && d >= threshold {
+		c.log.Trace(call.ctx).Warn("slow dependency call", zap.String("dep", dep), zap.String("key", key), zap.String("op", op), zap.Duration("duration", d), zap.String("statement", statement), zap.Error(err))
+	}
+}
+
+//MySQLWithContext 绑定请求的context(gorm v1的调用没有context参数), 之后的调用自动成为请求的子span
+func MySQLWithContext(ctx context.Context, db *gorm.DB) *gorm.DB {
+	return db.Set(gormContextKey, ctx)
+}
+
+//gorm 注册gorm回调
+func (c *depInstrument) gorm(key string, db *gorm.DB) {
+	if c == nil {
+		return
+	}
+	before := func(op string) func(*gorm.Scope) {
+		return func(scope *gorm.Scope) {
+			var ctx context.Context
+			if v, ok := scope.Get(gormContextKey); ok {
+				ctx, _ = v.(context.Context)
+			}
+			scope.Set(gormCallKey, c.start(ctx, DepMySQL, op))
+		}
+	}
+	after := func(op string) func(*gorm.Scope) {
+		return func(scope *gorm.Scope) {
+			v, ok := scope.Get(gormCallKey)
+			if !ok {
+				return
+			}
+			call, ok := v.(*depCall)
+			if !ok {
+				return
+			}
+			if call.span != nil {
+				call.span.SetTag("db.table", scope.TableName())
+			}
+			err := scope.DB().Error
+			if gorm.IsRecordNotFoundError(err) {
+				err = nil
+			}
+			c.finish(call, DepMySQL, key, op, scope.SQL, err)
+		}
+	}
+	cb := db.Callback()
+	cb.Create().Before("gorm:create").Register("micro:before_create", before("create"))
+	cb.Create().After("gorm:create").Register("micro:after_create", after("create"))
+	cb.Query().Before("gorm:query").Register("micro:before_query", before("query"))
+	cb.Query().After("gorm:query").Register("micro:after_query", after("query"))
+	cb.Update().Before("gorm:update").Register("micro:before_update", before("update"))
+	cb.Update().After("gorm:update").Register("micro:after_update", after("update"))
+	cb.Delete().Before("gorm:delete").Register("micro:before_delete", before("delete"))
+	cb.Delete().After("gorm:delete").Register("micro:after_delete", after("delete"))
+	cb.RowQuery().Before("gorm:row_query").Register("micro:before_row_query", before("row_query"))
+	cb.RowQuery().After("gorm:row_query").Register("micro:after_row_query", after("row_query"))
+}
+
+//redis 添加redis hook(client.WithContext(ctx)的调用自动成为请求的子span)
+func (c *depInstrument) redis(key string, client redis.Cmdable) {
+	if c == nil {
+		return
+	}
+	if h, ok := client.(interface{ AddHook(redis.Hook) }); ok {
+		h.AddHook(&redisHook{inst: c, key: key})
+	}
+}
+
+type redisCallKey struct{}
+
+type redisHook struct {
+	inst *depInstrument
+	key  string
+}
+
+func (c *redisHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	call := c.inst.start(ctx, DepRedis, cmd.Name())
+	return context.WithValue(call.ctx, redisCallKey{}, call), nil
+}
+
+func (c *redisHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if call, ok := ctx.Value(redisCallKey{}).(*depCall); ok {
+		err := cmd.Err()
+		if err == redis.Nil {
+			err = nil
+		}
+		c.inst.finish(call, DepRedis, c.key, cmd.Name(), redisStatement(cmd), err)
+	}
+	return nil
+}
+
+//redisStatement 命令名和key(不包含值和返回结果)
+func redisStatement(cmd redis.Cmder) string {
+	args := cmd.Args()
+	if len(args) < 2 {
+		return cmd.Name()
+	}
+	return fmt.Sprintf("%s %v", cmd.Name(), args[1])
+}
+
+func (c *redisHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	call := c.inst.start(ctx, DepRedis, "pipeline")
+	if call.span != nil {
+		call.span.SetTag("redis.cmds", len(cmds))
+	}
+	return context.WithValue(call.ctx, redisCallKey{}, call), nil
+}
+
+func (c *redisHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	if call, ok := ctx.Value(redisCallKey{}).(*depCall); ok {
+		var err error
+		for _, cmd := range cmds {
+			if e := cmd.Err(); e != nil && e != redis.Nil {
+				err = e
+				break
+			}
+		}
+		c.inst.finish(call, DepRedis, c.key, "pipeline", "", err)
+	}
+	return nil
+}
+
+//mongoMonitor mongo命令监听, 按RequestID关联开始和结束
+func (c *depInstrument) mongoMonitor(key string) *event.CommandMonitor {
+	if c == nil {
+		return nil
+	}
+	var calls sync.Map
+	finish := func(requestID int64, op string, err error) {
+		if v, ok := calls.Load(requestID); ok {
+			calls.Delete(requestID)
+			c.finish(v.(*depCall), DepMongo, key, op, "", err)
+		}
+	}
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, evt *event.CommandStartedEvent) {
+			call := c.start(ctx, DepMongo, evt.CommandName)
+			if call.span != nil {
+				ext.DBInstance.Set(call.span, evt.DatabaseName)
+				call.span.SetTag("mongo.request_id", strconv.FormatInt(evt.RequestID, 10))
+			}
+			calls.Store(evt.RequestID, call)
+		},
+		Succeeded: func(ctx context.Context, evt *event.CommandSucceededEvent) {
+			finish(evt.RequestID, evt.CommandName, nil)
+		},
+		Failed: func(ctx context.Context, evt *event.CommandFailedEvent) {
+			finish(evt.RequestID, evt.CommandName, errors.New(evt.Failure))
+		},
+	}
+}
+
+//newMongoClient 同conf.MongoDBClient, 可以设置命令监听
+func newMongoClient(ctx context.Context, cfg *conf.MongoDBConfig, monitor *event.CommandMonitor) (*mongo.Client, error) {
+	opts := mongooptions.Client().ApplyURI(cfg.URI)
+	if monitor != nil {
+		opts.SetMonitor(monitor)
+	}
+	client, err := mongo.NewClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ContextTimeout == 0 {
+		cfg.ContextTimeout = 30 * time.Second
+	}
+	connectCtx, cancel := context.WithTimeout(ctx, cfg.ContextTimeout)
+	defer cancel()
+	err = client.Connect(connectCtx)
+	if err != nil {
+		return nil, err
+	}
+	pingCtx, cancel := context.WithTimeout(ctx, cfg.ContextTimeout)
+	defer cancel()
+	err = client.Ping(pingCtx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+//influx 包装influx客户端(调用没有context, 只统计指标和慢调用)
+func (c *depInstrument) influx(key string, client ifxclient.Client) ifxclient.Client {
+	if c == nil {
+		return client
+	}
+	return &influxClient{Client: client, inst: c, key: key}
+}
+
+type influxClient struct {
+	ifxclient.Client
+	inst *depInstrument
+	key  string
+}
+
+func (c *influxClient) Write(bp ifxclient.BatchPoints) error {
+	call := c.inst.start(context.TODO(), DepInflux, "write")
+	err := c.Client.Write(bp)
+	c.inst.finish(call, DepInflux, c.key, "write", bp.Database(), err)
+	return err
+}
+
+func (c *influxClient) Query(q ifxclient.Query) (*ifxclient.Response, error) {
+	call := c.inst.start(context.TODO(), DepInflux, "query")
+	resp, err := c.Client.Query(q)
+	if err == nil && resp != nil {
+		err = resp.Error()
+	}
+	c.inst.finish(call, DepInflux, c.key, "query", q.Command, err)
+	return resp, err
+}
+
+func (c *influxClient) QueryAsChunk(q ifxclient.Query) (*ifxclient.ChunkedResponse, error) {
+	call := c.inst.start(context.TODO(), DepInflux, "query_chunk")
+	resp, err := c.Client.QueryAsChunk(q)
+	c.inst.finish(call, DepInflux, c.key, "query_chunk", q.Command, err)
+	return resp, err
+}
+
+//rabbitMQ 包装rabbitmq客户端, 发布和消费回调统计指标
+func (c *depInstrument) rabbitMQ(key string, client amqp.Client) amqp.Client {
+	if c == nil {
+		return client
+	}
+	return &rabbitMQClient{Client: client, inst: c, key: key}
+}
+
+type rabbitMQClient struct {
+	amqp.Client
+	inst *depInstrument
+	key  string
+}
+
+func (c *rabbitMQClient) Pub(ctx context.Context, exchange string, data []byte, compressed ...bool) error {
+	call := c.inst.start(ctx, DepRabbitMQ, "pub")
+	err := c.Client.Pub(call.ctx, exchange, data, compressed...)
+	c.inst.finish(call, DepRabbitMQ, c.key, "pub", exchange, err)
+	return err
+}
+
+func (c *rabbitMQClient) RoutePub(ctx context.Context, exchange string, route string, data []byte, compressed ...bool) error {
+	call := c.inst.start(ctx, DepRabbitMQ, "route_pub")
+	err := c.Client.RoutePub(call.ctx, exchange, route, data, compressed...)
+	c.inst.finish(call, DepRabbitMQ, c.key, "route_pub", exchange+"/"+route, err)
+	return err
+}
+
+func (c *rabbitMQClient) Produce(ctx context.Context, queue string, data []byte, compressed ...bool) error {
+	call := c.inst.start(ctx, DepRabbitMQ, "produce")
+	err := c.Client.Produce(call.ctx, queue, data, compressed...)
+	c.inst.finish(call, DepRabbitMQ, c.key, "produce", queue, err)
+	return err
+}
+
+func (c *rabbitMQClient) callback(op string, name string, callback func(context.Context, []byte) error) func(context.Context, []byte) error {
+	return func(ctx context.Context, data []byte) error {
+		call := c.inst.start(ctx, DepRabbitMQ, op)
+		err := callback(call.ctx, data)
+		c.inst.finish(call, DepRabbitMQ, c.key, op, name, err)
+		return err
+	}
+}
+
+func (c *rabbitMQClient) Sub(ctx context.Context, exchange string, callback func(context.Context, []byte) error) error {
+	return c.Client.Sub(ctx, exchange, c.callback("sub", exchange, callback))
+}
+
+func (c *rabbitMQClient) RouteSub(ctx context.Context, exchange string, route string, callback func(context.Context, []byte) error) error {
+	return c.Client.RouteSub(ctx, exchange, route, c.callback("route_sub", exchange+"/"+route, callback))
+}
+
+func (c *rabbitMQClient) Consume(ctx context.Context, queue string, callback func(context.Context, []byte) error) error {
+	return c.Client.Consume(ctx, queue, c.callback("consume", queue, callback))
+}
@@ -0,0 +1,284 @@
+package micro
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	ifxclient "github.com/influxdata/influxdb1-client/v2"
+	"github.com/jinzhu/gorm"
+	"github.com/opentracing/opentracing-go"
+	"github.com/whatisfaker/conf"
+	"github.com/whatisfaker/conf/amqp"
+	"github.com/whatisfaker/gormzap"
+	"github.com/whatisfaker/zaptrace/log"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+//DepFactory 根据配置创建依赖, cfg为配置结构体的指针(值类型的字段传入副本的指针)
+type DepFactory func(env *DepEnv, cfg interface{}) (interface{}, error)
+
+//DepCloser 关闭依赖
+type DepCloser func(ctx context.Context, dep interface{}) error
+
+//DepCheck 创建依赖的连接检查(ParseConfig增加为就绪检查deps.<key>)
+type DepCheck func(cfg interface{}, dep interface{}) HealthCheck
+
+//DepEnv 创建依赖的环境
+type DepEnv struct {
+	//Key 配置字段的tag
+	Key string
+	//Log 依赖使用的日志(deps子系统)
+	Log  *log.Factory
+	ctx  context.Context
+	inst *depInstrument
+}
+
+//Context 创建的context, 超过每个依赖的创建超时(DepInitTimeout)时取消
+func (c *DepEnv) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+//Tracer 依赖使用的tracer(SetDepTracer设置), 没有设置时为全局tracer
+func (c *DepEnv) Tracer(dep string) opentracing.Tracer {
+	if c.inst == nil || c.inst.tracer == nil {
+		return opentracing.GlobalTracer()
+	}
+	return c.inst.tracer(dep)
+}
+
+//DepOption 依赖的设置(RegisterDepProvider)
+type DepOption interface {
+	apply(*depProvider)
+}
+
+type depOption struct {
+	f func(*depProvider)
+}
+
+func (c *depOption) apply(o *depProvider) {
+	c.f(o)
+}
+
+func newDepOption(f func(*depProvider)) *depOption {
+	return &depOption{
+		f: f,
+	}
+}
+
+//DepReconnect 定时(interval)执行连接检查, 失败时重新创建依赖并关闭旧的依赖(客户端不能自动重连时使用), 创建失败时指数退避重试(最大maxBackoff)
+func DepReconnect(interval time.Duration, maxBackoff time.Duration) DepOption {
+	return newDepOption(func(o *depProvider) {
+		o.reconnect = interval
+		o.maxBackoff = maxBackoff
+	})
+}
+
+//depProvider 一种配置类型的依赖
+type depProvider struct {
+	name       string
+	factory    DepFactory
+	closer     DepCloser
+	check      DepCheck
+	reconnect  time.Duration
+	maxBackoff time.Duration
+}
+
+//backoff 重新创建失败后的等待时间
+func (c *depProvider) backoff(attempt int) time.Duration {
+	d := c.reconnect << uint(attempt)
+	if d <= 0 || (c.maxBackoff > 0 && d > c.maxBackoff) {
+		d = c.maxBackoff
+	}
+	if d <= 0 {
+		d = c.reconnect
+	}
+	return d
+}
+
+var depProviders = struct {
+	sync.RWMutex
+	m map[reflect.Type]*depProvider
+}{m: make(map[reflect.Type]*depProvider)}
+
+//RegisterDepProvider 注册配置类型的依赖(ParseConfig按字段的类型创建), configType为配置结构体的值或指针, 如RegisterDepProvider(ElasticConfig{}, ...)
+//同一类型重复注册时替换(可以替换内置的mysql, redis, mongodb, rabbitmq, influx, kafka), closer和check可以为nil
+//返回的restore恢复注册之前的依赖(例如测试中替换后恢复)
+func RegisterDepProvider(configType interface{}, factory DepFactory, closer DepCloser, check DepCheck, opts ...DepOption) (restore func()) {
+	t := depConfigType(configType)
+	return registerDepProvider(t.String(), t, factory, closer, check, opts...)
+}
+
+func registerDepProvider(name string, t reflect.Type, factory DepFactory, closer DepCloser, check DepCheck, opts ...DepOption) func() {
+	if factory == nil {
+		panic("micro: RegisterDepProvider factory is nil")
+	}
+	p := &depProvider{
+		name:    name,
+		factory: factory,
+		closer:  closer,
+		check:   check,
+	}
+	for _, o := range opts {
+		o.apply(p)
+	}
+	depProviders.Lock()
+	defer depProviders.Unlock()
+	old, ok := depProviders.m[t]
+	depProviders.m[t] = p
+	return func() {
+		depProviders.Lock()
+		defer depProviders.Unlock()
+		if depProviders.m[t] != p {
+			//已经再次替换
+			return
+		}
+		if ok {
+			depProviders.m[t] = old
+		} else {
+			delete(depProviders.m, t)
+		}
+	}
+}
+
+//depConfigType 配置结构体的类型
+func depConfigType(configType interface{}) reflect.Type {
+	t := reflect.TypeOf(configType)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		panic("micro: RegisterDepProvider config type should be a struct or struct's pointer")
+	}
+	return t
+}
+
+//lookupDepProvider 按字段的类型查找依赖, 返回配置的指针(nil指针没有配置)
+func lookupDepProvider(v reflect.Value) (*depProvider, interface{}) {
+	t := v.Type()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	depProviders.RLock()
+	p, ok := depProviders.m[t]
+	depProviders.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return p, nil
+		}
+		return p, v.Interface()
+	}
+	ptr := reflect.New(t)
+	ptr.Elem().Set(v)
+	return p, ptr.Interface()
+}
+
+func init() {
+	registerDepProvider(DepMySQL, reflect.TypeOf(conf.MysqlConfig{}), newMySQLDep, closeDep, pingDepCheck)
+	registerDepProvider(DepMySQL, reflect.TypeOf(MySQLClusterConfig{}), newMySQLClusterDep, closeDep, mysqlClusterDepCheck)
+	registerDepProvider(DepRedis, reflect.TypeOf(conf.RedisConfig{}), newRedisDep, closeDep, pingDepCheck)
+	registerDepProvider(DepRedis, reflect.TypeOf(RedisSentinelConfig{}), newRedisSentinelDep, closeDep, pingDepCheck)
+	registerDepProvider(DepRedis, reflect.TypeOf(RedisShardsConfig{}), newRedisShardsDep, closeDep, pingDepCheck)
+	registerDepProvider(DepMongo, reflect.TypeOf(conf.MongoDBConfig{}), newMongoDep, closeDep, pingDepCheck)
+	registerDepProvider(DepRabbitMQ, reflect.TypeOf(conf.RabbitMQConfig{}), newRabbitMQDep, closeDep, rabbitMQDepCheck)
+	registerDepProvider(DepInflux, reflect.TypeOf(conf.InfluxConfig{}), newInfluxDep, closeDep, pingDepCheck)
+	registerDepProvider(DepKafka, reflect.TypeOf(KafkaProducerConfig{}), newKafkaProducerDep, closeDep, kafkaDepCheck)
+	registerDepProvider(DepKafka, reflect.TypeOf(KafkaConsumerConfig{}), newKafkaConsumerDep, closeDep, kafkaDepCheck)
+}
+
+func newMySQLDep(env *DepEnv, cfg interface{}) (interface{}, error) {
+	dep, err := conf.MySQLClient(cfg.(*conf.MysqlConfig))
+	if err != nil {
+		return nil, err
+	}
+	dep.SetLogger(gormzap.New(env.Log.ZapLogger))
+	env.inst.gorm(env.Key, dep)
+	return dep, nil
+}
+
+func newMySQLClusterDep(env *DepEnv, cfg interface{}) (interface{}, error) {
+	return newMySQLRouter(env.Context(), env.Key, cfg.(*MySQLClusterConfig), env.Log, env.inst)
+}
+
+func newRedisDep(env *DepEnv, cfg interface{}) (interface{}, error) {
+	dep, err := conf.RedisClient(cfg.(*conf.RedisConfig))
+	if err != nil {
+		return nil, err
+	}
+	env.inst.redis(env.Key, dep)
+	return dep, nil
+}
+
+func newMongoDep(env *DepEnv, cfg interface{}) (interface{}, error) {
+	return newMongoClient(env.Context(), cfg.(*conf.MongoDBConfig), env.inst.mongoMonitor(env.Key))
+}
+
+func newRabbitMQDep(env *DepEnv, cfg interface{}) (interface{}, error) {
+	s := cfg.(*conf.RabbitMQConfig)
+	dep := amqp.NewRabbitMQClient(s.Address, s.Username, s.Password, env.Log.With(zap.String("agent", "rabbitmq")), env.inst != nil)
+	return &rabbitMQDep{Client: env.inst.rabbitMQ(env.Key, dep), url: rabbitMQURL(s)}, nil
+}
+
+func newInfluxDep(env *DepEnv, cfg interface{}) (interface{}, error) {
+	s := cfg.(*conf.InfluxConfig)
+	influxConfig := ifxclient.HTTPConfig{
+		Addr:     s.Addr,
+		Username: s.UserName,
+		Password: s.Password,
+		Timeout:  30 * time.Second,
+	}
+	influxClient, err := ifxclient.NewHTTPClient(influxConfig)
+	if err != nil {
+		return nil, err
+	}
+	_, _, err = influxClient.Ping(2 * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return env.inst.influx(env.Key, influxClient), nil
+}
+
+//closeDep 关闭内置的依赖
+func closeDep(ctx context.Context, dep interface{}) error {
+	switch d := dep.(type) {
+	case *MySQLRouter:
+		return d.Close()
+	case *gorm.DB:
+		return d.Close()
+	case *mongo.Client:
+		return d.Disconnect(ctx)
+	case amqp.Client:
+		d.CloseConn()
+		return nil
+	case redis.Cmdable:
+		if c, ok := d.(io.Closer); ok {
+			return c.Close()
+		}
+	case io.Closer:
+		return d.Close()
+	}
+	return nil
+}
+
+func pingDepCheck(cfg interface{}, dep interface{}) HealthCheck {
+	return pingCheck(dep)
+}
+
+//mysqlClusterDepCheck 主库的连接检查(从库由路由定时检查)
+func mysqlClusterDepCheck(cfg interface{}, dep interface{}) HealthCheck {
+	return pingCheck(dep.(*MySQLRouter).Primary())
+}
+
+func rabbitMQDepCheck(cfg interface{}, dep interface{}) HealthCheck {
+	return dialCheck(cfg.(*conf.RabbitMQConfig).Address)
+}
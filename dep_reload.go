@@ -0,0 +1,113 @@
+package micro
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+const (
+	//defaultDepReloadGrace 配置变化替换依赖后, 旧的依赖默认等待30s关闭(完成进行中的调用)
+	defaultDepReloadGrace = 30 * time.Second
+)
+
+//reload 使用新的配置重新创建配置变化的依赖(和新增的依赖), 替换后旧的依赖在grace之后关闭, 返回替换的key
+//noreload的依赖被长期持有(例如AuditSink), 配置变化时继续使用旧的依赖(需要重启). 创建失败时继续使用旧的依赖
+func (c *Deps) reload(ctx context.Context, v interface{}, grace time.Duration) ([]string, error) {
+	fields, err := scanDeps(v, c.tag)
+	if err != nil {
+		return nil, err
+	}
+	var errs error
+	var changed []string
+	for _, f := range fields {
+		if f.provider == nil || f.cfg == nil {
+			continue
+		}
+		old, ok := c.item(f.key)
+		if ok && old.provider == f.provider && reflect.DeepEqual(old.snapshot, reflect.ValueOf(f.cfg).Elem().Interface()) {
+			continue
+		}
+		if ok && !f.reload {
+			c.log.Normal().Warn(f.provider.name+" config changed with noreload, keep current", zap.String("key", f.key))
+			continue
+		}
+		item, err := c.createTimeout(ctx, f)
+		if err != nil {
+			c.log.Normal().Warn("reload "+f.provider.name+" error, keep current", zap.String("key", f.key), zap.Error(err))
+			errs = multierr.Append(errs, fmt.Errorf("%s: %w", f.key, err))
+			continue
+		}
+		if !c.swap(f.key, item, grace) {
+			//已经关闭
+			_ = item.close(context.TODO())
+			return changed, errs
+		}
+		c.log.Normal().Info("dependency reloaded", zap.String("dep", f.provider.name), zap.String("key", f.key), zap.Duration("grace", grace))
+		changed = append(changed, f.key)
+	}
+	return changed, errs
+}
+
+//swap 替换依赖, 旧的依赖在grace之后关闭, 已经关闭时返回false
+func (c *Deps) swap(key string, v *depItem, grace time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	old, ok := c.items[key]
+	if !ok {
+		c.keys = append(c.keys, key)
+	}
+	c.items[key] = v
+	for _, r := range c.report {
+		if r.Key == key {
+			r.Result = DepCreated
+			r.Error = ""
+		}
+	}
+	if ok {
+		c.retiring[old] = time.AfterFunc(grace, func() {
+			c.mu.Lock()
+			_, ok := c.retiring[old]
+			delete(c.retiring, old)
+			c.mu.Unlock()
+			if !ok {
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.TODO(), defaultHealthTimeout)
+			defer cancel()
+			if err := old.close(ctx); err != nil {
+				c.log.Normal().Warn("close "+old.provider.name+" error", zap.String("key", key), zap.Error(err))
+			}
+		})
+	}
+	return true
+}
+
+//ReloadDeps 从配置中心重新读取ParseConfig的配置, 重新创建配置变化的reload依赖并替换(Get*获取的是新的依赖), 旧的依赖在DepReloadGrace之后关闭
+func (c *MSManager) ReloadDeps(ctx context.Context) error {
+	var errs error
+	for _, d := range c.allDeps() {
+		v := reflect.New(d.cfgType).Interface()
+		if err := c.confCenter.GetConfig(ctx, v); err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		changed, err := d.reload(ctx, v, c.options.depReloadGrace)
+		errs = multierr.Append(errs, err)
+		if len(changed) > 0 {
+			//新增的依赖增加就绪检查
+			for key, check := range d.HealthChecks() {
+				c.AddHealthCheck("deps."+key, check)
+			}
+		}
+	}
+	c.metrics.configReloaded("deps", errs)
+	return errs
+}
@@ -0,0 +1,83 @@
+package micro
+
+import (
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+//依赖字段的创建结果(Deps.Report)
+const (
+	DepCreated     = "created"
+	DepSkipped     = "skipped"
+	DepUnsupported = "unsupported"
+)
+
+//DepReport ParseConfig中字段的创建结果
+type DepReport struct {
+	Field    string `json:"field"`
+	Key      string `json:"key"`
+	Type     string `json:"type"`
+	Optional bool   `json:"optional"`
+	Result   string `json:"result"` //created, skipped, unsupported
+	Error    string `json:"error,omitempty"`
+}
+
+//parseDepTag 解析tag: key[,optional][,noreload], optional的依赖创建失败时跳过, noreload的依赖配置变化时不热更新(默认热更新, reload兼容原来的写法)
+func parseDepTag(tag string) (string, bool, bool) {
+	parts := strings.Split(tag, ",")
+	optional, noreload := false, false
+	for _, v := range parts[1:] {
+		switch strings.Trim(v, " ") {
+		case "optional":
+			optional = true
+		case "noreload":
+			noreload = true
+		}
+	}
+	return strings.Trim(parts[0], " "), optional, noreload
+}
+
+//Report 字段的创建结果(有tag的字段和支持的配置类型), 按字段顺序
+func (c *Deps) Report() []*DepReport {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v := make([]*DepReport, len(c.report))
+	for i, r := range c.report {
+		item := *r
+		v[i] = &item
+	}
+	return v
+}
+
+func (c *Deps) reportOf(key string) *DepReport {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, r := range c.report {
+		if r.Key == key {
+			return r
+		}
+	}
+	return nil
+}
+
+//logReport 启动时打印创建结果, 有跳过或者不支持的字段时为warn
+func (c *Deps) logReport() {
+	var created, skipped, unsupported []string
+	for _, r := range c.report {
+		switch r.Result {
+		case DepCreated:
+			created = append(created, r.Key)
+		case DepSkipped:
+			skipped = append(skipped, r.Key)
+		case DepUnsupported:
+			unsupported = append(unsupported, r.Field+"("+r.Type+")")
+		}
+	}
+	fields := []zap.Field{zap.Strings("created", created), zap.Strings("skipped", skipped), zap.Strings("unsupported", unsupported)}
+	if len(skipped) > 0 || len(unsupported) > 0 {
+		c.log.Normal().Warn("deps report", fields...)
+		return
+	}
+	c.log.Normal().Info("deps report", fields...)
+}
@@ -0,0 +1,152 @@
+package micro
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+const (
+	//maxDepDepth 查找依赖的最大嵌套层数
+	maxDepDepth = 16
+)
+
+//depField 配置中的依赖字段
+type depField struct {
+	//name 字段的路径(Storage.Primary, Redis[cache], Shards[0])
+	name string
+	//key 依赖的key(storage.primary, redis.cache, redis.shards[0])
+	key      string
+	typ      string
+	tagged   bool
+	optional bool
+	//reload 配置变化时热更新(ReloadDeps, 默认), noreload时继续使用旧的依赖
+	reload   bool
+	provider *depProvider
+	cfg      interface{}
+}
+
+//scanDeps 查找配置中有tag或者支持的类型的字段, 多个字段的key相同时返回错误(包含两个字段的路径)
+//有tag的结构体, map, slice递归查找(key使用.和[i]连接), 嵌入的结构体不增加key前缀, optional和noreload对子字段同样生效
+func scanDeps(v interface{}, structTag string) ([]*depField, error) {
+	s := reflect.ValueOf(v)
+	switch s.Type().Kind() {
+	case reflect.Ptr:
+		s = s.Elem()
+		if s.Type().Kind() != reflect.Struct {
+			return nil, ErrUnsupportedConfig
+		}
+	case reflect.Struct:
+	default:
+		return nil, ErrConfigShouldPtrOrStruct
+	}
+	fields := make([]*depField, 0, s.NumField())
+	scanStruct(&fields, s, structTag, &depField{reload: true}, 0)
+	names := make(map[string]string, len(fields))
+	for _, f := range fields {
+		if name, ok := names[f.key]; ok {
+			return nil, fmt.Errorf("%w: %s (%s, %s)", ErrDuplicateDep, f.key, name, f.name)
+		}
+		names[f.key] = f.name
+	}
+	return fields, nil
+}
+
+//scanStruct 查找结构体的字段, parent为结构体所在的字段
+func scanStruct(fields *[]*depField, s reflect.Value, structTag string, parent *depField, depth int) {
+	l := s.NumField()
+	for i := 0; i < l; i++ {
+		field := s.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		f := &depField{name: joinDepPath(parent.name, field.Name), key: parent.key, typ: field.Type.String(), optional: parent.optional, reload: parent.reload}
+		var tag string
+		if tag, f.tagged = field.Tag.Lookup(structTag); f.tagged {
+			key, optional, noreload := parseDepTag(tag)
+			if key == "" {
+				continue
+			}
+			f.key = joinDepKey(parent.key, key)
+			f.optional = f.optional || optional
+			f.reload = f.reload && !noreload
+		}
+		scanValue(fields, f, s.Field(i), structTag, f.tagged || field.Anonymous, depth)
+	}
+}
+
+//scanValue 支持的配置类型直接加入, 否则recurse时递归查找, 有tag但是没有找到依赖时为不支持的字段
+func scanValue(fields *[]*depField, f *depField, v reflect.Value, structTag string, recurse bool, depth int) {
+	f.provider, f.cfg = lookupDepProvider(v)
+	if f.provider != nil {
+		*fields = append(*fields, f)
+		return
+	}
+	n := len(*fields)
+	if recurse && depth < maxDepDepth {
+		for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return
+			}
+			v = v.Elem()
+		}
+		switch v.Kind() {
+		case reflect.Struct:
+			scanStruct(fields, v, structTag, f, depth+1)
+		case reflect.Map:
+			keys := v.MapKeys()
+			names := make([]string, len(keys))
+			for i, k := range keys {
+				names[i] = fmt.Sprint(k.Interface())
+			}
+			sort.Sort(&mapKeys{keys: keys, names: names})
+			for i, k := range keys {
+				child := &depField{name: f.name + "[" + names[i] + "]", key: joinDepKey(f.key, names[i]), typ: v.Type().Elem().String(), optional: f.optional, reload: f.reload}
+				scanValue(fields, child, v.MapIndex(k), structTag, true, depth+1)
+			}
+		case reflect.Slice, reflect.Array:
+			for i := 0; i < v.Len(); i++ {
+				idx := "[" + strconv.Itoa(i) + "]"
+				child := &depField{name: f.name + idx, key: f.key + idx, typ: v.Type().Elem().String(), optional: f.optional, reload: f.reload}
+				scanValue(fields, child, v.Index(i), structTag, true, depth+1)
+			}
+		}
+	}
+	if len(*fields) == n && f.tagged {
+		*fields = append(*fields, f)
+	}
+}
+
+func joinDepKey(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+func joinDepPath(prefix string, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+//mapKeys 按字符串排序map的key
+type mapKeys struct {
+	keys  []reflect.Value
+	names []string
+}
+
+func (c *mapKeys) Len() int {
+	return len(c.keys)
+}
+
+func (c *mapKeys) Less(i, j int) bool {
+	return c.names[i] < c.names[j]
+}
+
+func (c *mapKeys) Swap(i, j int) {
+	c.keys[i], c.keys[j] = c.keys[j], c.keys[i]
+	c.names[i], c.names[j] = c.names[j], c.names[i]
+}
@@ -0,0 +1,129 @@
+package micro
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+//supervise 定时检查需要重连的依赖(DepReconnect), ctx结束时返回
+func (c *Deps) supervise(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, key := range c.Keys() {
+		item, ok := c.item(key)
+		if !ok || item.provider.reconnect <= 0 || item.check == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(key string, p *depProvider) {
+			defer wg.Done()
+			c.superviseKey(ctx, key, p)
+		}(key, item.provider)
+	}
+	wg.Wait()
+}
+
+func (c *Deps) superviseKey(ctx context.Context, key string, p *depProvider) {
+	ticker := time.NewTicker(p.reconnect)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		item, ok := c.item(key)
+		if !ok || item.check == nil {
+			return
+		}
+		cctx, cancel := context.WithTimeout(ctx, defaultHealthTimeout)
+		err := item.check(cctx)
+		cancel()
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		c.log.Normal().Warn("dependency unhealthy, reconnect", zap.String("dep", p.name), zap.String("key", key), zap.Error(err))
+		c.reconnect(ctx, key, item)
+	}
+}
+
+//reconnect 重新创建依赖, 失败时退避重试直到成功或者ctx结束, 成功后关闭旧的依赖
+func (c *Deps) reconnect(ctx context.Context, key string, old *depItem) {
+	p := old.provider
+	for attempt := 0; ; attempt++ {
+		v, err := c.createTimeout(ctx, &depField{key: key, provider: p, cfg: old.cfg})
+		if c.inst != nil && c.inst.metrics != nil {
+			c.inst.metrics.depReconnected(p.name, key, err)
+		}
+		if err == nil {
+			v.snapshot = old.snapshot
+			cctx, cancel := context.WithTimeout(context.TODO(), defaultHealthTimeout)
+			defer cancel()
+			if !c.replace(key, old, v) {
+				//已经关闭或者替换
+				_ = v.close(cctx)
+				return
+			}
+			if err := old.close(cctx); err != nil {
+				c.log.Normal().Warn("close "+p.name+" error", zap.String("key", key), zap.Error(err))
+			}
+			c.log.Normal().Info("dependency reconnected", zap.String("dep", p.name), zap.String("key", key), zap.Int("attempts", attempt+1))
+			return
+		}
+		wait := p.backoff(attempt)
+		c.log.Normal().Warn("reconnect "+p.name+" error", zap.String("key", key), zap.Int("attempt", attempt+1), zap.Duration("backoff", wait), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+//replace 替换依赖, 已经关闭或者old已经被替换时返回false
+func (c *Deps) replace(key string, old *depItem, v *depItem) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.items[key] != old {
+		return false
+	}
+	c.items[key] = v
+	return true
+}
+
+//allDeps ParseConfig创建的依赖
+func (c *MSManager) allDeps() []*Deps {
+	c.depsMu.Lock()
+	defer c.depsMu.Unlock()
+	v := make([]*Deps, len(c.deps))
+	copy(v, c.deps)
+	return v
+}
+
+//superviseDeps 重连ParseConfig创建的依赖(RunWith启动)
+func (c *MSManager) superviseDeps(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, d := range c.allDeps() {
+		wg.Add(1)
+		go func(d *Deps) {
+			defer wg.Done()
+			d.supervise(ctx)
+		}(d)
+	}
+	wg.Wait()
+	return nil
+}
+
+//closeDeps 按创建的逆序关闭ParseConfig创建的依赖(RunWith在服务停止后)
+func (c *MSManager) closeDeps() {
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	all := c.allDeps()
+	for i := len(all) - 1; i >= 0; i-- {
+		if err := all[i].Close(ctx); err != nil {
+			c.log.Normal().Warn("close deps", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package micro
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testDepConfig struct {
+	Addr string `yaml:"addr"`
+	Fail bool   `yaml:"fail"`
+	Slow bool   `yaml:"slow"`
+}
+
+type testDep struct {
+	addr   string
+	closed int32
+}
+
+type testDepsConfig struct {
+	Primary testDepConfig   `yaml:"primary" nacos:"primary"`
+	Cache   testDepConfig   `yaml:"cache" nacos:"cache,noreload"`
+	Extra   *testDepConfig  `yaml:"extra" nacos:"extra,optional"`
+	Shards  []testDepConfig `yaml:"shards" nacos:"shards"`
+	Name    string          `yaml:"name" nacos:"name"`
+}
+
+//testDepCloses 关闭的依赖(按关闭顺序)
+type testDepCloses struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (c *testDepCloses) list() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.addrs...)
+}
+
+//registerTestDep 注册testDepConfig的依赖(测试结束时恢复), Fail为true时创建失败, Slow为true时等待到创建超时
+func registerTestDep(t *testing.T) *testDepCloses {
+	t.Helper()
+	closes := &testDepCloses{}
+	t.Cleanup(RegisterDepProvider(testDepConfig{}, func(env *DepEnv, cfg interface{}) (interface{}, error) {
+		s := cfg.(*testDepConfig)
+		if s.Slow {
+			<-env.Context().Done()
+			return nil, env.Context().Err()
+		}
+		if s.Fail {
+			return nil, errors.New("connect " + s.Addr)
+		}
+		return &testDep{addr: s.Addr}, nil
+	}, func(ctx context.Context, dep interface{}) error {
+		d := dep.(*testDep)
+		atomic.StoreInt32(&d.closed, 1)
+		closes.mu.Lock()
+		closes.addrs = append(closes.addrs, d.addr)
+		closes.mu.Unlock()
+		return nil
+	}, func(cfg interface{}, dep interface{}) HealthCheck {
+		return func(ctx context.Context) error {
+			return nil
+		}
+	}))
+	return closes
+}
+
+func newTestDepsManager(t *testing.T, cfg interface{}, opts ...Option) *MSManager {
+	t.Helper()
+	opts = append([]Option{NoopServiceCenter(), MemoryConfigCenter(cfg), LogLevel("error"), DepInitRetry(0, 0, 0), DepReloadGrace(0)}, opts...)
+	m, err := NewMSManager(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestRegisterDepProvider(t *testing.T) {
+	restore := RegisterDepProvider(testDepConfig{}, func(env *DepEnv, cfg interface{}) (interface{}, error) {
+		return "first", nil
+	}, nil, nil)
+	defer restore()
+	registerTestDep(t)
+	m := newTestDepsManager(t, nil)
+	deps, err := m.ParseConfig(&struct {
+		DB testDepConfig `nacos:"db"`
+	}{DB: testDepConfig{Addr: "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deps.Close(context.Background())
+	if dep, err := Get[*testDep](deps, "db"); err != nil || dep.addr != "a" {
+		t.Fatalf("get db: %v %v", dep, err)
+	}
+	if _, err := Get[string](deps, "db"); !errors.Is(err, ErrDepType) {
+		t.Fatalf("get db as string: %v", err)
+	}
+	if _, err := Get[*testDep](deps, "missing"); !errors.Is(err, ErrDepNotFound) {
+		t.Fatalf("get missing: %v", err)
+	}
+}
+
+func TestDepsClose(t *testing.T) {
+	closes := registerTestDep(t)
+	m := newTestDepsManager(t, nil)
+	deps, err := m.ParseConfig(&testDepsConfig{
+		Primary: testDepConfig{Addr: "p"},
+		Cache:   testDepConfig{Addr: "c"},
+		Shards:  []testDepConfig{{Addr: "s0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deps.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := deps.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	//按创建的逆序关闭, 重复调用不会重复关闭
+	if got := strings.Join(closes.list(), ","); got != "s0,c,p" {
+		t.Fatalf("closed %s, want s0,c,p", got)
+	}
+}
+
+func TestParseConfigReport(t *testing.T) {
+	registerTestDep(t)
+	m := newTestDepsManager(t, nil)
+	deps, err := m.ParseConfig(&testDepsConfig{
+		Primary: testDepConfig{Addr: "p"},
+		Cache:   testDepConfig{Addr: "c"},
+		Extra:   &testDepConfig{Addr: "e", Fail: true},
+		Shards:  []testDepConfig{{Addr: "s0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deps.Close(context.Background())
+	results := map[string]string{}
+	for _, r := range deps.Report() {
+		results[r.Key] = r.Result
+	}
+	want := map[string]string{
+		"primary":   DepCreated,
+		"cache":     DepCreated,
+		"extra":     DepSkipped,
+		"shards[0]": DepCreated,
+		"name":      DepUnsupported,
+	}
+	for k, v := range want {
+		if results[k] != v {
+			t.Fatalf("report %s: %s, want %s (%v)", k, results[k], v, results)
+		}
+	}
+	if _, err := Get[*testDep](deps, "extra"); !errors.Is(err, ErrDepNotFound) || !strings.Contains(err.Error(), DepSkipped) {
+		t.Fatalf("get extra: %v", err)
+	}
+	if _, err := deps.LookupMySQL("primary"); !errors.Is(err, ErrDepType) {
+		t.Fatalf("lookup primary as mysql: %v", err)
+	}
+	status := m.DepsStatus(context.Background())
+	if len(status) != 3 {
+		t.Fatalf("got %d dep status, want 3", len(status))
+	}
+	for _, s := range status {
+		if s.Status != "up" {
+			t.Fatalf("dep %s status %s", s.Key, s.Status)
+		}
+	}
+}
+
+func TestReloadDeps(t *testing.T) {
+	registerTestDep(t)
+	cfg := &testDepsConfig{
+		Primary: testDepConfig{Addr: "p1"},
+		Cache:   testDepConfig{Addr: "c1"},
+	}
+	m := newTestDepsManager(t, cfg)
+	deps, err := m.ParseConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deps.Close(context.Background())
+	oldPrimary, _ := Get[*testDep](deps, "primary")
+	oldCache, _ := Get[*testDep](deps, "cache")
+	if err := m.ConfigCenter().SetConfig(context.Background(), &testDepsConfig{
+		Primary: testDepConfig{Addr: "p2"},
+		Cache:   testDepConfig{Addr: "c2"},
+		Extra:   &testDepConfig{Addr: "e"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ReloadDeps(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	//默认热更新, 旧的依赖在grace之后关闭
+	if dep, _ := Get[*testDep](deps, "primary"); dep.addr != "p2" {
+		t.Fatalf("primary %s, want p2", dep.addr)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&oldPrimary.closed) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("replaced primary not closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	//noreload的依赖继续使用
+	if dep, _ := Get[*testDep](deps, "cache"); dep != oldCache || atomic.LoadInt32(&oldCache.closed) != 0 {
+		t.Fatalf("cache replaced with noreload tag")
+	}
+	//新增的依赖创建
+	if dep, err := Get[*testDep](deps, "extra"); err != nil || dep.addr != "e" {
+		t.Fatalf("get extra: %v %v", dep, err)
+	}
+}
+
+func TestParseConfigInitErrors(t *testing.T) {
+	closes := registerTestDep(t)
+	m := newTestDepsManager(t, nil, DepInitTimeout(20*time.Millisecond, time.Second))
+	_, err := m.ParseConfig(&testDepsConfig{
+		Primary: testDepConfig{Addr: "p", Fail: true},
+		Cache:   testDepConfig{Addr: "c", Slow: true},
+		Shards:  []testDepConfig{{Addr: "s0"}},
+	})
+	if err == nil {
+		t.Fatal("required dependencies failed without error")
+	}
+	//每个失败的key一个错误
+	if msg := err.Error(); !strings.Contains(msg, "primary: connect p") || !strings.Contains(msg, "cache: ") {
+		t.Fatalf("init error %q", msg)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("init error %v, want DeadlineExceeded", err)
+	}
+	//创建成功的依赖被关闭
+	if got := strings.Join(closes.list(), ","); got != "s0" {
+		t.Fatalf("closed %s, want s0", got)
+	}
+}
+
+func TestScanDepsDuplicateKey(t *testing.T) {
+	registerTestDep(t)
+	v := &struct {
+		A testDepConfig `nacos:"db"`
+		B struct {
+			C testDepConfig `nacos:"db"`
+		}
+	}{}
+	if _, err := scanDeps(v, "nacos"); err != nil {
+		t.Fatalf("untagged nested struct: %v", err)
+	}
+	w := &struct {
+		A testDepConfig `nacos:"db"`
+		B testDepConfig `nacos:"db"`
+	}{}
+	if _, err := scanDeps(w, "nacos"); !errors.Is(err, ErrDuplicateDep) {
+		t.Fatalf("got %v, want ErrDuplicateDep", err)
+	}
+}
+
+func TestScanDepsNested(t *testing.T) {
+	registerTestDep(t)
+	type Embedded struct {
+		E testDepConfig `nacos:"e"`
+	}
+	v := &struct {
+		Embedded
+		Group struct {
+			A testDepConfig            `nacos:"a"`
+			M map[string]testDepConfig `nacos:"m,optional"`
+		} `nacos:"group,noreload"`
+		Shards []testDepConfig `nacos:"shards,reload"`
+	}{}
+	v.Group.M = map[string]testDepConfig{"y": {}, "x": {}}
+	v.Shards = []testDepConfig{{}}
+	fields, err := scanDeps(v, "nacos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		key      string
+		optional bool
+		reload   bool
+	}{
+		{"e", false, true},
+		{"group.a", false, false},
+		{"group.m.x", true, false},
+		{"group.m.y", true, false},
+		{"shards[0]", false, true},
+	}
+	if len(fields) != len(want) {
+		t.Fatalf("got %d fields, want %d", len(fields), len(want))
+	}
+	for i, w := range want {
+		f := fields[i]
+		if f.key != w.key || f.optional != w.optional || f.reload != w.reload {
+			t.Fatalf("field %d: key %s optional %v reload %v, want %+v", i, f.key, f.optional, f.reload, w)
+		}
+	}
+}
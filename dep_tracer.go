@@ -0,0 +1,53 @@
+package micro
+
+import (
+	"context"
+	"io"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/whatisfaker/zaptrace/tracing"
+)
+
+//依赖名称(EnableTracer, DepTracer使用), 其他依赖可以使用自定义名称
+const (
+	DepMySQL    = "mysql"
+	DepRedis    = "redis"
+	DepMongo    = "mongo"
+	DepInflux   = "influx"
+	DepRabbitMQ = "rabbitmq"
+	DepKafka    = "kafka"
+)
+
+//DepTracer 依赖使用的tracer, EnableTracer启用的依赖使用独立的tracer(RunWith时创建), 否则为全局tracer
+func (c *MSManager) DepTracer(dep string) opentracing.Tracer {
+	if v, ok := c.depTracers.Load(dep); ok {
+		return v.(opentracing.Tracer)
+	}
+	return opentracing.GlobalTracer()
+}
+
+//DepStartSpan 使用依赖的tracer开始span
+func (c *MSManager) DepStartSpan(ctx context.Context, dep string, opName string, tags ...map[string]string) (context.Context, opentracing.Span) {
+	return tracing.QuickStartSpanWithTracer(ctx, c.DepTracer(dep), opName, ext.SpanKindRPCClient, tags...)
+}
+
+//initDepTracers 创建EnableTracer启用的依赖tracer, 返回关闭函数
+func (c *MSManager) initDepTracers() (func(), error) {
+	closers := make([]io.Closer, 0, len(c.options.depTracers))
+	closeAll := func() {
+		for _, v := range closers {
+			v.Close()
+		}
+	}
+	for _, name := range c.options.depTracers {
+		tracer, closer, err := c.newDepTracer(name)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		closers = append(closers, closer)
+		c.depTracers.Store(name, tracer)
+	}
+	return closeAll, nil
+}
@@ -0,0 +1,91 @@
+package micro
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+var ErrGRPCServiceNotFound = errors.New("grpc service not found (RegisterGRPC first)")
+
+//GatewayRegisterFunc 注册grpc-gateway的handler(例如: pb.RegisterXXXHandler)
+type GatewayRegisterFunc func(context.Context, *runtime.ServeMux, *grpc.ClientConn) error
+
+func (c *MSManager) grpcService(name string) (*msGRPC, error) {
+	for _, svc := range c.svcs {
+		if svc.Name() != name {
+			continue
+		}
+		switch s := svc.(type) {
+		case *msGRPC:
+			return s, nil
+		case *msMux:
+			if s.grpc != nil {
+				return s.grpc, nil
+			}
+		}
+	}
+	return nil, ErrGRPCServiceNotFound
+}
+
+//GRPCGateway 将已注册的grpc服务(grpcName)以HTTP/JSON暴露为gin handler, prefix为挂载的路由组前缀
+//例: g := engine.Group("/api"); g.Any("/*any", handler)
+func (c *MSManager) GRPCGateway(ctx context.Context, grpcName string, prefix string, register GatewayRegisterFunc, opts ...runtime.ServeMuxOption) (gin.HandlerFunc, error) {
+	svc, err := c.grpcService(grpcName)
+	if err != nil {
+		c.log.Normal().Error("grpc gateway", zap.Error(err), zap.String("grpc", grpcName))
+		return nil, err
+	}
+	conn, err := svc.dialInProcess(ctx, c.clientDialOptions(false)...)
+	if err != nil {
+		c.log.Normal().Error("grpc gateway dial in-process", zap.Error(err), zap.String("grpc", grpcName))
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	mux := runtime.NewServeMux(opts...)
+	if err = register(ctx, mux, conn); err != nil {
+		c.log.Normal().Error("grpc gateway register", zap.Error(err), zap.String("grpc", grpcName))
+		return nil, err
+	}
+	var h http.Handler = mux
+	prefix = strings.TrimRight(prefix, "/")
+	if prefix != "" {
+		h = http.StripPrefix(prefix, mux)
+	}
+	return func(ctx *gin.Context) {
+		h.ServeHTTP(ctx.Writer, ctx.Request)
+	}, nil
+}
+
+//RegisterGRPCGateway 在独立端口上以HTTP/JSON暴露已注册的grpc服务(grpcName), 使用gin服务的追踪和健康检查
+//启动时创建gateway, 失败(例如register返回错误)时服务启动失败
+func (c *MSManager) RegisterGRPCGateway(name string, listen string, grpcName string, register GatewayRegisterFunc, params ...Param) error {
+	if _, err := c.grpcService(grpcName); err != nil {
+		c.log.Normal().Error("register grpc gateway", zap.Error(err), zap.String("name", name), zap.String("grpc", grpcName))
+		return err
+	}
+	svc, err := newGinMicroService(name, listen, nil, c.log.With(zap.String("srv_gin", name)), params...)
+	if err != nil {
+		c.log.Normal().Error("register grpc gateway", zap.Error(err), zap.String("name", name), zap.String("listen", listen))
+		return err
+	}
+	svc.setupFunc = func(ctx context.Context, engine *gin.Engine) error {
+		h, err := c.GRPCGateway(ctx, grpcName, "", register)
+		if err != nil {
+			return err
+		}
+		engine.NoRoute(h)
+		return nil
+	}
+	c.Register(svc)
+	return nil
+}
@@ -2,21 +2,21 @@ package micro
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	validator "github.com/go-playground/validator/v10"
-	"github.com/opentracing/opentracing-go"
 	"github.com/whatisfaker/gin-contrib/ginzap"
-	"github.com/whatisfaker/gin-contrib/nethttp"
 	"github.com/whatisfaker/gin-contrib/validatoroverriding"
 	"github.com/whatisfaker/zaptrace/log"
 	"go.uber.org/zap"
 )
 
 type msGin struct {
+	*startSignal
 	params      *paramMap
 	srv         *gin.Engine
 	listen      string
@@ -25,7 +25,15 @@ type msGin struct {
 	name        string
 	log         *log.Factory
 	initFunc    func(context.Context, *gin.Engine)
-	httpSrv     *http.Server
+	//setupFunc 可能失败的初始化(initFunc之后), 失败时服务启动失败
+	setupFunc func(context.Context, *gin.Engine) error
+	httpSrv   *http.Server
+	limit     *limiter
+	netListen func(string, string) (net.Listener, error)
+	metrics   *metrics
+	tracers   *tracers
+	logLevel  http.Handler
+	mgr       *MSManager
 }
 
 var _ MicroService = (*msGin)(nil)
@@ -34,8 +42,9 @@ func newGinMicroService(name string, listen string, initFunc func(context.Contex
 	p := &paramMap{
 		webHealthCheck:  defaultHealthzPath,
 		webValidateCN:   true,
+		webProbes:       true,
 		enableTracer:    true,
-		ignoreTracePath: []string{defaultHealthzPath},
+		ignoreTracePath: []string{defaultHealthzPath, defaultLivezPath, defaultReadyzPath},
 		metadata:        map[string]interface{}{},
 		weight:          defaultMSWeight,
 	}
@@ -43,11 +52,14 @@ func newGinMicroService(name string, listen string, initFunc func(context.Contex
 		v.apply(p)
 	}
 	c := &msGin{
-		params:   p,
-		name:     name,
-		listen:   listen,
-		log:      log,
-		initFunc: initFunc,
+		startSignal: newStartSignal(),
+		params:      p,
+		name:        name,
+		listen:      listen,
+		log:         log,
+		initFunc:    initFunc,
+		netListen:   net.Listen,
+		limit:       newLimiter(p.limit),
 	}
 	var err error
 	c.discoveryIP, c.port, err = split2ipport(listen, p.discoveryIP)
@@ -57,7 +69,30 @@ func newGinMicroService(name string, listen string, initFunc func(context.Contex
 	return c, nil
 }
 
+func (c *msGin) attach(m *MSManager) {
+	c.netListen = m.options.listen
+	c.metrics = m.metrics
+	c.tracers = m.tracers
+	m.logs.register(LogGin, c.log)
+	c.logLevel = m.LogLevelHandler()
+	c.mgr = m
+}
+
+func (c *msGin) limiters() []*limiter {
+	return []*limiter{c.limit}
+}
+
 func (c *msGin) Start(ctx context.Context) error {
+	l, err := c.netListen("tcp", c.listen)
+	if err != nil {
+		return err
+	}
+	c.markStarted()
+	return c.serve(ctx, l)
+}
+
+//serve 在指定的listener上提供服务
+func (c *msGin) serve(ctx context.Context, l net.Listener) error {
 	if c.log.Level() == "debug" {
 		gin.SetMode(gin.DebugMode)
 		c.srv = gin.New()
@@ -77,26 +112,51 @@ func (c *msGin) Start(ctx context.Context) error {
 	}
 	c.srv.Use(gin.Recovery())
 	if c.params.enableTracer {
-		tracer := opentracing.GlobalTracer()
-		if len(c.params.ignoreTracePath) > 0 {
-			c.srv.Use(nethttp.Middleware(tracer, nethttp.MWOmitURI(c.params.ignoreTracePath...)))
-		} else {
-			c.srv.Use(nethttp.Middleware(tracer))
+		c.srv.Use(c.tracers.ginMiddleware(c.name, c.params.ignoreTracePath))
+	}
+	if c.metrics != nil {
+		c.srv.Use(c.metrics.ginMiddleware(c.name))
+		if c.params.webMetrics != "" {
+			c.srv.GET(c.params.webMetrics, gin.WrapH(c.metrics.handler()))
 		}
 	}
+	if c.logLevel != nil && c.params.webLogLevel != "" {
+		c.srv.Any(c.params.webLogLevel, gin.WrapH(c.logLevel))
+	}
+	c.srv.Use(requestLogGinMiddleware(c.log))
+	//探针在审计和限流之前注册(不审计, 不限流)
 	if c.params.webHealthCheck != "" {
 		c.srv.GET(c.params.webHealthCheck, func(ctx *gin.Context) {
+			//最近一次就绪检查的结果
+			if c.mgr != nil && !c.mgr.health.isReady() {
+				ctx.String(http.StatusServiceUnavailable, "not ready")
+				return
+			}
 			ctx.String(http.StatusOK, "ok")
 		})
 	}
+	if c.mgr != nil && c.params.webProbes {
+		c.srv.GET(defaultLivezPath, gin.WrapH(c.mgr.livezHandler()))
+		c.srv.GET(defaultReadyzPath, gin.WrapH(c.mgr.readyzHandler()))
+	}
+	if c.params.audit != nil || c.params.webAuditFunc != nil {
+		c.srv.Use(auditGinMiddleware(c.name, c.params.audit, c.params.webAuditFunc))
+	}
+	c.srv.Use(c.limit.ginMiddleware())
 	if c.initFunc != nil {
-		c.initFunc(ctx, c.srv)
+		c.initFunc(withServiceLog(ctx, c.log), c.srv)
+	}
+	if c.setupFunc != nil {
+		if err := c.setupFunc(withServiceLog(ctx, c.log), c.srv); err != nil {
+			_ = l.Close()
+			return err
+		}
 	}
 	c.httpSrv = &http.Server{
 		Addr:    c.listen,
 		Handler: c.srv,
 	}
-	if err := c.httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if err := c.httpSrv.Serve(l); err != nil && err != http.ErrServerClosed {
 		return err
 	}
 	return nil
@@ -135,6 +195,6 @@ func (c *MSManager) RegisterGin(name string, listen string, initFunc func(contex
 		c.log.Normal().Error("register gin", zap.Error(err), zap.String("name", name), zap.String("listen", listen))
 		return err
 	}
-	c.svcs = append(c.svcs, svc)
+	c.Register(svc)
 	return nil
 }
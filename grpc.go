@@ -3,15 +3,20 @@ package micro
 import (
 	"context"
 	"net"
+	"sync"
 
-	otgrpc "github.com/opentracing-contrib/go-grpc"
-	"github.com/opentracing/opentracing-go"
 	"github.com/whatisfaker/zaptrace/log"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
 )
 
+const inProcessBufSize = 1024 * 1024
+
 type msGRPC struct {
+	*startSignal
 	params      *paramMap
 	srv         *grpc.Server
 	listen      string
@@ -20,6 +25,17 @@ type msGRPC struct {
 	name        string
 	log         *log.Factory
 	initFunc    func(context.Context, *grpc.Server)
+	limit       *limiter
+	//inproc 进程内连接(dialInProcess)使用的listener, 第一次连接时创建
+	mu        sync.Mutex
+	inproc    *bufconn.Listener
+	serving   *grpc.Server
+	stopped   bool
+	netListen func(string, string) (net.Listener, error)
+	metrics   *metrics
+	tracers   *tracers
+	health    *health
+	healthSrv *grpchealth.Server
 }
 
 var _ MicroService = (*msGRPC)(nil)
@@ -27,6 +43,7 @@ var _ MicroService = (*msGRPC)(nil)
 func newGRPCMicroService(name string, listen string, initFunc func(context.Context, *grpc.Server), log *log.Factory, params ...Param) (*msGRPC, error) {
 	p := &paramMap{
 		enableTracer: true,
+		grpcHealth:   true,
 		metadata:     map[string]interface{}{},
 		weight:       defaultMSWeight,
 	}
@@ -35,11 +52,14 @@ func newGRPCMicroService(name string, listen string, initFunc func(context.Conte
 	}
 	var err error
 	c := &msGRPC{
-		params:   p,
-		initFunc: initFunc,
-		name:     name,
-		listen:   listen,
-		log:      log,
+		startSignal: newStartSignal(),
+		params:      p,
+		initFunc:    initFunc,
+		name:        name,
+		listen:      listen,
+		log:         log,
+		limit:       newLimiter(p.limit),
+		netListen:   net.Listen,
 	}
 	c.discoveryIP, c.port, err = split2ipport(listen, p.discoveryIP)
 	if err != nil {
@@ -48,25 +68,119 @@ func newGRPCMicroService(name string, listen string, initFunc func(context.Conte
 	return c, nil
 }
 
+func (c *msGRPC) attach(m *MSManager) {
+	c.netListen = m.options.listen
+	c.metrics = m.metrics
+	c.tracers = m.tracers
+	m.logs.register(LogGRPC, c.log)
+	c.health = m.health
+}
+
+func (c *msGRPC) limiters() []*limiter {
+	return []*limiter{c.limit}
+}
+
 func (c *msGRPC) Start(ctx context.Context) error {
-	grpcListen, err := net.Listen("tcp", c.listen)
+	grpcListen, err := c.netListen("tcp", c.listen)
 	if err != nil {
 		return err
 	}
+	c.markStarted()
+	return c.serve(ctx, grpcListen)
+}
+
+//serve 在指定的listener上提供服务
+func (c *msGRPC) serve(ctx context.Context, grpcListen net.Listener) error {
+	unary := make([]grpc.UnaryServerInterceptor, 0)
+	stream := make([]grpc.StreamServerInterceptor, 0)
 	if c.params.enableTracer {
-		tracer := opentracing.GlobalTracer()
-		c.srv = grpc.NewServer(
-			grpc.UnaryInterceptor(otgrpc.OpenTracingServerInterceptor(tracer)),
-			grpc.StreamInterceptor(otgrpc.OpenTracingStreamServerInterceptor(tracer)))
-	} else {
-		c.srv = grpc.NewServer()
+		u, s := c.tracers.serverInterceptors()
+		unary = append(unary, u)
+		stream = append(stream, s)
+	}
+	if c.metrics != nil {
+		unary = append(unary, c.metrics.unaryServerInterceptor(c.name))
+		stream = append(stream, c.metrics.streamServerInterceptor(c.name))
+	}
+	unary = append(unary, requestLogUnaryServerInterceptor(c.log), c.limit.unaryServerInterceptor())
+	stream = append(stream, requestLogStreamServerInterceptor(c.log), c.limit.streamServerInterceptor())
+	if c.params.audit != nil {
+		unary = append(unary, c.params.audit.UnaryServerInterceptor(c.name))
+		stream = append(stream, c.params.audit.StreamServerInterceptor(c.name))
 	}
+	c.srv = grpc.NewServer(
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...))
 	if c.initFunc != nil {
-		c.initFunc(ctx, c.srv)
+		c.initFunc(withServiceLog(ctx, c.log), c.srv)
 	}
+	c.registerHealth()
+	c.mu.Lock()
+	c.serving = c.srv
+	if c.inproc != nil {
+		c.serveInProcess()
+	}
+	c.mu.Unlock()
 	return c.srv.Serve(grpcListen)
 }
 
+//serveInProcess 在进程内的listener上提供服务(调用时持有锁)
+func (c *msGRPC) serveInProcess() {
+	srv, l := c.serving, c.inproc
+	go func() {
+		if err := srv.Serve(l); err != nil && err != grpc.ErrServerStopped {
+			c.log.Normal().Error("serve in-process grpc", zap.Error(err))
+		}
+	}()
+}
+
+//inProcess 进程内的listener, 第一次调用时创建(服务已经启动时开始提供服务), 停止后返回grpc.ErrServerStopped
+func (c *msGRPC) inProcess() (*bufconn.Listener, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return nil, grpc.ErrServerStopped
+	}
+	if c.inproc == nil {
+		c.inproc = bufconn.Listen(inProcessBufSize)
+		if c.serving != nil {
+			c.serveInProcess()
+		}
+	}
+	return c.inproc, nil
+}
+
+//registerHealth 注册grpc health服务, 状态跟随管理器的就绪检查
+func (c *msGRPC) registerHealth() {
+	if !c.params.grpcHealth || c.health == nil {
+		return
+	}
+	if _, ok := c.srv.GetServiceInfo()[healthpb.Health_ServiceDesc.ServiceName]; ok {
+		return
+	}
+	c.healthSrv = grpchealth.NewServer()
+	healthpb.RegisterHealthServer(c.srv, c.healthSrv)
+	c.health.watch(func(ready bool) {
+		status := healthpb.HealthCheckResponse_SERVING
+		if !ready {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		c.healthSrv.SetServingStatus("", status)
+	})
+}
+
+//dialInProcess 在进程内连接grpc服务(不经过网络), 服务启动前建立的连接在启动后可用
+func (c *msGRPC) dialInProcess(ctx context.Context, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append(opts, grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		l, err := c.inProcess()
+		if err != nil {
+			return nil, err
+		}
+		return l.Dial()
+	}))
+	return grpc.DialContext(ctx, "passthrough:///"+c.name, opts...)
+}
+
 func (c *msGRPC) Name() string {
 	return c.name
 }
@@ -88,9 +202,19 @@ func (c *msGRPC) Metadata() map[string]interface{} {
 }
 
 func (c *msGRPC) Shutdown(ctx context.Context) {
+	if c.healthSrv != nil {
+		c.healthSrv.Shutdown()
+	}
 	if c.srv != nil {
 		c.srv.GracefulStop()
 	}
+	//没有开始提供服务的进程内listener
+	c.mu.Lock()
+	c.stopped = true
+	if c.inproc != nil {
+		_ = c.inproc.Close()
+	}
+	c.mu.Unlock()
 }
 
 //RegisterGRPC 注册grpc的微服务
@@ -100,6 +224,6 @@ func (c *MSManager) RegisterGRPC(name string, listen string, initFunc func(conte
 		c.log.Normal().Error("register grpc", zap.Error(err), zap.String("name", name), zap.String("listen", listen))
 		return err
 	}
-	c.svcs = append(c.svcs, svc)
+	c.Register(svc)
 	return nil
 }
@@ -0,0 +1,66 @@
+package micro
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPCInProcess(t *testing.T) {
+	m, err := NewMSManager(NoopServiceCenter(), MemoryConfigCenter(nil), LogLevel("error"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RegisterGRPC("rpc", "127.0.0.1:9090", nil); err != nil {
+		t.Fatal(err)
+	}
+	svc, err := m.grpcService("rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- svc.serve(ctx, bufconn.Listen(1024))
+	}()
+	//服务启动前后建立的连接都可以使用
+	conn, err := svc.dialInProcess(ctx, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true)); err != nil {
+		t.Fatal(err)
+	}
+	svc.Shutdown(ctx)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.inProcess(); err != grpc.ErrServerStopped {
+		t.Fatalf("in-process listener after shutdown: %v", err)
+	}
+}
+
+func TestGRPCInProcessLazy(t *testing.T) {
+	svc, err := newGRPCMicroService("rpc", "127.0.0.1:9090", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc.inproc != nil {
+		t.Fatal("in-process listener created without dial")
+	}
+	//没有提供服务时关闭创建的listener
+	l, err := svc.inProcess()
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.Shutdown(context.Background())
+	if _, err := l.Dial(); err == nil {
+		t.Fatal("in-process listener not closed on shutdown")
+	}
+}
@@ -3,6 +3,7 @@ package grpcpool
 import (
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"google.golang.org/grpc"
@@ -19,6 +20,18 @@ type Pool struct {
 	grpcoptions []grpc.DialOption
 	option      Option
 	lock        sync.RWMutex
+	stats       Stats
+	onClose     []func()
+}
+
+//Stats 连接池统计
+type Stats struct {
+	Idle       int64 //当前空闲连接数
+	Gets       int64 //获取次数
+	Hits       int64 //命中空闲连接次数
+	News       int64 //新建连接次数
+	Closed     int64 //关闭连接次数(过期/空闲超时/池满)
+	DialErrors int64 //新建连接失败次数
 }
 
 type Option struct {
@@ -54,6 +67,7 @@ type ClientConn struct {
 }
 
 func (c *Pool) Get() (*ClientConn, error) {
+	atomic.AddInt64(&c.stats.Gets, 1)
 	select {
 	case conn, ok := <-c.connCh:
 		if !ok {
@@ -68,17 +82,21 @@ func (c *Pool) Get() (*ClientConn, error) {
 		}
 		//如果未超过最大空闲时间
 		if !conn.Closed && conn.u.Add(c.option.IdleTime).After(time.Now()) {
+			atomic.AddInt64(&c.stats.Hits, 1)
 			return conn, nil
 		}
 		//关闭空闲链接
 		conn.Closed = true
 		conn.Close()
+		atomic.AddInt64(&c.stats.Closed, 1)
 	default:
 	}
 	conn, err := c.newConn()
 	if err != nil {
+		atomic.AddInt64(&c.stats.DialErrors, 1)
 		return nil, err
 	}
+	atomic.AddInt64(&c.stats.News, 1)
 	return &ClientConn{ClientConn: conn, t: time.Now(), u: time.Now()}, nil
 }
 
@@ -104,15 +122,46 @@ func (c *Pool) Put(conn *ClientConn) {
 	}
 	conn.Closed = true
 	conn.Close()
+	atomic.AddInt64(&c.stats.Closed, 1)
+}
+
+//Stats 获取连接池统计
+func (c *Pool) Stats() Stats {
+	return Stats{
+		Idle:       int64(len(c.connCh)),
+		Gets:       atomic.LoadInt64(&c.stats.Gets),
+		Hits:       atomic.LoadInt64(&c.stats.Hits),
+		News:       atomic.LoadInt64(&c.stats.News),
+		Closed:     atomic.LoadInt64(&c.stats.Closed),
+		DialErrors: atomic.LoadInt64(&c.stats.DialErrors),
+	}
 }
 
 func (c *Pool) Close() {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return
+	}
+	close(c.connCh)
+	c.closed = true
+	fns := c.onClose
+	c.lock.Unlock()
+	for _, f := range fns {
+		f()
+	}
+}
+
+//OnClose 连接池关闭时调用f(例如注销统计), 已经关闭时直接调用
+func (c *Pool) OnClose(f func()) {
+	c.lock.Lock()
 	if !c.closed {
-		c.lock.Lock()
-		defer c.lock.Unlock()
-		close(c.connCh)
-		c.closed = true
+		c.onClose = append(c.onClose, f)
+		c.lock.Unlock()
+		return
 	}
+	c.lock.Unlock()
+	f()
 }
 
 func (c *Pool) newConn() (*grpc.ClientConn, error) {
@@ -0,0 +1,411 @@
+package micro
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	ifxclient "github.com/influxdata/influxdb1-client/v2"
+	"github.com/jinzhu/gorm"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+const (
+	HealthUp   = "up"
+	HealthDown = "down"
+
+	defaultLivezPath  = "/livez"
+	defaultReadyzPath = "/readyz"
+
+	//defaultHealthTimeout 默认的检查超时
+	defaultHealthTimeout = 2 * time.Second
+	//defaultHealthInterval 默认的就绪检查间隔(同步grpc health和注册中心)
+	defaultHealthInterval = 10 * time.Second
+	//defaultHealthStartInterval 第一次就绪之前的最长检查间隔
+	defaultHealthStartInterval = time.Second
+	//defaultHealthGrace 默认的启动宽限期(注册中心)
+	defaultHealthGrace = 30 * time.Second
+)
+
+//HealthCheck 健康检查函数, 返回错误表示不健康
+type HealthCheck func(ctx context.Context) error
+
+//HealthOption 健康检查的设置
+type HealthOption interface {
+	apply(*healthCheck)
+}
+
+type healthOption struct {
+	f func(*healthCheck)
+}
+
+func (c *healthOption) apply(o *healthCheck) {
+	c.f(o)
+}
+
+func newHealthOption(f func(*healthCheck)) *healthOption {
+	return &healthOption{
+		f: f,
+	}
+}
+
+//HealthTimeout 检查的超时(默认2s)
+func HealthTimeout(d time.Duration) HealthOption {
+	return newHealthOption(func(o *healthCheck) {
+		o.timeout = d
+	})
+}
+
+//HealthCritical 关键检查失败时不就绪(默认是), 非关键检查只展示结果
+func HealthCritical(critical bool) HealthOption {
+	return newHealthOption(func(o *healthCheck) {
+		o.critical = critical
+	})
+}
+
+//HealthLiveness 同时作为存活检查(/livez), 默认只作为就绪检查(/readyz)
+func HealthLiveness() HealthOption {
+	return newHealthOption(func(o *healthCheck) {
+		o.liveness = true
+	})
+}
+
+type healthCheck struct {
+	name     string
+	check    HealthCheck
+	timeout  time.Duration
+	critical bool
+	liveness bool
+}
+
+//HealthResult 健康检查的结果
+type HealthResult struct {
+	Status string               `json:"status"`
+	Checks []*HealthCheckResult `json:"checks"`
+}
+
+//HealthCheckResult 单个检查的结果
+type HealthCheckResult struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+	Latency  string `json:"latency"`
+}
+
+//Up 是否健康
+func (c *HealthResult) Up() bool {
+	return c.Status == HealthUp
+}
+
+//health 命名的健康检查, 就绪状态变化时通知grpc health和注册中心
+type health struct {
+	mu       sync.RWMutex
+	checks   map[string]*healthCheck
+	watchers []func(ready bool)
+	ready    *bool
+}
+
+func newHealth() *health {
+	return &health{checks: make(map[string]*healthCheck)}
+}
+
+func (c *health) add(name string, check HealthCheck, opts ...HealthOption) {
+	v := &healthCheck{
+		name:     name,
+		check:    check,
+		timeout:  defaultHealthTimeout,
+		critical: true,
+	}
+	for _, o := range opts {
+		o.apply(v)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = v
+}
+
+func (c *health) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.checks, name)
+}
+
+//run 并发执行检查, liveness为true时只执行存活检查
+func (c *health) run(ctx context.Context, liveness bool) *HealthResult {
+	c.mu.RLock()
+	checks := make([]*healthCheck, 0, len(c.checks))
+	for _, v := range c.checks {
+		if !liveness || v.liveness {
+			checks = append(checks, v)
+		}
+	}
+	c.mu.RUnlock()
+	sort.Slice(checks, func(i, j int) bool {
+		return checks[i].name < checks[j].name
+	})
+	result := &HealthResult{
+		Status: HealthUp,
+		Checks: make([]*HealthCheckResult, len(checks)),
+	}
+	var wg sync.WaitGroup
+	for i, v := range checks {
+		wg.Add(1)
+		go func(i int, v *healthCheck) {
+			defer wg.Done()
+			result.Checks[i] = v.run(ctx)
+		}(i, v)
+	}
+	wg.Wait()
+	for _, v := range result.Checks {
+		if v.Status != HealthUp && v.Critical {
+			result.Status = HealthDown
+		}
+	}
+	return result
+}
+
+func (c *healthCheck) run(ctx context.Context) *HealthCheckResult {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	ch := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				ch <- fmt.Errorf("health check panic: %v", r)
+			}
+		}()
+		ch <- c.check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-ch:
+	case <-ctx.Done():
+		//检查函数不支持context时也按超时处理
+		err = ctx.Err()
+	}
+	v := &HealthCheckResult{
+		Name:     c.name,
+		Status:   HealthUp,
+		Critical: c.critical,
+		Latency:  time.Since(start).String(),
+	}
+	if err != nil {
+		v.Status = HealthDown
+		v.Error = err.Error()
+	}
+	return v
+}
+
+//watch 就绪状态变化时回调(注册时使用当前状态回调一次, 还没有检查时为不就绪)
+func (c *health) watch(f func(ready bool)) {
+	c.mu.Lock()
+	c.watchers = append(c.watchers, f)
+	ready := c.ready != nil && *c.ready
+	c.mu.Unlock()
+	f(ready)
+}
+
+//isReady 最近一次就绪检查的结果(还没有检查时为不就绪)
+func (c *health) isReady() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ready != nil && *c.ready
+}
+
+//update 更新就绪状态, 返回状态是否变化
+func (c *health) update(ready bool) bool {
+	c.mu.Lock()
+	if c.ready != nil && *c.ready == ready {
+		c.mu.Unlock()
+		return false
+	}
+	c.ready = &ready
+	watchers := make([]func(bool), len(c.watchers))
+	copy(watchers, c.watchers)
+	c.mu.Unlock()
+	for _, f := range watchers {
+		f(ready)
+	}
+	return true
+}
+
+//AddHealthCheck 增加命名的健康检查(同名替换), 默认为2s超时的关键就绪检查
+func (c *MSManager) AddHealthCheck(name string, check HealthCheck, opts ...HealthOption) {
+	c.health.add(name, check, opts...)
+}
+
+//RemoveHealthCheck 删除健康检查
+func (c *MSManager) RemoveHealthCheck(name string) {
+	c.health.remove(name)
+}
+
+//Liveness 执行存活检查
+func (c *MSManager) Liveness(ctx context.Context) *HealthResult {
+	return c.health.run(ctx, true)
+}
+
+//Readiness 执行就绪检查
+func (c *MSManager) Readiness(ctx context.Context) *HealthResult {
+	return c.health.run(ctx, false)
+}
+
+func (c *MSManager) livezHandler() http.Handler {
+	return healthHandler(c.Liveness)
+}
+
+func (c *MSManager) readyzHandler() http.Handler {
+	return healthHandler(c.Readiness)
+}
+
+func healthHandler(run func(context.Context) *HealthResult) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := run(r.Context())
+		code := http.StatusOK
+		if !v.Up() {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, v)
+	})
+}
+
+//checkServices 注册的服务都在运行(RunWith启动之前不就绪)
+func (c *MSManager) checkServices(ctx context.Context) error {
+	for _, svc := range c.Services() {
+		if svc.State != ServiceRunning {
+			if svc.Error != "" {
+				return fmt.Errorf("service %s %s: %s", svc.Name, svc.State, svc.Error)
+			}
+			return fmt.Errorf("service %s %s", svc.Name, svc.State)
+		}
+	}
+	return nil
+}
+
+//healthReporter 支持上报实例健康状态的注册中心
+type healthReporter interface {
+	SetHealthy(ctx context.Context, svc MicroService, healthy bool) error
+}
+
+//watchHealth 定时执行就绪检查, 状态变化时更新grpc health和注册中心(不就绪的实例不接收流量)
+//第一次检查通过之前grpc health为NOT_SERVING(检查间隔最长1s), 注册中心在grace内不标记不健康, 避免每次启动时注销实例
+func (c *MSManager) watchHealth(ctx context.Context, interval time.Duration, grace time.Duration) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	deadline := time.Now().Add(grace)
+	started := false
+	//注册中心的状态, 注册时为健康
+	reported := true
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+		}
+		result := c.Readiness(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		up := result.Up()
+		changed := c.health.update(up)
+		switch {
+		case up && changed:
+			c.log.Normal().Info("service ready")
+		case !up && !started:
+			c.log.Normal().Debug("service starting, wait for ready", zap.Any("checks", result.Checks))
+		case changed:
+			c.log.Normal().Warn("service not ready", zap.Any("checks", result.Checks))
+		}
+		started = started || up
+		if up != reported && (started || time.Now().After(deadline)) {
+			if !up && !started {
+				c.log.Normal().Warn("service not ready after startup grace", zap.Duration("grace", grace), zap.Any("checks", result.Checks))
+			}
+			reported = up
+			c.reportHealth(ctx, up)
+		}
+		next := interval
+		if !started && next > defaultHealthStartInterval {
+			next = defaultHealthStartInterval
+		}
+		timer.Reset(next)
+	}
+}
+
+//reportHealth 在注册中心标记实例是否健康
+func (c *MSManager) reportHealth(ctx context.Context, healthy bool) {
+	reporter, ok := c.svcCenter.(healthReporter)
+	if !ok {
+		return
+	}
+	for _, svc := range c.svcs {
+		if err := reporter.SetHealthy(ctx, svc, healthy); err != nil {
+			c.log.Normal().Warn("report health to service center", zap.String("name", svc.Name()), zap.Error(err))
+			continue
+		}
+		if healthy {
+			c.states.setRegistry(svc, RegistryRegistered, nil)
+		} else {
+			c.states.setRegistry(svc, RegistryUnhealthy, nil)
+		}
+	}
+}
+
+//pingCheck 依赖的连接检查: mysql ping, redis PING(集群的每个主节点, 每个分片), mongo ping, influx ping
+func pingCheck(dep interface{}) HealthCheck {
+	return func(ctx context.Context) error {
+		switch d := dep.(type) {
+		case *gorm.DB:
+			pool := mysqlPool(d)
+			if pool == nil {
+				return errors.New("mysql transaction has no connection pool")
+			}
+			return pool.PingContext(ctx)
+		case *redis.Client:
+			return d.WithContext(ctx).Ping().Err()
+		case *redis.ClusterClient:
+			return d.WithContext(ctx).ForEachMaster(func(c *redis.Client) error {
+				return c.WithContext(ctx).Ping().Err()
+			})
+		case *redis.Ring:
+			return d.WithContext(ctx).ForEachShard(func(c *redis.Client) error {
+				return c.WithContext(ctx).Ping().Err()
+			})
+		case redis.Cmdable:
+			return d.Ping().Err()
+		case *mongo.Client:
+			return d.Ping(ctx, nil)
+		case ifxclient.Client:
+			timeout := defaultHealthTimeout
+			if deadline, ok := ctx.Deadline(); ok {
+				timeout = time.Until(deadline)
+			}
+			_, _, err := d.Ping(timeout)
+			return err
+		}
+		return nil
+	}
+}
+
+//dialCheck 检查地址可以连接(rabbitmq在使用时才建立连接)
+func dialCheck(addr string) HealthCheck {
+	return func(ctx context.Context) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
@@ -0,0 +1,144 @@
+package micro
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+//healthSC 记录SetHealthy的注册中心
+type healthSC struct {
+	ServiceCenter
+	mu      sync.Mutex
+	reports []bool
+}
+
+func (c *healthSC) SetHealthy(ctx context.Context, svc MicroService, healthy bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reports = append(c.reports, healthy)
+	return nil
+}
+
+func (c *healthSC) list() []bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]bool{}, c.reports...)
+}
+
+func TestHealthNotCheckedNotReady(t *testing.T) {
+	h := newHealth()
+	if h.isReady() {
+		t.Fatal("ready before the first check")
+	}
+	var got []bool
+	h.watch(func(ready bool) {
+		got = append(got, ready)
+	})
+	h.update(true)
+	h.update(true)
+	h.update(false)
+	if len(got) != 3 || got[0] || !got[1] || got[2] {
+		t.Fatalf("watch got %v, want [false true false]", got)
+	}
+}
+
+func TestHealthDepDownAtBoot(t *testing.T) {
+	const grace = 100 * time.Millisecond
+	m, err := NewMSManager(NoopServiceCenter(), MemoryConfigCenter(nil), LogLevel("error"),
+		NoGlobalTracer(), NoSignalHandler(), HealthInterval(10*time.Millisecond), HealthStartupGrace(grace),
+		ListenFunc(func(network, address string) (net.Listener, error) {
+			return bufconn.Listen(1024), nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &healthSC{ServiceCenter: m.svcCenter}
+	m.svcCenter = sc
+	var down int32 = 1
+	m.AddHealthCheck("deps.db", func(ctx context.Context) error {
+		if atomic.LoadInt32(&down) == 1 {
+			return errors.New("db down")
+		}
+		return nil
+	})
+	if err := m.RegisterGRPC("rpc", "127.0.0.1:9090", nil); err != nil {
+		t.Fatal(err)
+	}
+	svc, err := m.grpcService("rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		done <- m.RunWith(ctx, "test")
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	cctx, ccancel := context.WithTimeout(ctx, 5*time.Second)
+	defer ccancel()
+	conn, err := svc.dialInProcess(cctx, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	//serving的状态, 等待到want或者超时
+	waitServing := func(want healthpb.HealthCheckResponse_ServingStatus) {
+		t.Helper()
+		for {
+			resp, err := client.Check(cctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status == want {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	//依赖不可用时一直不就绪, grace之后在注册中心标记不健康
+	waitServing(healthpb.HealthCheckResponse_NOT_SERVING)
+	for len(sc.list()) == 0 {
+		if cctx.Err() != nil {
+			t.Fatal("not reported unhealthy")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < grace {
+		t.Fatalf("reported unhealthy after %v, within grace %v", elapsed, grace)
+	}
+	if r := sc.list(); r[0] {
+		t.Fatalf("reports %v, want unhealthy first", r)
+	}
+	if m.health.isReady() {
+		t.Fatal("ready with dependency down")
+	}
+	//依赖恢复后就绪
+	atomic.StoreInt32(&down, 0)
+	waitServing(healthpb.HealthCheckResponse_SERVING)
+	for {
+		if r := sc.list(); r[len(r)-1] {
+			break
+		}
+		if cctx.Err() != nil {
+			t.Fatal("not reported healthy")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !m.health.isReady() {
+		t.Fatal("not ready after dependency recovered")
+	}
+}
@@ -0,0 +1,469 @@
+package micro
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/whatisfaker/zaptrace/log"
+	"go.uber.org/zap"
+)
+
+const (
+	//defaultKafkaDialTimeout 默认的连接超时
+	defaultKafkaDialTimeout = 10 * time.Second
+	//defaultKafkaRetries 默认的消费失败重试次数
+	defaultKafkaRetries = 3
+	//defaultKafkaBackoff 默认的消费失败第一次重试的等待时间(之后加倍)
+	defaultKafkaBackoff = 200 * time.Millisecond
+	//kafkaHeaderDeadLetterError 死信消息的header: 处理失败的错误
+	kafkaHeaderDeadLetterError = "x-dead-letter-error"
+)
+
+var ErrKafkaMessageFailed = errors.New("kafka message failed")
+
+//KafkaConsumeOption ConsumeKafka的设置
+type KafkaConsumeOption interface {
+	apply(*kafkaConsume)
+}
+
+type kafkaConsumeOption struct {
+	f func(*kafkaConsume)
+}
+
+func (c *kafkaConsumeOption) apply(o *kafkaConsume) {
+	c.f(o)
+}
+
+func newKafkaConsumeOption(f func(*kafkaConsume)) *kafkaConsumeOption {
+	return &kafkaConsumeOption{
+		f: f,
+	}
+}
+
+//kafkaConsume 消费失败的处理
+type kafkaConsume struct {
+	retries     int
+	backoff     time.Duration
+	skip        bool
+	dlqProducer string
+	dlqTopic    string
+}
+
+//KafkaRetries 消费失败的重试次数(默认3, 0不重试)和第一次重试的等待时间(默认200ms, 之后加倍)
+func KafkaRetries(retries int, backoff time.Duration) KafkaConsumeOption {
+	return newKafkaConsumeOption(func(o *kafkaConsume) {
+		o.retries = retries
+		o.backoff = backoff
+	})
+}
+
+//KafkaSkipFailed 重试后仍然失败的消息记录错误日志后提交(跳过), 默认不提交并停止消费循环
+func KafkaSkipFailed() KafkaConsumeOption {
+	return newKafkaConsumeOption(func(o *kafkaConsume) {
+		o.skip = true
+	})
+}
+
+//KafkaDeadLetter 重试后仍然失败的消息使用deps中producerKey的生产者发送到topic(header带有错误), 发送成功后提交
+func KafkaDeadLetter(producerKey string, topic string) KafkaConsumeOption {
+	return newKafkaConsumeOption(func(o *kafkaConsume) {
+		o.dlqProducer = producerKey
+		o.dlqTopic = topic
+	})
+}
+
+//KafkaConfig kafka的连接配置
+type KafkaConfig struct {
+	Brokers  []string `yaml:"brokers"`
+	ClientID string   `yaml:"client_id"`
+	//Username, Password SASL PLAIN认证, Username为空时不认证
+	Username    string        `yaml:"username"`
+	Password    string        `yaml:"password"`
+	TLS         bool          `yaml:"tls"`
+	DialTimeout time.Duration `yaml:"dialtimeout"`
+}
+
+//KafkaProducerConfig kafka生产者配置, ParseConfig创建KafkaProducer(GetKafkaProducer)
+type KafkaProducerConfig struct {
+	KafkaConfig `yaml:",inline"`
+	//Topic 默认的topic, 为空时每条消息指定topic
+	Topic string `yaml:"topic"`
+	//Acks none, one, all(默认)
+	Acks string `yaml:"acks"`
+	//Async 异步发送(不等待结果, 错误只记录日志)
+	Async        bool          `yaml:"async"`
+	BatchSize    int           `yaml:"batch_size"`
+	BatchTimeout time.Duration `yaml:"batch_timeout"`
+	//Compression gzip, snappy, lz4, zstd, 为空时不压缩
+	Compression string `yaml:"compression"`
+}
+
+//KafkaConsumerConfig kafka消费组配置, ParseConfig创建KafkaConsumer(GetKafkaConsumer)
+type KafkaConsumerConfig struct {
+	KafkaConfig `yaml:",inline"`
+	GroupID     string   `yaml:"group_id"`
+	Topics      []string `yaml:"topics"`
+	//StartOffset 消费组没有提交的offset时开始的位置: first(默认), last
+	StartOffset    string        `yaml:"start_offset"`
+	MinBytes       int           `yaml:"min_bytes"`
+	MaxBytes       int           `yaml:"max_bytes"`
+	MaxWait        time.Duration `yaml:"max_wait"`
+	CommitInterval time.Duration `yaml:"commit_interval"`
+}
+
+//KafkaProducer kafka生产者(*kafka.Writer或者testkit的内存broker)
+type KafkaProducer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+//KafkaConsumer kafka消费组(*kafka.Reader或者testkit的内存broker), 处理后CommitMessages提交offset
+type KafkaConsumer interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+//KafkaHandler 处理kafka消息, ctx带有从消息headers提取的追踪
+type KafkaHandler func(ctx context.Context, msg kafka.Message) error
+
+func (c *KafkaConfig) mechanism() sasl.Mechanism {
+	if c.Username == "" {
+		return nil
+	}
+	return plain.Mechanism{Username: c.Username, Password: c.Password}
+}
+
+func (c *KafkaConfig) tls() *tls.Config {
+	if !c.TLS {
+		return nil
+	}
+	return &tls.Config{}
+}
+
+func (c *KafkaConfig) dialTimeout() time.Duration {
+	if c.DialTimeout <= 0 {
+		return defaultKafkaDialTimeout
+	}
+	return c.DialTimeout
+}
+
+//dial 连接任意一个broker
+func (c *KafkaConfig) dial(ctx context.Context) error {
+	if len(c.Brokers) == 0 {
+		return errors.New("miss kafka brokers")
+	}
+	d := &kafka.Dialer{
+		ClientID:      c.ClientID,
+		Timeout:       c.dialTimeout(),
+		TLS:           c.tls(),
+		SASLMechanism: c.mechanism(),
+	}
+	var err error
+	for _, addr := range c.Brokers {
+		var conn *kafka.Conn
+		conn, err = d.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn.Close()
+		}
+	}
+	return err
+}
+
+func newKafkaProducerDep(env *DepEnv, cfg interface{}) (interface{}, error) {
+	s := cfg.(*KafkaProducerConfig)
+	if err := s.dial(env.Context()); err != nil {
+		return nil, err
+	}
+	w := &kafka.Writer{
+		Addr:         kafka.TCP(s.Brokers...),
+		Topic:        s.Topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		Async:        s.Async,
+		BatchSize:    s.BatchSize,
+		BatchTimeout: s.BatchTimeout,
+		Transport: &kafka.Transport{
+			ClientID:    s.ClientID,
+			DialTimeout: s.dialTimeout(),
+			TLS:         s.tls(),
+			SASL:        s.mechanism(),
+		},
+		ErrorLogger: kafkaErrorLogger(env.Log),
+	}
+	if s.Acks != "" {
+		if err := w.RequiredAcks.UnmarshalText([]byte(s.Acks)); err != nil {
+			return nil, err
+		}
+	}
+	if s.Compression != "" {
+		if err := w.Compression.UnmarshalText([]byte(s.Compression)); err != nil {
+			return nil, err
+		}
+	}
+	return env.InstrumentKafka(w), nil
+}
+
+func newKafkaConsumerDep(env *DepEnv, cfg interface{}) (interface{}, error) {
+	s := cfg.(*KafkaConsumerConfig)
+	if s.GroupID == "" || len(s.Topics) == 0 {
+		return nil, errors.New("miss kafka group_id or topics")
+	}
+	if err := s.dial(env.Context()); err != nil {
+		return nil, err
+	}
+	rc := kafka.ReaderConfig{
+		Brokers:     s.Brokers,
+		GroupID:     s.GroupID,
+		GroupTopics: s.Topics,
+		StartOffset: kafka.FirstOffset,
+		MinBytes:    s.MinBytes,
+		MaxBytes:    s.MaxBytes,
+		MaxWait:     s.MaxWait,
+		Dialer: &kafka.Dialer{
+			ClientID:      s.ClientID,
+			Timeout:       s.dialTimeout(),
+			TLS:           s.tls(),
+			SASLMechanism: s.mechanism(),
+		},
+		CommitInterval: s.CommitInterval,
+		ErrorLogger:    kafkaErrorLogger(env.Log),
+	}
+	switch s.StartOffset {
+	case "", "first":
+	case "last":
+		rc.StartOffset = kafka.LastOffset
+	default:
+		return nil, errors.New("kafka start_offset must be first or last, not " + s.StartOffset)
+	}
+	if rc.MaxBytes == 0 {
+		rc.MaxBytes = 1e6
+	}
+	if err := rc.Validate(); err != nil {
+		return nil, err
+	}
+	return kafka.NewReader(rc), nil
+}
+
+//kafkaErrorLogger kafka客户端的错误日志
+func kafkaErrorLogger(l *log.Factory) kafka.Logger {
+	return kafka.LoggerFunc(func(msg string, args ...interface{}) {
+		l.Normal().Warn(fmt.Sprintf(msg, args...), zap.String("agent", "kafka"))
+	})
+}
+
+//kafkaDepCheck 连接任意一个broker
+func kafkaDepCheck(cfg interface{}, dep interface{}) HealthCheck {
+	var s *KafkaConfig
+	switch c := cfg.(type) {
+	case *KafkaProducerConfig:
+		s = &c.KafkaConfig
+	case *KafkaConsumerConfig:
+		s = &c.KafkaConfig
+	default:
+		return nil
+	}
+	return func(ctx context.Context) error {
+		return s.dial(ctx)
+	}
+}
+
+//InstrumentKafka 包装生产者(例如testkit的内存broker): 发送时创建span(kafka.produce)并注入到消息的headers, 统计指标
+func (c *DepEnv) InstrumentKafka(p KafkaProducer) KafkaProducer {
+	return c.inst.kafka(c.Key, p)
+}
+
+func (c *depInstrument) kafka(key string, p KafkaProducer) KafkaProducer {
+	if c == nil {
+		return p
+	}
+	return &kafkaProducer{KafkaProducer: p, inst: c, key: key}
+}
+
+type kafkaProducer struct {
+	KafkaProducer
+	inst *depInstrument
+	key  string
+}
+
+func (c *kafkaProducer) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	call := c.inst.start(ctx, DepKafka, "produce")
+	topic := ""
+	if len(msgs) > 0 {
+		topic = msgs[0].Topic
+	}
+	if call.span != nil {
+		ext.SpanKindProducer.Set(call.span)
+		call.span.SetTag("kafka.messages", len(msgs))
+		//不修改调用者的消息
+		traced := make([]kafka.Message, len(msgs))
+		for i := range msgs {
+			traced[i] = msgs[i]
+			traced[i].Headers = append([]kafka.Header(nil), msgs[i].Headers...)
+			_ = InjectKafkaHeaders(c.inst.tracer(DepKafka), call.span.Context(), &traced[i])
+		}
+		msgs = traced
+	}
+	err := c.KafkaProducer.WriteMessages(call.ctx, msgs...)
+	c.inst.finish(call, DepKafka, c.key, "produce", topic, err)
+	return err
+}
+
+//kafkaHeaders 消息headers的opentracing carrier(TextMap)
+type kafkaHeaders struct {
+	msg *kafka.Message
+}
+
+func (c kafkaHeaders) Set(key, val string) {
+	for i := range c.msg.Headers {
+		if c.msg.Headers[i].Key == key {
+			c.msg.Headers[i].Value = []byte(val)
+			return
+		}
+	}
+	c.msg.Headers = append(c.msg.Headers, kafka.Header{Key: key, Value: []byte(val)})
+}
+
+func (c kafkaHeaders) ForeachKey(handler func(key, val string) error) error {
+	for _, h := range c.msg.Headers {
+		if err := handler(h.Key, string(h.Value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//InjectKafkaHeaders 追踪注入到消息的headers
+func InjectKafkaHeaders(tracer opentracing.Tracer, sc opentracing.SpanContext, msg *kafka.Message) error {
+	return tracer.Inject(sc, opentracing.TextMap, kafkaHeaders{msg: msg})
+}
+
+//ExtractKafkaHeaders 从消息的headers提取追踪, 没有时返回opentracing.ErrSpanContextNotFound
+func ExtractKafkaHeaders(tracer opentracing.Tracer, msg *kafka.Message) (opentracing.SpanContext, error) {
+	return tracer.Extract(opentracing.TextMap, kafkaHeaders{msg: msg})
+}
+
+//ConsumeKafka 消费循环(用于RunWith), ctx结束时返回. 每条消息从headers提取追踪创建span(kafka.consume), handler成功后提交offset,
+//失败时退避重试(KafkaRetries), 重试后仍然失败时: 默认不提交, 返回错误(ErrKafkaMessageFailed)停止消费循环(RunWith退出, 重启后重新消费);
+//KafkaDeadLetter发送到死信topic后提交; KafkaSkipFailed记录错误日志后提交. 每次获取消息时从deps查找消费者(重连和热更新后使用新的消费者)
+func (c *MSManager) ConsumeKafka(deps *Deps, key string, handler KafkaHandler, opts ...KafkaConsumeOption) func(context.Context) error {
+	inst := c.depInstrument()
+	o := &kafkaConsume{retries: defaultKafkaRetries, backoff: defaultKafkaBackoff}
+	for _, v := range opts {
+		v.apply(o)
+	}
+	return func(ctx context.Context) error {
+		for {
+			consumer, err := deps.LookupKafkaConsumer(key)
+			if err != nil {
+				return err
+			}
+			msg, err := consumer.FetchMessage(ctx)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				if err != io.EOF {
+					inst.log.Normal().Warn("fetch kafka message", zap.String("key", key), zap.Error(err))
+				}
+				//消费者已经关闭(替换)或者暂时不可用
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(time.Second):
+				}
+				continue
+			}
+			if err := inst.consumeKafka(ctx, key, &msg, handler, o); err != nil {
+				if ctx.Err() != nil {
+					//没有处理完成, 不提交
+					return nil
+				}
+				if err := o.failed(ctx, deps, inst, key, msg, err); err != nil {
+					return err
+				}
+			}
+			//ctx结束时仍然提交已经处理的消息
+			cctx, cancel := context.WithTimeout(context.TODO(), defaultHealthTimeout)
+			err = consumer.CommitMessages(cctx, msg)
+			cancel()
+			if err != nil {
+				inst.log.Normal().Warn("commit kafka message", zap.String("key", key), zap.String("topic", msg.Topic), zap.Int64("offset", msg.Offset), zap.Error(err))
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+		}
+	}
+}
+
+//failed 重试后仍然失败的消息: 发送到死信或者跳过时返回nil(提交), 否则返回错误(不提交)
+func (c *kafkaConsume) failed(ctx context.Context, deps *Deps, inst *depInstrument, key string, msg kafka.Message, err error) error {
+	fields := []zap.Field{zap.String("key", key), zap.String("topic", msg.Topic), zap.Int("partition", msg.Partition), zap.Int64("offset", msg.Offset), zap.Error(err)}
+	if c.dlqTopic != "" {
+		producer, perr := deps.LookupKafkaProducer(c.dlqProducer)
+		if perr == nil {
+			dlq := kafka.Message{Topic: c.dlqTopic, Key: msg.Key, Value: msg.Value}
+			dlq.Headers = append(dlq.Headers, msg.Headers...)
+			dlq.Headers = append(dlq.Headers, kafka.Header{Key: kafkaHeaderDeadLetterError, Value: []byte(err.Error())})
+			perr = producer.WriteMessages(ctx, dlq)
+		}
+		if perr == nil {
+			inst.log.Normal().Warn("kafka message sent to dead letter", append(fields, zap.String("dead_letter", c.dlqTopic))...)
+			return nil
+		}
+		inst.log.Normal().Error("send kafka message to dead letter", append(fields, zap.String("dead_letter", c.dlqTopic), zap.NamedError("dead_letter_error", perr))...)
+	} else if c.skip {
+		inst.log.Normal().Error("kafka message dropped", fields...)
+		return nil
+	}
+	inst.log.Normal().Error("kafka message failed, stop consuming", fields...)
+	return fmt.Errorf("%w: %s/%d/%d: %v", ErrKafkaMessageFailed, msg.Topic, msg.Partition, msg.Offset, err)
+}
+
+//consumeKafka 处理一条消息, 失败时退避重试
+func (c *depInstrument) consumeKafka(ctx context.Context, key string, msg *kafka.Message, handler KafkaHandler, o *kafkaConsume) error {
+	tracer := c.tracer(DepKafka)
+	opts := []opentracing.StartSpanOption{ext.SpanKindConsumer}
+	if sc, err := ExtractKafkaHeaders(tracer, msg); err == nil {
+		opts = append(opts, opentracing.FollowsFrom(sc))
+	}
+	span := tracer.StartSpan(DepKafka+".consume", opts...)
+	ext.MessageBusDestination.Set(span, msg.Topic)
+	span.SetTag("kafka.partition", msg.Partition)
+	span.SetTag("kafka.offset", strconv.FormatInt(msg.Offset, 10))
+	call := &depCall{
+		ctx:   opentracing.ContextWithSpan(ctx, span),
+		span:  span,
+		start: time.Now(),
+	}
+	var err error
+	wait := o.backoff
+	for attempt := 0; ; attempt++ {
+		err = handler(call.ctx, *msg)
+		if err == nil || attempt >= o.retries {
+			break
+		}
+		c.log.Trace(call.ctx).Warn("handle kafka message error, retry", zap.String("key", key), zap.Int("attempt", attempt+1), zap.Error(err))
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wait *= 2
+	}
+	c.finish(call, DepKafka, key, "consume", msg.Topic, err)
+	return err
+}
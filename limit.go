@@ -0,0 +1,229 @@
+package micro
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+//LimitRule 限流规则(0表示不限制)
+type LimitRule struct {
+	RPS           float64 `yaml:"rps"`
+	Burst         int     `yaml:"burst"`
+	MaxConcurrent int     `yaml:"max_concurrent"`
+}
+
+//LimitConfig 服务的限流配置(配置中心key: limits.<服务名>)
+type LimitConfig struct {
+	LimitRule `yaml:",inline"`
+	//PerRoute 默认规则是否按路由/方法分别计数
+	PerRoute bool `yaml:"per_route"`
+	//Routes 按路由(gin FullPath)或方法(grpc FullMethod)单独设置的规则
+	Routes map[string]LimitRule `yaml:"routes"`
+}
+
+func (c *LimitConfig) rule(key string) (string, LimitRule) {
+	if r, ok := c.Routes[key]; ok {
+		return key, r
+	}
+	if c.PerRoute {
+		return key, c.LimitRule
+	}
+	return "", c.LimitRule
+}
+
+type keyLimiter struct {
+	rate     *rate.Limiter
+	max      int64
+	inflight int64
+}
+
+type limiter struct {
+	mu sync.Mutex
+	//initial 注册时的配置(ParamRateLimit等), 配置中心没有服务的配置时恢复
+	initial *LimitConfig
+	cfg     *LimitConfig
+	keys    map[string]*keyLimiter
+}
+
+func newLimiter(cfg *LimitConfig) *limiter {
+	c := &limiter{initial: cfg}
+	c.update(cfg)
+	return c
+}
+
+//reset 恢复注册时的配置
+func (c *limiter) reset() {
+	c.update(c.initial)
+}
+
+func (c *limiter) update(cfg *LimitConfig) {
+	if cfg == nil {
+		cfg = &LimitConfig{}
+	}
+	c.mu.Lock()
+	c.cfg = cfg
+	c.keys = make(map[string]*keyLimiter)
+	c.mu.Unlock()
+}
+
+func (c *limiter) get(key string) *keyLimiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, r := c.cfg.rule(key)
+	if kl, ok := c.keys[key]; ok {
+		return kl
+	}
+	kl := &keyLimiter{max: int64(r.MaxConcurrent)}
+	if r.RPS > 0 {
+		burst := r.Burst
+		if burst <= 0 {
+			burst = int(r.RPS) + 1
+		}
+		kl.rate = rate.NewLimiter(rate.Limit(r.RPS), burst)
+	}
+	c.keys[key] = kl
+	return kl
+}
+
+//acquire 获取执行许可, 返回释放函数
+func (c *limiter) acquire(key string) (func(), bool) {
+	kl := c.get(key)
+	if kl.rate != nil && !kl.rate.Allow() {
+		return nil, false
+	}
+	if kl.max <= 0 {
+		return func() {}, true
+	}
+	if atomic.AddInt64(&kl.inflight, 1) > kl.max {
+		atomic.AddInt64(&kl.inflight, -1)
+		return nil, false
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			atomic.AddInt64(&kl.inflight, -1)
+		})
+	}, true
+}
+
+func (c *limiter) ginMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		release, ok := c.acquire(ctx.FullPath())
+		if !ok {
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": ErrRateLimited.Error()})
+			return
+		}
+		defer release()
+		ctx.Next()
+	}
+}
+
+func (c *limiter) unaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		release, ok := c.acquire(info.FullMethod)
+		if !ok {
+			return nil, status.Error(codes.ResourceExhausted, ErrRateLimited.Error())
+		}
+		defer release()
+		return handler(ctx, req)
+	}
+}
+
+func (c *limiter) streamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		release, ok := c.acquire(info.FullMethod)
+		if !ok {
+			return status.Error(codes.ResourceExhausted, ErrRateLimited.Error())
+		}
+		defer release()
+		return handler(srv, ss)
+	}
+}
+
+//limitListener tcp服务按连接限流, 超出限制的连接直接关闭
+type limitListener struct {
+	net.Listener
+	limiter *limiter
+}
+
+func (c *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := c.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		release, ok := c.limiter.acquire("")
+		if !ok {
+			_ = conn.Close()
+			continue
+		}
+		return &limitConn{Conn: conn, release: release}, nil
+	}
+}
+
+type limitConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+type limitable interface {
+	limiters() []*limiter
+}
+
+//SetLimit 运行时修改服务的限流配置
+func (c *MSManager) SetLimit(name string, cfg *LimitConfig) {
+	for _, svc := range c.svcs {
+		if svc.Name() != name {
+			continue
+		}
+		if l, ok := svc.(limitable); ok {
+			for _, v := range l.limiters() {
+				v.update(cfg)
+			}
+		}
+	}
+}
+
+//ReloadLimits 从配置中心(limits)重新加载所有服务的限流配置, 配置中没有的服务恢复注册时的配置(ParamRateLimit等, 没有时不限制)
+func (c *MSManager) ReloadLimits(ctx context.Context) error {
+	v := &struct {
+		Limits map[string]*LimitConfig `yaml:"limits"`
+	}{}
+	err := c.confCenter.GetConfig(ctx, v)
+	c.metrics.configReloaded("limits", err)
+	if err != nil {
+		return err
+	}
+	for _, svc := range c.svcs {
+		l, ok := svc.(limitable)
+		if !ok {
+			continue
+		}
+		cfg, ok := v.Limits[svc.Name()]
+		for _, v := range l.limiters() {
+			if ok {
+				v.update(cfg)
+			} else {
+				v.reset()
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package micro
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestLimiterRules(t *testing.T) {
+	l := newLimiter(&LimitConfig{
+		LimitRule: LimitRule{MaxConcurrent: 1},
+		Routes:    map[string]LimitRule{"/slow": {RPS: 0.001, Burst: 1}},
+	})
+	release, ok := l.acquire("/a")
+	if !ok {
+		t.Fatal("first request limited")
+	}
+	//没有PerRoute时所有路由共用默认规则
+	if _, ok := l.acquire("/b"); ok {
+		t.Fatal("concurrent request on shared rule not limited")
+	}
+	release()
+	release()
+	if r, ok := l.acquire("/b"); !ok {
+		t.Fatal("request limited after release")
+	} else {
+		r()
+	}
+	//单独设置的路由
+	if _, ok := l.acquire("/slow"); !ok {
+		t.Fatal("first /slow request limited")
+	}
+	if _, ok := l.acquire("/slow"); ok {
+		t.Fatal("/slow over rps not limited")
+	}
+	l.update(&LimitConfig{LimitRule: LimitRule{MaxConcurrent: 1}, PerRoute: true})
+	if _, ok := l.acquire("/a"); !ok {
+		t.Fatal("/a limited")
+	}
+	if _, ok := l.acquire("/b"); !ok {
+		t.Fatal("per route rule shared between routes")
+	}
+}
+
+func TestLimitGin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := newLimiter(&LimitConfig{LimitRule: LimitRule{RPS: 0.001, Burst: 1}})
+	r := gin.New()
+	r.Use(l.ginMiddleware())
+	r.GET("/ping", func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, "pong")
+	})
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/ping", nil))
+		if w.Code != want {
+			t.Fatalf("request %d: status %d, want %d", i, w.Code, want)
+		}
+	}
+}
+
+func TestLimitGRPC(t *testing.T) {
+	l := newLimiter(&LimitConfig{LimitRule: LimitRule{MaxConcurrent: 1}})
+	unary := l.unaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Method"}
+	entered := make(chan struct{})
+	block := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := unary(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			close(entered)
+			<-block
+			return nil, nil
+		})
+		done <- err
+	}()
+	<-entered
+	_, err := unary(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("unary over limit: %v, want ResourceExhausted", err)
+	}
+	stream := l.streamServerInterceptor()
+	err = stream(nil, nil, &grpc.StreamServerInfo{FullMethod: "/pkg.Service/Stream"}, func(srv interface{}, ss grpc.ServerStream) error {
+		return nil
+	})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("stream over limit: %v, want ResourceExhausted", err)
+	}
+	close(block)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unary(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}); err != nil {
+		t.Fatalf("unary after release: %v", err)
+	}
+}
+
+func TestLimitListener(t *testing.T) {
+	bl := bufconn.Listen(1024)
+	ln := &limitListener{Listener: bl, limiter: newLimiter(&LimitConfig{LimitRule: LimitRule{MaxConcurrent: 1}})}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	c1, err := bl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	first := <-accepted
+	//超过最大连接数的连接被关闭
+	c2, err := bl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c2.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("connection over limit not closed: %v", err)
+	}
+	//关闭后可以建立新的连接
+	first.Close()
+	c3, err := bl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c3.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not accepted after release")
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func TestReloadLimits(t *testing.T) {
+	m, err := NewMSManager(NoopServiceCenter(), MemoryConfigCenter(map[string]interface{}{
+		"limits": map[string]interface{}{
+			"a": map[string]interface{}{"rps": 5},
+			"b": map[string]interface{}{"max_concurrent": 2},
+		},
+	}), LogLevel("error"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RegisterGin("a", "127.0.0.1:8080", nil, ParamRateLimit(1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RegisterGRPC("b", "127.0.0.1:9090", nil); err != nil {
+		t.Fatal(err)
+	}
+	limits := func(name string) *LimitConfig {
+		for _, svc := range m.svcs {
+			if svc.Name() == name {
+				return svc.(limitable).limiters()[0].cfg
+			}
+		}
+		t.Fatalf("service %s not registered", name)
+		return nil
+	}
+	ctx := context.Background()
+	if err := m.ReloadLimits(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if limits("a").RPS != 5 || limits("b").MaxConcurrent != 2 {
+		t.Fatalf("limits not loaded: %+v %+v", limits("a"), limits("b"))
+	}
+	//配置中没有的服务恢复注册时的配置
+	if err := m.ConfigCenter().SetConfig(ctx, map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ReloadLimits(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if limits("a").RPS != 1 || limits("a").Burst != 1 {
+		t.Fatalf("a not reset to registration limits: %+v", limits("a"))
+	}
+	if limits("b").MaxConcurrent != 0 {
+		t.Fatalf("b not reset to unlimited: %+v", limits("b"))
+	}
+}
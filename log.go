@@ -39,4 +39,4 @@ func (c *zapLogger) Level(level string) {
 
 func (c *zapLogger) SetLevel(level string) {
 	c.zaplogger.SetLevel(level)
-}
\ No newline at end of file
+}
@@ -0,0 +1,250 @@
+package micro
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/whatisfaker/zaptrace/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	//HeaderRequestID 请求ID(http header, grpc metadata为小写)
+	HeaderRequestID = "X-Request-ID"
+	//HeaderUserID 调用方用户(网关设置)
+	HeaderUserID = "X-User-ID"
+)
+
+var defaultLogger = log.NewStdLogger("info")
+
+type requestIDKey struct{}
+
+type requestLogKey struct{}
+
+//requestLog 请求的日志上下文
+type requestLog struct {
+	factory *log.Factory
+	fields  []zap.Field
+}
+
+//LoggerFrom 获取请求的日志(包含请求ID, 路由/方法, 来源, 用户等字段和追踪信息), 没有请求时为管理器的日志
+func LoggerFrom(ctx context.Context) log.Logger {
+	if gc, ok := ctx.(*gin.Context); ok && gc.Request != nil {
+		ctx = gc.Request.Context()
+	}
+	if v, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return v.factory.Trace(ctx).With(v.fields...)
+	}
+	if gMSManager != nil {
+		return gMSManager.log.Trace(ctx)
+	}
+	return defaultLogger.Trace(ctx)
+}
+
+//RequestID 获取请求ID
+func RequestID(ctx context.Context) string {
+	if gc, ok := ctx.(*gin.Context); ok && gc.Request != nil {
+		ctx = gc.Request.Context()
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+//WithLogFields 为请求的日志增加字段(例如鉴权之后的用户信息)
+func WithLogFields(ctx context.Context, fields ...zap.Field) context.Context {
+	v, ok := ctx.Value(requestLogKey{}).(*requestLog)
+	if !ok {
+		factory := defaultLogger
+		if gMSManager != nil {
+			factory = gMSManager.log
+		}
+		v = &requestLog{factory: factory}
+	}
+	all := make([]zap.Field, 0, len(v.fields)+len(fields))
+	all = append(all, v.fields...)
+	all = append(all, fields...)
+	return context.WithValue(ctx, requestLogKey{}, &requestLog{factory: v.factory, fields: all})
+}
+
+//NewRequestContext 创建请求的上下文(requestID为空时生成), 用于tcp等没有中间件的处理函数
+func NewRequestContext(ctx context.Context, requestID string, fields ...zap.Field) context.Context {
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	ctx = context.WithValue(ctx, requestIDKey{}, requestID)
+	return WithLogFields(ctx, append([]zap.Field{zap.String("request_id", requestID)}, fields...)...)
+}
+
+//withServiceLog 服务的日志上下文(处理函数的ctx从这里派生)
+func withServiceLog(ctx context.Context, factory *log.Factory) context.Context {
+	return context.WithValue(ctx, requestLogKey{}, &requestLog{factory: factory})
+}
+
+func newRequestID() string {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return ""
+	}
+	return id.String()
+}
+
+//requestLogGinMiddleware 生成或者传递请求ID, 设置请求的日志上下文
+func requestLogGinMiddleware(factory *log.Factory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id := ctx.GetHeader(HeaderRequestID)
+		if id == "" {
+			id = newRequestID()
+		}
+		ctx.Header(HeaderRequestID, id)
+		fields := []zap.Field{
+			zap.String("request_id", id),
+			zap.String("method", ctx.Request.Method),
+			zap.String("route", ctx.FullPath()),
+			zap.String("peer", ctx.ClientIP()),
+		}
+		if user := ctx.GetHeader(HeaderUserID); user != "" {
+			fields = append(fields, zap.String("user", user))
+		}
+		rctx := context.WithValue(ctx.Request.Context(), requestIDKey{}, id)
+		rctx = context.WithValue(rctx, requestLogKey{}, &requestLog{factory: factory, fields: fields})
+		ctx.Request = ctx.Request.WithContext(rctx)
+		ctx.Next()
+	}
+}
+
+func metadataValue(md metadata.MD, key string) string {
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+//grpcRequestContext 从metadata获取或者生成请求ID, 设置请求的日志上下文
+func grpcRequestContext(ctx context.Context, factory *log.Factory, method string) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := metadataValue(md, strings.ToLower(HeaderRequestID))
+	if id == "" {
+		id = newRequestID()
+	}
+	_ = grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(HeaderRequestID), id))
+	fields := []zap.Field{
+		zap.String("request_id", id),
+		zap.String("method", method),
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		fields = append(fields, zap.String("peer", p.Addr.String()))
+	}
+	if user := metadataValue(md, strings.ToLower(HeaderUserID)); user != "" {
+		fields = append(fields, zap.String("user", user))
+	}
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	return context.WithValue(ctx, requestLogKey{}, &requestLog{factory: factory, fields: fields})
+}
+
+func requestLogUnaryServerInterceptor(factory *log.Factory) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(grpcRequestContext(ctx, factory, info.FullMethod), req)
+	}
+}
+
+//contextServerStream 替换ServerStream的context
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (c *contextServerStream) Context() context.Context {
+	return c.ctx
+}
+
+func requestLogStreamServerInterceptor(factory *log.Factory) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &contextServerStream{ServerStream: ss, ctx: grpcRequestContext(ss.Context(), factory, info.FullMethod)})
+	}
+}
+
+//outgoingRequestID grpc客户端传递请求ID
+func outgoingRequestID(ctx context.Context) context.Context {
+	if id := RequestID(ctx); id != "" {
+		return metadata.AppendToOutgoingContext(ctx, strings.ToLower(HeaderRequestID), id)
+	}
+	return ctx
+}
+
+func requestIDUnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(outgoingRequestID(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+func requestIDStreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(outgoingRequestID(ctx), desc, cc, method, opts...)
+	}
+}
+
+//TCPMetadata tcp消息的元数据(codec的消息头), 用于传递请求ID
+type TCPMetadata interface {
+	Get(key string) string
+	Set(key string, value string)
+}
+
+//TCPMetadataMap map实现的TCPMetadata
+type TCPMetadataMap map[string]string
+
+func (c TCPMetadataMap) Get(key string) string {
+	return c[key]
+}
+
+func (c TCPMetadataMap) Set(key string, value string) {
+	c[key] = value
+}
+
+//TCPHandler tcp处理函数, req和resp为请求和响应的元数据
+type TCPHandler func(ctx context.Context, peer net.Addr, req TCPMetadata, resp TCPMetadata) error
+
+//TCPInterceptor tcp拦截器: 从请求的元数据读取(没有时生成)X-Request-ID并写回响应的元数据, handler的ctx带有请求日志(request_id, route, peer, user)
+//ctx为initFunc的ctx(服务的日志)
+func TCPInterceptor(ctx context.Context, route string, handler TCPHandler) TCPHandler {
+	factory := defaultLogger
+	if v, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		factory = v.factory
+	} else if gMSManager != nil {
+		factory = gMSManager.log
+	}
+	return func(rctx context.Context, peer net.Addr, req TCPMetadata, resp TCPMetadata) error {
+		id := req.Get(HeaderRequestID)
+		if id == "" {
+			id = newRequestID()
+		}
+		if resp != nil {
+			resp.Set(HeaderRequestID, id)
+		}
+		fields := []zap.Field{
+			zap.String("request_id", id),
+			zap.String("route", route),
+		}
+		if peer != nil {
+			fields = append(fields, zap.String("peer", peer.String()))
+		}
+		if user := req.Get(HeaderUserID); user != "" {
+			fields = append(fields, zap.String("user", user))
+		}
+		rctx = context.WithValue(rctx, requestIDKey{}, id)
+		rctx = context.WithValue(rctx, requestLogKey{}, &requestLog{factory: factory, fields: fields})
+		return handler(rctx, peer, req, resp)
+	}
+}
+
+//InjectTCPRequestID tcp客户端传递请求ID
+func InjectTCPRequestID(ctx context.Context, md TCPMetadata) {
+	if id := RequestID(ctx); id != "" {
+		md.Set(HeaderRequestID, id)
+	}
+}
@@ -0,0 +1,225 @@
+package micro
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/whatisfaker/zaptrace/log"
+	"go.uber.org/zap"
+)
+
+//日志子系统(SetLogLevel使用)
+const (
+	LogNacos    = "nacos"
+	LogConf     = "conf"
+	LogRegistry = "registry"
+	LogDeps     = "deps"
+	LogGin      = "gin"
+	LogGRPC     = "grpc"
+	LogTCP      = "tcp"
+	LogAudit    = "audit"
+	LogConsumer = "consumer"
+
+	defaultLogLevelPath = "/admin/loglevel"
+)
+
+var ErrInvalidLogLevel = errors.New("invalid log level")
+
+//LogLevelConfig 日志级别(配置中心key: log)
+type LogLevelConfig struct {
+	//Level 全局级别(没有单独设置的子系统跟随全局级别)
+	Level string `yaml:"level" json:"level"`
+	//Subsystems 子系统的级别(nacos, conf, registry, deps, gin, grpc, tcp, audit, consumer)
+	Subsystems map[string]string `yaml:"subsystems" json:"subsystems"`
+}
+
+//logLevels 运行时的日志级别, log.With创建的日志有独立的级别, 所以按子系统登记
+type logLevels struct {
+	mu         sync.Mutex
+	root       *log.Factory
+	factories  map[string][]*log.Factory
+	overridden map[string]string
+}
+
+func newLogLevels(root *log.Factory) *logLevels {
+	return &logLevels{
+		root:       root,
+		factories:  make(map[string][]*log.Factory),
+		overridden: make(map[string]string),
+	}
+}
+
+//register 登记子系统的日志, 使用子系统当前的级别
+func (c *logLevels) register(subsystem string, factory *log.Factory) *log.Factory {
+	if c == nil || factory == nil {
+		return factory
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.factories[subsystem] = append(c.factories[subsystem], factory)
+	if lv, ok := c.overridden[subsystem]; ok {
+		factory.SetLevel(lv)
+	} else {
+		factory.SetLevel(c.root.Level())
+	}
+	return factory
+}
+
+//with 创建并登记子系统的日志
+func (c *logLevels) with(subsystem string, fields ...zap.Field) *log.Factory {
+	return c.register(subsystem, c.root.With(fields...))
+}
+
+//normalizeLogLevel 转为小写, 只支持zaptrace的debug, info, warn, error(其他级别zaptrace按info处理)
+func normalizeLogLevel(level string) (string, bool) {
+	level = strings.ToLower(strings.TrimSpace(level))
+	switch level {
+	case "debug", "info", "warn", "error":
+		return level, true
+	}
+	return "", false
+}
+
+//set 设置级别, subsystem为空时设置全局级别(已经单独设置的子系统不变)
+func (c *logLevels) set(subsystem string, level string) error {
+	level, ok := normalizeLogLevel(level)
+	if !ok {
+		return ErrInvalidLogLevel
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if subsystem == "" {
+		c.root.SetLevel(level)
+		for name, factories := range c.factories {
+			if _, ok := c.overridden[name]; ok {
+				continue
+			}
+			for _, f := range factories {
+				f.SetLevel(level)
+			}
+		}
+		return nil
+	}
+	c.overridden[subsystem] = level
+	for _, f := range c.factories[subsystem] {
+		f.SetLevel(level)
+	}
+	return nil
+}
+
+//reset 子系统恢复跟随全局级别
+func (c *logLevels) reset(subsystem string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.overridden, subsystem)
+	for _, f := range c.factories[subsystem] {
+		f.SetLevel(c.root.Level())
+	}
+}
+
+func (c *logLevels) get() *LogLevelConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v := &LogLevelConfig{
+		Level:      c.root.Level(),
+		Subsystems: make(map[string]string),
+	}
+	for name := range c.factories {
+		v.Subsystems[name] = v.Level
+	}
+	for name, lv := range c.overridden {
+		v.Subsystems[name] = lv
+	}
+	return v
+}
+
+//apply 应用配置, 配置中没有的子系统恢复跟随全局级别
+func (c *logLevels) apply(cfg *LogLevelConfig) error {
+	if cfg.Level != "" {
+		if err := c.set("", cfg.Level); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	names := make([]string, 0, len(c.overridden))
+	for name := range c.overridden {
+		names = append(names, name)
+	}
+	c.mu.Unlock()
+	for _, name := range names {
+		if _, ok := cfg.Subsystems[name]; !ok {
+			c.reset(name)
+		}
+	}
+	for name, lv := range cfg.Subsystems {
+		if err := c.set(name, lv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//SetLogLevel 设置日志级别, subsystem为空时设置全局级别
+func (c *MSManager) SetLogLevel(subsystem string, level string) error {
+	return c.logs.set(subsystem, level)
+}
+
+//LogLevels 获取当前的日志级别
+func (c *MSManager) LogLevels() *LogLevelConfig {
+	return c.logs.get()
+}
+
+//ReloadLogLevel 从配置中心(log)重新加载日志级别
+func (c *MSManager) ReloadLogLevel(ctx context.Context) error {
+	v := &struct {
+		Log *LogLevelConfig `yaml:"log"`
+	}{}
+	err := c.confCenter.GetConfig(ctx, v)
+	if err == nil && v.Log != nil {
+		err = c.logs.apply(v.Log)
+	}
+	c.metrics.configReloaded("log", err)
+	return err
+}
+
+//LogLevelHandler 日志级别的http接口: GET获取, PUT设置({"level":"debug","subsystem":"gin"}, subsystem为空时设置全局级别)
+func (c *MSManager) LogLevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			req := &struct {
+				Level     string `json:"level"`
+				Subsystem string `json:"subsystem"`
+			}{
+				Level:     r.URL.Query().Get("level"),
+				Subsystem: r.URL.Query().Get("subsystem"),
+			}
+			if req.Level == "" {
+				if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+					writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+					return
+				}
+			}
+			if err := c.SetLogLevel(req.Subsystem, req.Level); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			c.log.Normal().Info("set log level", zap.String("subsystem", req.Subsystem), zap.String("level", req.Level))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, c.LogLevels())
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,343 @@
+package micro
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/whatisfaker/micro/grpcpool"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	metricsNamespace   = "micro"
+	defaultMetricsPath = "/metrics"
+)
+
+//metrics 管理器持有的prometheus指标
+type metrics struct {
+	registry           *prometheus.Registry
+	httpRequests       *prometheus.CounterVec
+	httpDuration       *prometheus.HistogramVec
+	grpcServerHandled  *prometheus.CounterVec
+	grpcServerDuration *prometheus.HistogramVec
+	grpcClientHandled  *prometheus.CounterVec
+	grpcClientDuration *prometheus.HistogramVec
+	tcpAccepted        *prometheus.CounterVec
+	tcpActive          *prometheus.GaugeVec
+	tcpReadBytes       *prometheus.CounterVec
+	tcpWriteBytes      *prometheus.CounterVec
+	configReloads      *prometheus.CounterVec
+	registerFailures   *prometheus.CounterVec
+	heartbeatFailures  *prometheus.CounterVec
+	depRequests        *prometheus.CounterVec
+	depDuration        *prometheus.HistogramVec
+	depReconnects      *prometheus.CounterVec
+	consumerMessages   *prometheus.CounterVec
+	consumerDuration   *prometheus.HistogramVec
+	consumerInflight   *prometheus.GaugeVec
+	pools              *poolCollector
+}
+
+func newMetrics() *metrics {
+	c := &metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "http", Name: "requests_total", Help: "HTTP requests handled by gin services.",
+		}, []string{"service", "method", "route", "code"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Subsystem: "http", Name: "request_duration_seconds", Help: "HTTP request latency of gin services.", Buckets: prometheus.DefBuckets,
+		}, []string{"service", "method", "route"}),
+		grpcServerHandled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "grpc_server", Name: "handled_total", Help: "gRPC calls handled by grpc services.",
+		}, []string{"service", "method", "code"}),
+		grpcServerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Subsystem: "grpc_server", Name: "handling_seconds", Help: "gRPC handling latency of grpc services.", Buckets: prometheus.DefBuckets,
+		}, []string{"service", "method"}),
+		grpcClientHandled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "grpc_client", Name: "handled_total", Help: "gRPC calls completed by clients.",
+		}, []string{"target", "method", "code"}),
+		grpcClientDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Subsystem: "grpc_client", Name: "handling_seconds", Help: "gRPC client call latency.", Buckets: prometheus.DefBuckets,
+		}, []string{"target", "method"}),
+		tcpAccepted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "tcp", Name: "connections_total", Help: "TCP connections accepted.",
+		}, []string{"service"}),
+		tcpActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace, Subsystem: "tcp", Name: "connections_active", Help: "TCP connections currently open.",
+		}, []string{"service"}),
+		tcpReadBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "tcp", Name: "read_bytes_total", Help: "Bytes read from TCP connections.",
+		}, []string{"service"}),
+		tcpWriteBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "tcp", Name: "write_bytes_total", Help: "Bytes written to TCP connections.",
+		}, []string{"service"}),
+		configReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "config", Name: "reloads_total", Help: "Config reloads from the config center.",
+		}, []string{"kind", "result"}),
+		registerFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "registry", Name: "registration_failures_total", Help: "Service registry registration failures.",
+		}, []string{"service", "group"}),
+		heartbeatFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "registry", Name: "heartbeat_failures_total", Help: "Service registry heartbeat failures.",
+		}, []string{"service", "group"}),
+		depRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "dep", Name: "requests_total", Help: "Calls to dependencies created by ParseConfig.",
+		}, []string{"dep", "key", "op", "result"}),
+		depDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Subsystem: "dep", Name: "request_duration_seconds", Help: "Latency of calls to dependencies created by ParseConfig.", Buckets: prometheus.DefBuckets,
+		}, []string{"dep", "key", "op"}),
+		depReconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "dep", Name: "reconnects_total", Help: "Reconnects of dependencies created by ParseConfig.",
+		}, []string{"dep", "key", "result"}),
+		consumerMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "consumer", Name: "messages_total", Help: "Messages handled by consumers.",
+		}, []string{"consumer", "result"}),
+		consumerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Subsystem: "consumer", Name: "handling_seconds", Help: "Message handling latency of consumers, including retries.", Buckets: prometheus.DefBuckets,
+		}, []string{"consumer"}),
+		consumerInflight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace, Subsystem: "consumer", Name: "inflight", Help: "Messages currently being handled by consumers.",
+		}, []string{"consumer"}),
+		pools: &poolCollector{
+			pools: make(map[string]*grpcpool.Pool),
+		},
+	}
+	c.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		c.httpRequests, c.httpDuration,
+		c.grpcServerHandled, c.grpcServerDuration,
+		c.grpcClientHandled, c.grpcClientDuration,
+		c.tcpAccepted, c.tcpActive, c.tcpReadBytes, c.tcpWriteBytes,
+		c.configReloads, c.registerFailures, c.heartbeatFailures,
+		c.depRequests, c.depDuration, c.depReconnects,
+		c.consumerMessages, c.consumerDuration, c.consumerInflight,
+		c.pools,
+	)
+	return c
+}
+
+func (c *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(c.registry, promhttp.HandlerOpts{})
+}
+
+func (c *metrics) ginMiddleware(service string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+		route := ctx.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := ctx.Request.Method
+		c.httpRequests.WithLabelValues(service, method, route, strconv.Itoa(ctx.Writer.Status())).Inc()
+		c.httpDuration.WithLabelValues(service, method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (c *metrics) unaryServerInterceptor(service string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		c.grpcServerHandled.WithLabelValues(service, info.FullMethod, status.Code(err).String()).Inc()
+		c.grpcServerDuration.WithLabelValues(service, info.FullMethod).Observe(time.Since(start).Seconds())
+		return resp, err
+	}
+}
+
+func (c *metrics) streamServerInterceptor(service string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		c.grpcServerHandled.WithLabelValues(service, info.FullMethod, status.Code(err).String()).Inc()
+		c.grpcServerDuration.WithLabelValues(service, info.FullMethod).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+func (c *metrics) unaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		c.grpcClientHandled.WithLabelValues(cc.Target(), method, status.Code(err).String()).Inc()
+		c.grpcClientDuration.WithLabelValues(cc.Target(), method).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+//streamClientInterceptor 流式调用只统计建立流
+func (c *metrics) streamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		start := time.Now()
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		c.grpcClientHandled.WithLabelValues(cc.Target(), method, status.Code(err).String()).Inc()
+		c.grpcClientDuration.WithLabelValues(cc.Target(), method).Observe(time.Since(start).Seconds())
+		return stream, err
+	}
+}
+
+func (c *metrics) configReloaded(kind string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	c.configReloads.WithLabelValues(kind, result).Inc()
+}
+
+func (c *metrics) depReconnected(dep string, key string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	c.depReconnects.WithLabelValues(dep, key, result).Inc()
+}
+
+//consumed 消费者处理一条消息(result: ack, dead_letter, dropped, nack)
+func (c *metrics) consumed(consumer string, result string, d time.Duration) {
+	c.consumerMessages.WithLabelValues(consumer, result).Inc()
+	c.consumerDuration.WithLabelValues(consumer).Observe(d.Seconds())
+}
+
+//tcpListener 统计tcp服务的连接数和读写字节数
+func (c *metrics) tcpListener(service string, l net.Listener) net.Listener {
+	return &metricsListener{Listener: l, service: service, metrics: c}
+}
+
+type metricsListener struct {
+	net.Listener
+	service string
+	metrics *metrics
+}
+
+func (c *metricsListener) Accept() (net.Conn, error) {
+	conn, err := c.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c.metrics.tcpAccepted.WithLabelValues(c.service).Inc()
+	c.metrics.tcpActive.WithLabelValues(c.service).Inc()
+	return &metricsConn{
+		Conn:  conn,
+		read:  c.metrics.tcpReadBytes.WithLabelValues(c.service),
+		write: c.metrics.tcpWriteBytes.WithLabelValues(c.service),
+		close: func() {
+			c.metrics.tcpActive.WithLabelValues(c.service).Dec()
+		},
+	}, nil
+}
+
+type metricsConn struct {
+	net.Conn
+	read  prometheus.Counter
+	write prometheus.Counter
+	close func()
+	once  sync.Once
+}
+
+func (c *metricsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(float64(n))
+	return n, err
+}
+
+func (c *metricsConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.write.Add(float64(n))
+	return n, err
+}
+
+func (c *metricsConn) Close() error {
+	c.once.Do(c.close)
+	return c.Conn.Close()
+}
+
+//poolCollector grpc连接池统计
+type poolCollector struct {
+	mu    sync.RWMutex
+	pools map[string]*grpcpool.Pool
+}
+
+var (
+	poolIdleDesc       = prometheus.NewDesc(metricsNamespace+"_grpcpool_idle_connections", "Idle connections in the grpc pool.", []string{"target"}, nil)
+	poolGetsDesc       = prometheus.NewDesc(metricsNamespace+"_grpcpool_gets_total", "Connections requested from the grpc pool.", []string{"target"}, nil)
+	poolHitsDesc       = prometheus.NewDesc(metricsNamespace+"_grpcpool_hits_total", "Idle connections reused from the grpc pool.", []string{"target"}, nil)
+	poolNewsDesc       = prometheus.NewDesc(metricsNamespace+"_grpcpool_new_connections_total", "Connections dialed by the grpc pool.", []string{"target"}, nil)
+	poolClosedDesc     = prometheus.NewDesc(metricsNamespace+"_grpcpool_closed_connections_total", "Connections closed by the grpc pool.", []string{"target"}, nil)
+	poolDialErrorsDesc = prometheus.NewDesc(metricsNamespace+"_grpcpool_dial_errors_total", "Dial failures of the grpc pool.", []string{"target"}, nil)
+)
+
+//add 统计连接池, 连接池关闭时注销
+func (c *poolCollector) add(target string, pool *grpcpool.Pool) {
+	c.mu.Lock()
+	c.pools[target] = pool
+	c.mu.Unlock()
+	pool.OnClose(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		//同一个target已经替换为新的连接池时保留
+		if c.pools[target] == pool {
+			delete(c.pools, target)
+		}
+	})
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolIdleDesc
+	ch <- poolGetsDesc
+	ch <- poolHitsDesc
+	ch <- poolNewsDesc
+	ch <- poolClosedDesc
+	ch <- poolDialErrorsDesc
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for target, pool := range c.pools {
+		s := pool.Stats()
+		ch <- prometheus.MustNewConstMetric(poolIdleDesc, prometheus.GaugeValue, float64(s.Idle), target)
+		ch <- prometheus.MustNewConstMetric(poolGetsDesc, prometheus.CounterValue, float64(s.Gets), target)
+		ch <- prometheus.MustNewConstMetric(poolHitsDesc, prometheus.CounterValue, float64(s.Hits), target)
+		ch <- prometheus.MustNewConstMetric(poolNewsDesc, prometheus.CounterValue, float64(s.News), target)
+		ch <- prometheus.MustNewConstMetric(poolClosedDesc, prometheus.CounterValue, float64(s.Closed), target)
+		ch <- prometheus.MustNewConstMetric(poolDialErrorsDesc, prometheus.CounterValue, float64(s.DialErrors), target)
+	}
+}
+
+//MetricsRegistry 获取prometheus的registry(注册自定义指标)
+func (c *MSManager) MetricsRegistry() *prometheus.Registry {
+	return c.metrics.registry
+}
+
+//MetricsHandler 获取prometheus指标的http handler
+func (c *MSManager) MetricsHandler() http.Handler {
+	return c.metrics.handler()
+}
+
+//serveMetrics 在独立端口上提供/metrics
+func (c *MSManager) serveMetrics(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.Handle(defaultMetricsPath, c.metrics.handler())
+	srv := &http.Server{
+		Addr:    c.options.metricsListen,
+		Handler: mux,
+	}
+	go func() {
+		<-ctx.Done()
+		cctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+		_ = srv.Shutdown(cctx)
+		cancel()
+	}()
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
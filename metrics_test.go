@@ -0,0 +1,79 @@
+package micro
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/whatisfaker/micro/grpcpool"
+	"google.golang.org/grpc"
+)
+
+//gatherPool 收集连接池的指标(name -> target -> value)
+func gatherPool(t *testing.T, c *poolCollector) map[string]map[string]float64 {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]map[string]float64{}
+	for _, mf := range mfs {
+		values[mf.GetName()] = map[string]float64{}
+		for _, m := range mf.GetMetric() {
+			v := m.GetCounter().GetValue()
+			if m.GetGauge() != nil {
+				v = m.GetGauge().GetValue()
+			}
+			values[mf.GetName()][m.GetLabel()[0].GetValue()] = v
+		}
+	}
+	return values
+}
+
+func TestPoolCollector(t *testing.T) {
+	c := &poolCollector{pools: make(map[string]*grpcpool.Pool)}
+	opt := grpcpool.Option{MaxCap: 2, TTL: time.Minute, IdleTime: time.Minute}
+	//没有transport security时新建连接失败
+	failing := grpcpool.NewPool("passthrough:///a", opt)
+	c.add("a", failing)
+	if _, err := failing.Get(); err == nil {
+		t.Fatal("dial without credentials succeeded")
+	}
+	pool := grpcpool.NewPool("passthrough:///b", opt, grpc.WithInsecure())
+	c.add("b", pool)
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(conn)
+	if conn, err = pool.Get(); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	values := gatherPool(t, c)
+	want := map[string]map[string]float64{
+		"micro_grpcpool_dial_errors_total":     {"a": 1, "b": 0},
+		"micro_grpcpool_gets_total":            {"a": 1, "b": 2},
+		"micro_grpcpool_hits_total":            {"a": 0, "b": 1},
+		"micro_grpcpool_new_connections_total": {"a": 0, "b": 1},
+		"micro_grpcpool_idle_connections":      {"a": 0, "b": 0},
+	}
+	for name, targets := range want {
+		for target, v := range targets {
+			if got, ok := values[name][target]; !ok || got != v {
+				t.Fatalf("%s{target=%s} = %v, want %v", name, target, got, v)
+			}
+		}
+	}
+	//关闭的连接池注销
+	failing.Close()
+	values = gatherPool(t, c)
+	if _, ok := values["micro_grpcpool_gets_total"]["a"]; ok {
+		t.Fatal("closed pool still collected")
+	}
+	if _, ok := values["micro_grpcpool_gets_total"]["b"]; !ok {
+		t.Fatal("open pool not collected")
+	}
+}
@@ -15,12 +15,9 @@ import (
 
 	"github.com/google/uuid"
 	nacosgrpc "github.com/magicdvd/nacos-grpc"
-	otgrpc "github.com/opentracing-contrib/go-grpc"
 	"github.com/opentracing/opentracing-go"
-	"github.com/opentracing/opentracing-go/ext"
 	"github.com/whatisfaker/micro/grpcpool"
 	"github.com/whatisfaker/zaptrace/log"
-	"github.com/whatisfaker/zaptrace/tracing"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
@@ -32,29 +29,44 @@ const (
 	EnvLogLevel       = "LOG_LEVEL"
 	EnvApplicationID  = "MS_APPLICATION_ID"
 	EnvNacosConfigKey = "NACOS_CONFIG_KEY"
+	EnvTracing        = "MS_TRACING" //jaeger, otel
 )
 
 const (
 	MSGroupTCPServer = "TCP_SERVER"
 	MSGroupGRPC      = "GRPC"
 	MSGroupWeb       = "DEFAULT_GROUP"
+	MSGroupConsumer  = "CONSUMER"
 )
 
 var ErrNoNacosAddr = errors.New("no addr option setting(ENV:NACOS_ADDR)")
 var ErrNoFileConfigPathSet = errors.New("empty config path option setting(ENV:CONFIG_PATH)")
 var ErrNoConfigKey = errors.New("no config key")
+var ErrNilListenFunc = errors.New("nil listen func")
 
 type MSManager struct {
-	options      *options
-	audit        *audit
-	svcCenter    ServiceCenter
-	confCenter   ConfigCenter
-	svcs         []MicroService
-	log          *log.Factory
-	mysqlTracer  opentracing.Tracer
-	redisTracer  opentracing.Tracer
-	mongoTracer  opentracing.Tracer
-	influxTracer opentracing.Tracer
+	options    *options
+	audit      *Auditor
+	auditMu    sync.Mutex
+	auditors   []*Auditor
+	svcCenter  ServiceCenter
+	confCenter ConfigCenter
+	svcs       []MicroService
+	log        *log.Factory
+	logs       *logLevels
+	states     *serviceStates
+	health     *health
+	depsMu     sync.Mutex
+	deps       []*Deps
+	depTracers sync.Map
+	resilience *resilience
+	metrics    *metrics
+	tracers    *tracers
+}
+
+//managed 需要管理器注入运行时依赖的服务
+type managed interface {
+	attach(*MSManager)
 }
 
 var gMSManager *MSManager
@@ -67,108 +79,144 @@ func Manager() *MSManager {
 	return gMSManager
 }
 
-//NewMSManager 创建配置管理器
+//InitMSManager 初始化全局的微服务管理器(Manager()获取)
 func InitMSManager(opts ...Option) error {
 	var err error
 	once.Do(func() {
-		lv := os.Getenv(EnvLogLevel)
-		if lv == "" {
-			lv = "info"
-		}
-		options := &options{
-			confPath:  defaultConfPath,
-			ccType:    ccTypeFile,
-			scType:    scTypeNoop,
-			namespace: "public",
-			configKey: "go_config",
-			logLevel:  lv,
-			logger:    log.NewStdLogger(lv),
-		}
-		appID := os.Getenv(EnvApplicationID)
-		if appID != "" {
-			options.applicationID = appID
-		} else {
-			uuidObj, _ := uuid.NewRandom()
-			options.applicationID = uuidObj.String()
-		}
-		addr := os.Getenv(EnvNacosAddr)
-		if addr != "" {
-			options.scType = scTypeNacos
-			options.ccType = ccTypeNacos
-			options.addr = addr
+		gMSManager, err = NewMSManager(opts...)
+	})
+	return err
+}
+
+//NewMSManager 创建独立的微服务管理器(不设置全局单例, 例如测试使用)
+func NewMSManager(opts ...Option) (*MSManager, error) {
+	var err error
+	lv := os.Getenv(EnvLogLevel)
+	if lv == "" {
+		lv = "info"
+	}
+	options := &options{
+		confPath:       defaultConfPath,
+		ccType:         ccTypeFile,
+		scType:         scTypeNoop,
+		namespace:      "public",
+		configKey:      "go_config",
+		logLevel:       lv,
+		logger:         log.NewStdLogger(lv),
+		listen:         net.Listen,
+		tracing:        TracingJaeger,
+		healthInterval: defaultHealthInterval,
+		healthGrace:    defaultHealthGrace,
+		depReloadGrace: defaultDepReloadGrace,
+		depInit:        newDepInit(),
+	}
+	appID := os.Getenv(EnvApplicationID)
+	if appID != "" {
+		options.applicationID = appID
+	} else {
+		uuidObj, _ := uuid.NewRandom()
+		options.applicationID = uuidObj.String()
+	}
+	addr := os.Getenv(EnvNacosAddr)
+	if addr != "" {
+		options.scType = scTypeNacos
+		options.ccType = ccTypeNacos
+		options.addr = addr
+	}
+	if backend := os.Getenv(EnvTracing); backend != "" {
+		options.tracing = backend
+	}
+	configKey := os.Getenv(EnvNacosConfigKey)
+	if configKey != "" {
+		options.configKey = configKey
+	}
+	//如果配置了文件路径，使用配置的文件配置中心
+	fp := os.Getenv(EnvConfFilePath)
+	if fp != "" {
+		options.ccType = ccTypeFile
+		options.confPath = fp
+	}
+	for _, v := range opts {
+		v.apply(options)
+	}
+	if options.listen == nil {
+		err = ErrNilListenFunc
+		options.logger.Normal().Error("micro service manager initilize", zap.Error(err))
+		return nil, err
+	}
+	options.logger.SetLevel(options.logLevel)
+	logs := newLogLevels(options.logger)
+	var svcCenter ServiceCenter
+	var confCenter ConfigCenter
+	switch options.scType {
+	case scTypeNacos:
+		if len(options.addr) == 0 {
+			err = ErrNoNacosAddr
+			options.logger.Normal().Error("micro service manager initilize", zap.Error(err))
+			return nil, err
 		}
-		configKey := os.Getenv(EnvNacosConfigKey)
-		if configKey != "" {
-			options.configKey = configKey
+		svcCenter, err = newNacosSC(options.addr, options.namespace, logs.with(LogNacos, zap.String("srv", "nacos")))
+		if err != nil {
+			options.logger.Normal().Error("micro service manager initilize", zap.Error(err))
+			return nil, err
 		}
-		//如果配置了文件路径，使用配置的文件配置中心
-		fp := os.Getenv(EnvConfFilePath)
-		if fp != "" {
-			options.ccType = ccTypeFile
-			options.confPath = fp
+	case scTypeNoop:
+		svcCenter = newNoopSC(logs.with(LogRegistry, zap.String("srv", "noop")))
+	default:
+		svcCenter = newNoopSC(logs.with(LogRegistry, zap.String("srv", "noop")))
+	}
+
+	switch options.ccType {
+	case ccTypeNacos:
+		if len(options.addr) == 0 {
+			err = ErrNoNacosAddr
+			options.logger.Normal().Error("micro service manager initilize", zap.Error(err))
+			return nil, err
 		}
-		for _, v := range opts {
-			v.apply(options)
+		if options.configKey == "" {
+			err = ErrNoConfigKey
+			options.logger.Normal().Error("micro service manager initilize", zap.Error(err))
+			return nil, err
 		}
-		options.logger.SetLevel(options.logLevel)
-		var svcCenter ServiceCenter
-		var confCenter ConfigCenter
-		switch options.scType {
-		case scTypeNacos:
-			if len(options.addr) == 0 {
-				err = ErrNoNacosAddr
-				options.logger.Normal().Error("micro service manager initilize", zap.Error(err))
-				return
-			}
-			svcCenter, err = newNacosSC(options.addr, options.namespace, options.logger.With(zap.String("srv", "nacos")))
-			if err != nil {
-				options.logger.Normal().Error("micro service manager initilize", zap.Error(err))
-				return
-			}
-		case scTypeNoop:
-			svcCenter = newNoopSC(options.logger.With(zap.String("srv", "noop")))
-		default:
-			svcCenter = newNoopSC(options.logger.With(zap.String("srv", "noop")))
+		confCenter, err = newNacosCC(options.addr, options.namespace, options.configKey, logs.with(LogNacos, zap.String("conf", "nacos")))
+		if err != nil {
+			options.logger.Normal().Error("micro service manager initilize", zap.Error(err))
+			return nil, err
 		}
-
-		switch options.ccType {
-		case ccTypeNacos:
-			if len(options.addr) == 0 {
-				err = ErrNoNacosAddr
-				options.logger.Normal().Error("micro service manager initilize", zap.Error(err))
-				return
-			}
-			if options.configKey == "" {
-				err = ErrNoConfigKey
-				options.logger.Normal().Error("micro service manager initilize", zap.Error(err))
-				return
-			}
-			confCenter, err = newNacosCC(options.addr, options.namespace, options.configKey, options.logger.With(zap.String("conf", "nacos")))
-			if err != nil {
-				options.logger.Normal().Error("micro service manager initilize", zap.Error(err))
-				return
-			}
-		case ccTypeFile:
-			if options.confPath == "" {
-				err = ErrNoFileConfigPathSet
-				return
-			}
-			confCenter = newFileCC(options.confPath, options.logger.With(zap.String("conf", "file")))
-		default:
-			confCenter = newFileCC(options.confPath, options.logger.With(zap.String("conf", "file")))
+	case ccTypeFile:
+		if options.confPath == "" {
+			err = ErrNoFileConfigPathSet
+			return nil, err
 		}
-		gMSManager = &MSManager{
-			options: options,
-			svcs:    make([]MicroService, 0),
-			log:     options.logger,
-			audit: &audit{
-				log: options.logger.With(zap.String("audit", "audit")),
-			},
-			svcCenter:  svcCenter,
-			confCenter: confCenter,
+		confCenter = newFileCC(options.confPath, logs.with(LogConf, zap.String("conf", "file")))
+	case ccTypeMemory:
+		confCenter, err = newMemoryCC(options.memConfig, logs.with(LogConf, zap.String("conf", "memory")))
+		if err != nil {
+			options.logger.Normal().Error("micro service manager initilize", zap.Error(err))
+			return nil, err
 		}
-	})
-	return err
+	default:
+		confCenter = newFileCC(options.confPath, logs.with(LogConf, zap.String("conf", "file")))
+	}
+	c := &MSManager{
+		options:    options,
+		svcs:       make([]MicroService, 0),
+		log:        options.logger,
+		logs:       logs,
+		states:     newServiceStates(),
+		health:     newHealth(),
+		audit:      newAuditor(logs.with(LogAudit, zap.String("audit", "audit")), options.auditOpts...),
+		svcCenter:  svcCenter,
+		confCenter: confCenter,
+		resilience: newResilience(options.resilienceCfg),
+		metrics:    newMetrics(),
+		tracers: &tracers{
+			otel:    options.tracing == TracingOTel,
+			sampler: newSampler(),
+		},
+	}
+	c.AddHealthCheck("services", c.checkServices)
+	return c, nil
 }
 
 //ApplicationID 获取应用的唯一ID
@@ -178,6 +226,11 @@ func (c *MSManager) ApplicationID() string {
 
 //Register 通用注册微服务（满足MicroService接口即可)
 func (c *MSManager) Register(svcs ...MicroService) {
+	for _, svc := range svcs {
+		if m, ok := svc.(managed); ok {
+			m.attach(c)
+		}
+	}
 	c.svcs = append(c.svcs, svcs...)
 }
 
@@ -195,13 +248,21 @@ func (c *MSManager) GlobalLogger() *log.Factory {
 	return c.log
 }
 
-//ParseConfig 解析配置文件获取对应的依赖客户端(*gorm.DB, mongo.Client, mqtt, redis等)
+//ParseConfig 解析配置文件获取对应的依赖客户端(*gorm.DB, mongo.Client, mqtt, redis等), 并发创建(DepInitTimeout, DepInitRetry), 错误包含每个失败的key
 func (c *MSManager) ParseConfig(v interface{}, structTag ...string) (*Deps, error) {
 	tag := "nacos"
 	if len(structTag) > 0 {
 		tag = structTag[0]
 	}
-	return newDeps(v, tag, c.log.With(zap.String("deps", "deps")))
+	d, err := newDeps(v, tag, c.logs.with(LogDeps, zap.String("deps", "deps")), c.depInstrument(), c.options.depInit)
+	if err != nil {
+		return nil, err
+	}
+	c.addDeps(d)
+	for key, check := range d.HealthChecks() {
+		c.AddHealthCheck("deps."+key, check)
+	}
+	return d, nil
 }
 
 func (c *MSManager) GetGRPCConn(name string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
@@ -211,22 +272,32 @@ func (c *MSManager) GetGRPCConn(name string, opts ...grpc.DialOption) (*grpc.Cli
 		return nil, err
 	}
 	target := nacosgrpc.Target(c.options.addr, name, nacosgrpc.OptionGroupName("GRPC"))
-	tracer := opentracing.GlobalTracer()
-	options := make([]grpc.DialOption, 0)
-	options = append(options, grpc.WithInsecure())
-	if _, ok := tracer.(opentracing.NoopTracer); ok {
-		options = append(options, opts...)
-	} else if _, ok := tracer.(*opentracing.NoopTracer); ok {
-		options = opts
-	} else {
-		options = append(options,
-			grpc.WithUnaryInterceptor(otgrpc.OpenTracingClientInterceptor(tracer)),
-			grpc.WithStreamInterceptor(otgrpc.OpenTracingStreamClientInterceptor(tracer)))
-		options = append(options, opts...)
-	}
+	options := c.clientDialOptions(c.options.resilience)
+	options = append(options, opts...)
 	return grpc.DialContext(context.TODO(), target, options...)
 }
 
+//clientDialOptions grpc客户端的通用拨号参数(追踪, 容错)
+func (c *MSManager) clientDialOptions(resilience bool) []grpc.DialOption {
+	unary := []grpc.UnaryClientInterceptor{requestIDUnaryClientInterceptor()}
+	stream := []grpc.StreamClientInterceptor{requestIDStreamClientInterceptor()}
+	if u, s := c.tracers.clientInterceptors(); u != nil {
+		unary = append(unary, u)
+		stream = append(stream, s)
+	}
+	unary = append(unary, c.metrics.unaryClientInterceptor())
+	stream = append(stream, c.metrics.streamClientInterceptor())
+	if resilience {
+		unary = append(unary, c.resilience.unaryClientInterceptor())
+		stream = append(stream, c.resilience.streamClientInterceptor())
+	}
+	return []grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithChainUnaryInterceptor(unary...),
+		grpc.WithChainStreamInterceptor(stream...),
+	}
+}
+
 //GetGRPCConnPool 根据服务名获取grpc的连接池
 func (c *MSManager) GetGRPCConnPool(name string, opts ...grpc.DialOption) (*grpcpool.Pool, error) {
 	if len(c.options.addr) == 0 {
@@ -240,23 +311,13 @@ func (c *MSManager) GetGRPCConnPool(name string, opts ...grpc.DialOption) (*grpc
 
 //GetGRPCConnPoolDirect 根据dial target直接获取连接池
 func (c *MSManager) GetGRPCConnPoolDirect(target string, opts ...grpc.DialOption) *grpcpool.Pool {
-	tracer := opentracing.GlobalTracer()
-	options := make([]grpc.DialOption, 0)
-	options = append(options, grpc.WithInsecure())
-	if _, ok := tracer.(opentracing.NoopTracer); ok {
-		options = append(options, opts...)
-	} else if _, ok := tracer.(*opentracing.NoopTracer); ok {
-		options = opts
-	} else {
-		options = append(options,
-			grpc.WithUnaryInterceptor(otgrpc.OpenTracingClientInterceptor(tracer)),
-			grpc.WithStreamInterceptor(otgrpc.OpenTracingStreamClientInterceptor(tracer)))
-		options = append(options, opts...)
-	}
+	options := c.clientDialOptions(false)
+	options = append(options, opts...)
 	grpcPool := grpcpool.NewPool(
 		target,
 		grpcpool.Option{MaxCap: 10, TTL: 10 * time.Minute, IdleTime: 5 * time.Minute},
 		options...)
+	c.metrics.pools.add(target, grpcPool)
 	return grpcPool
 }
 
@@ -267,62 +328,68 @@ func (c *MSManager) Run(ctx context.Context, name string) error {
 
 //RunWith 启动微服务伴随一些阻塞函数(mq consume, write gorutine)
 func (c *MSManager) RunWith(ctx context.Context, name string, fns ...func(context.Context) error) error {
+	//配置中心的日志级别
+	if err := c.ReloadLogLevel(ctx); err != nil {
+		c.log.Normal().Warn("load log level config", zap.Error(err))
+	}
 	//设置全局tracer
-	tracer, closer, err := tracing.NewTracer(name, c.log)
+	tracer, closer, err := c.newTracer(ctx, name)
 	if err != nil {
 		return err
 	}
 	defer closer.Close()
-	opentracing.SetGlobalTracer(tracer)
-	c.mysqlTracer = tracer
-	c.redisTracer = tracer
-	c.influxTracer = tracer
-	c.mongoTracer = tracer
-	if c.options.mysqlTracer {
-		tracer, closer, err := tracing.NewTracer("mysql", c.log)
-		if err != nil {
-			return err
-		}
-		defer closer.Close()
-		c.mysqlTracer = tracer
-	}
-	if c.options.mysqlTracer {
-		tracer, closer, err := tracing.NewTracer("redis", c.log)
-		if err != nil {
-			return err
-		}
-		defer closer.Close()
-		c.redisTracer = tracer
-	}
-	if c.options.mysqlTracer {
-		tracer, closer, err := tracing.NewTracer("mongo", c.log)
-		if err != nil {
-			return err
-		}
-		defer closer.Close()
-		c.mongoTracer = tracer
+	if !c.options.noGlobalTracer {
+		opentracing.SetGlobalTracer(tracer)
 	}
-	if c.options.mysqlTracer {
-		tracer, closer, err := tracing.NewTracer("influx", c.log)
-		if err != nil {
-			return err
-		}
-		defer closer.Close()
-		c.influxTracer = tracer
+	closeDepTracers, err := c.initDepTracers()
+	if err != nil {
+		return err
 	}
+	defer closeDepTracers()
+	//服务停止后关闭依赖(审计可能使用依赖, 先关闭审计)
+	defer c.closeDeps()
+	defer c.closeAuditors()
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	grp, ctx := errgroup.WithContext(ctx)
 	for i := range c.svcs {
 		svc := c.svcs[i]
 		grp.Go(func() error {
-			err := c.svcCenter.Register(ctx, svc)
+			c.states.setRegistry(svc, RegistryRegistering, nil)
+			var err error
+			heartbeat := false
+			if n, ok := c.svcCenter.(registerNotifier); ok {
+				//Register阻塞到服务退出, 注册成功时更新状态
+				err = n.registerWith(ctx, svc, &registerHooks{
+					registered: func() {
+						c.states.setRegistry(svc, RegistryRegistered, nil)
+					},
+					heartbeatFailed: func(error) {
+						heartbeat = true
+						c.metrics.heartbeatFailures.WithLabelValues(svc.Name(), svc.Group()).Inc()
+					},
+				})
+			} else {
+				err = c.svcCenter.Register(ctx, svc)
+				if err == nil {
+					c.states.setRegistry(svc, RegistryRegistered, nil)
+				}
+			}
+			if err != nil && err != context.Canceled {
+				if !heartbeat {
+					c.metrics.registerFailures.WithLabelValues(svc.Name(), svc.Group()).Inc()
+				}
+				c.states.setRegistry(svc, RegistryFailed, err)
+			}
 			// if err != nil {
 			// 	return err
 			// }
 			// <-ctx.Done()
 			// err = ctx.Err()
 			// if err != nil {
-			_ = c.svcCenter.Deregister(ctx, svc)
+			if err := c.svcCenter.Deregister(ctx, svc); err == nil && ctx.Err() != nil {
+				c.states.setRegistry(svc, RegistryDeregistered, nil)
+			}
 			//}
 			return err
 		})
@@ -332,10 +399,35 @@ func (c *MSManager) RunWith(ctx context.Context, name string, fns ...func(contex
 				defer close(ch)
 				ip, port := svc.Discovery()
 				c.log.Trace(ctx).Info("start service", zap.String("name", svc.Name()), zap.String("ip", ip), zap.Uint("port", port))
-				if err := svc.Start(ctx); err != nil {
+				//stopWatch 等待Started的通知结束(Start返回之后的状态不会被覆盖为running)
+				stopWatch := func() {}
+				if n, ok := svc.(StartNotifier); ok {
+					//开始接收请求后为running
+					c.states.setState(svc, ServiceStarting, nil)
+					exited, watched := make(chan struct{}), make(chan struct{})
+					go func() {
+						defer close(watched)
+						select {
+						case <-n.Started():
+							c.states.setState(svc, ServiceRunning, nil)
+						case <-exited:
+						}
+					}()
+					stopWatch = func() {
+						close(exited)
+						<-watched
+					}
+				} else {
+					c.states.setState(svc, ServiceRunning, nil)
+				}
+				err := svc.Start(ctx)
+				stopWatch()
+				if err != nil {
+					c.states.setState(svc, ServiceFailed, err)
 					ch <- err
 					return
 				}
+				c.states.setState(svc, ServiceStopped, nil)
 				ch <- nil
 			}()
 			select {
@@ -345,6 +437,7 @@ func (c *MSManager) RunWith(ctx context.Context, name string, fns ...func(contex
 				cctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
 				svc.Shutdown(cctx)
 				cancel()
+				c.states.setState(svc, ServiceStopped, nil)
 				return ctx.Err()
 			}
 		})
@@ -357,17 +450,45 @@ func (c *MSManager) RunWith(ctx context.Context, name string, fns ...func(contex
 			return fn(ctx)
 		})
 	}
+	if c.options.metricsListen != "" {
+		grp.Go(func() error {
+			return c.serveMetrics(ctx)
+		})
+	}
+	if c.options.adminListen != "" {
+		grp.Go(func() error {
+			return c.serveAdmin(ctx)
+		})
+	}
+	if c.options.healthInterval > 0 {
+		grp.Go(func() error {
+			return c.watchHealth(ctx, c.options.healthInterval, c.options.healthGrace)
+		})
+	} else {
+		c.health.update(true)
+	}
 	grp.Go(func() error {
-		signals := make(chan os.Signal, 1)
-		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
-		select {
-		case <-signals:
-			cancel()
-		case <-ctx.Done():
-			return ctx.Err()
-		}
-		return nil
+		return c.superviseDeps(ctx)
 	})
+	if c.options.watchInterval > 0 {
+		grp.Go(func() error {
+			return c.watchConfig(ctx, c.options.watchInterval)
+		})
+	}
+	if !c.options.noSignal {
+		grp.Go(func() error {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			defer signal.Stop(signals)
+			select {
+			case <-signals:
+				cancel()
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			return nil
+		})
+	}
 	err = grp.Wait()
 	//if errors.Is(err, context.Canceled) {
 	if err != nil && err != context.Canceled {
@@ -378,19 +499,19 @@ func (c *MSManager) RunWith(ctx context.Context, name string, fns ...func(contex
 }
 
 func (c *MSManager) MySQLStartSpan(ctx context.Context, opName string, tags ...map[string]string) (context.Context, opentracing.Span) {
-	return tracing.QuickStartSpanWithTracer(ctx, c.mysqlTracer, opName, ext.SpanKindRPCClient, tags...)
+	return c.DepStartSpan(ctx, DepMySQL, opName, tags...)
 }
 
 func (c *MSManager) RedisStartSpan(ctx context.Context, opName string, tags ...map[string]string) (context.Context, opentracing.Span) {
-	return tracing.QuickStartSpanWithTracer(ctx, c.redisTracer, opName, ext.SpanKindRPCClient, tags...)
+	return c.DepStartSpan(ctx, DepRedis, opName, tags...)
 }
 
 func (c *MSManager) MongoStartSpan(ctx context.Context, opName string, tags ...map[string]string) (context.Context, opentracing.Span) {
-	return tracing.QuickStartSpanWithTracer(ctx, c.mongoTracer, opName, ext.SpanKindRPCClient, tags...)
+	return c.DepStartSpan(ctx, DepMongo, opName, tags...)
 }
 
 func (c *MSManager) InfluxStartSpan(ctx context.Context, opName string, tags ...map[string]string) (context.Context, opentracing.Span) {
-	return tracing.QuickStartSpanWithTracer(ctx, c.influxTracer, opName, ext.SpanKindRPCClient, tags...)
+	return c.DepStartSpan(ctx, DepInflux, opName, tags...)
 }
 
 func getOutboundIP() (string, error) {
@@ -0,0 +1,75 @@
+package micro
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewMSManagerNilListen(t *testing.T) {
+	_, err := NewMSManager(NoopServiceCenter(), MemoryConfigCenter(nil), LogLevel("error"), ListenFunc(nil))
+	if !errors.Is(err, ErrNilListenFunc) {
+		t.Fatalf("got %v, want ErrNilListenFunc", err)
+	}
+}
+
+//startService 测试StartNotifier的服务, Start等待到fail(返回错误)或者ctx结束
+type startService struct {
+	*startSignal
+	listen chan struct{}
+	fail   chan error
+}
+
+func (c *startService) Name() string                     { return "svc" }
+func (c *startService) Discovery() (string, uint)        { return "127.0.0.1", 1 }
+func (c *startService) Group() string                    { return MSGroupTCPServer }
+func (c *startService) Metadata() map[string]interface{} { return nil }
+func (c *startService) Weight() uint32                   { return defaultMSWeight }
+func (c *startService) Shutdown(context.Context)         {}
+
+func (c *startService) Start(ctx context.Context) error {
+	<-c.listen
+	c.markStarted()
+	select {
+	case err := <-c.fail:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+func TestRunWithStartNotifier(t *testing.T) {
+	m, err := NewMSManager(NoopServiceCenter(), MemoryConfigCenter(nil), LogLevel("error"), NoGlobalTracer(), NoSignalHandler(), HealthInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := &startService{startSignal: newStartSignal(), listen: make(chan struct{}), fail: make(chan error, 1)}
+	m.Register(svc)
+	done := make(chan error, 1)
+	go func() {
+		done <- m.RunWith(context.Background(), "test")
+	}()
+	waitState := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if s := m.Services(); len(s) == 1 && s[0].State == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("service is not %s: %+v", want, m.Services()[0])
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	//Started关闭之前为starting
+	waitState(ServiceStarting)
+	close(svc.listen)
+	waitState(ServiceRunning)
+	svc.fail <- errors.New("serve failed")
+	if err := <-done; err == nil {
+		t.Fatal("RunWith returned nil after service failed")
+	}
+	waitState(ServiceFailed)
+}
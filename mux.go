@@ -0,0 +1,228 @@
+package micro
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/soheilhy/cmux"
+	"github.com/whatisfaker/ms"
+	"github.com/whatisfaker/zaptrace/log"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
+)
+
+const (
+	metadataProtocols = "protocols"
+)
+
+//TCPPreambler codec实现时, 单端口服务(RegisterMux)没有ParamTCPPreamble时使用Preambles返回的消息开头识别tcp连接
+type TCPPreambler interface {
+	Preambles() [][]byte
+}
+
+//msMux 单端口同时提供gin, grpc(h2c)和tcp服务, 按协议嗅探分发
+type msMux struct {
+	*startSignal
+	params      *paramMap
+	listen      string
+	discoveryIP string
+	port        uint
+	name        string
+	log         *log.Factory
+	gin         *msGin
+	grpc        *msGRPC
+	tcp         *msTCP
+	mux         cmux.CMux
+	limit       *limiter
+	netListen   func(string, string) (net.Listener, error)
+}
+
+var _ MicroService = (*msMux)(nil)
+
+func newMuxMicroService(name string, listen string, ginInit func(context.Context, *gin.Engine), grpcInit func(context.Context, *grpc.Server), tcpInit func(context.Context, *ms.Server), log *log.Factory, params ...Param) (*msMux, error) {
+	p := &paramMap{
+		metadata: map[string]interface{}{},
+		weight:   defaultMSWeight,
+	}
+	for _, v := range params {
+		v.apply(p)
+	}
+	c := &msMux{
+		startSignal: newStartSignal(),
+		params:      p,
+		name:        name,
+		listen:      listen,
+		log:         log,
+		limit:       newLimiter(p.limit),
+		netListen:   net.Listen,
+	}
+	var err error
+	c.discoveryIP, c.port, err = split2ipport(listen, p.discoveryIP)
+	if err != nil {
+		return nil, err
+	}
+	protocols := make([]string, 0)
+	if grpcInit != nil {
+		c.grpc, err = newGRPCMicroService(name, listen, grpcInit, log.With(zap.String("mux", "grpc")), params...)
+		if err != nil {
+			return nil, err
+		}
+		c.grpc.limit = c.limit
+		protocols = append(protocols, "grpc")
+	}
+	if ginInit != nil {
+		c.gin, err = newGinMicroService(name, listen, ginInit, log.With(zap.String("mux", "gin")), params...)
+		if err != nil {
+			return nil, err
+		}
+		c.gin.limit = c.limit
+		protocols = append(protocols, "http")
+	}
+	if tcpInit != nil {
+		c.tcp, err = newTCPMicroService(name, listen, tcpInit, log.With(zap.String("mux", "tcp")), params...)
+		if err != nil {
+			return nil, err
+		}
+		c.tcp.limit = c.limit
+		protocols = append(protocols, "tcp")
+	}
+	metadata := map[string]interface{}{
+		metadataProtocols: strings.Join(protocols, ","),
+	}
+	for k, v := range p.metadata {
+		metadata[k] = v
+	}
+	p.metadata = metadata
+	return c, nil
+}
+
+func (c *msMux) Start(ctx context.Context) error {
+	l, err := c.netListen("tcp", c.listen)
+	if err != nil {
+		return err
+	}
+	c.markStarted()
+	c.mux = cmux.New(l)
+	grp, ctx := errgroup.WithContext(ctx)
+	//匹配顺序: grpc(h2c) -> http/1 -> tcp(codec的消息开头, 没有时为其余的所有连接), 都不匹配的连接关闭
+	if c.grpc != nil {
+		grpcL := c.mux.MatchWithWriters(cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"))
+		grp.Go(func() error {
+			return c.grpc.serve(ctx, grpcL)
+		})
+	}
+	if c.gin != nil {
+		httpL := c.mux.Match(cmux.HTTP1Fast())
+		grp.Go(func() error {
+			return c.gin.serve(ctx, httpL)
+		})
+	}
+	if c.tcp != nil {
+		matcher := cmux.Any()
+		if preambles := c.tcpPreambles(); len(preambles) > 0 {
+			prefixes := make([]string, len(preambles))
+			for i, v := range preambles {
+				prefixes[i] = string(v)
+			}
+			matcher = cmux.PrefixMatcher(prefixes...)
+		}
+		tcpL := c.mux.Match(matcher)
+		grp.Go(func() error {
+			return c.tcp.serve(ctx, tcpL)
+		})
+	}
+	grp.Go(func() error {
+		err := c.mux.Serve()
+		if errors.Is(err, net.ErrClosed) || errors.Is(err, cmux.ErrListenerClosed) || errors.Is(err, cmux.ErrServerClosed) {
+			return nil
+		}
+		return err
+	})
+	return grp.Wait()
+}
+
+//tcpPreambles tcp连接的消息开头, ParamTCPPreamble优先, 其次是codec(实现TCPPreambler)
+func (c *msMux) tcpPreambles() [][]byte {
+	if len(c.params.tcpPreambles) > 0 {
+		return c.params.tcpPreambles
+	}
+	if v, ok := c.params.tcpCodec.(TCPPreambler); ok {
+		return v.Preambles()
+	}
+	return nil
+}
+
+func (c *msMux) Name() string {
+	return c.name
+}
+
+func (c *msMux) Discovery() (string, uint) {
+	return c.discoveryIP, c.port
+}
+
+func (c *msMux) Weight() uint32 {
+	return c.params.weight
+}
+
+//Group 包含grpc时注册在grpc分组(GetGRPCConn可发现), 包含gin时为web分组, 只有tcp时为tcp分组, 具体协议见元数据protocols
+func (c *msMux) Group() string {
+	switch {
+	case c.grpc != nil:
+		return MSGroupGRPC
+	case c.gin != nil:
+		return MSGroupWeb
+	}
+	return MSGroupTCPServer
+}
+
+func (c *msMux) Metadata() map[string]interface{} {
+	return c.params.metadata
+}
+
+func (c *msMux) Shutdown(ctx context.Context) {
+	if c.gin != nil {
+		c.gin.Shutdown(ctx)
+	}
+	if c.grpc != nil {
+		c.grpc.Shutdown(ctx)
+	}
+	if c.tcp != nil {
+		c.tcp.Shutdown(ctx)
+	}
+	if c.mux != nil {
+		c.mux.Close()
+	}
+}
+
+func (c *msMux) attach(m *MSManager) {
+	c.netListen = m.options.listen
+	if c.gin != nil {
+		c.gin.attach(m)
+	}
+	if c.grpc != nil {
+		c.grpc.attach(m)
+	}
+	if c.tcp != nil {
+		c.tcp.attach(m)
+	}
+}
+
+//limiters 所有协议共用一个限流(同一个端口)
+func (c *msMux) limiters() []*limiter {
+	return []*limiter{c.limit}
+}
+
+//RegisterMux 注册单端口的微服务, 按协议嗅探分发到gin, grpc和tcp(不需要的传nil), 只注册一个实例
+func (c *MSManager) RegisterMux(name string, listen string, ginInit func(context.Context, *gin.Engine), grpcInit func(context.Context, *grpc.Server), tcpInit func(context.Context, *ms.Server), params ...Param) error {
+	svc, err := newMuxMicroService(name, listen, ginInit, grpcInit, tcpInit, c.log.With(zap.String("srv_mux", name)), params...)
+	if err != nil {
+		c.log.Normal().Error("register mux", zap.Error(err), zap.String("name", name), zap.String("listen", listen))
+		return err
+	}
+	c.Register(svc)
+	return nil
+}
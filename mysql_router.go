@@ -0,0 +1,399 @@
+package micro
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/whatisfaker/conf"
+	"github.com/whatisfaker/gormzap"
+	"github.com/whatisfaker/zaptrace/log"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+const (
+	//defaultReplicaCheckInterval 默认的从库检查间隔
+	defaultReplicaCheckInterval = 5 * time.Second
+)
+
+var ErrReplicationStopped = errors.New("replication stopped")
+
+//MySQLClusterConfig mysql主从配置, ParseConfig创建读写分离的*gorm.DB(GetMySQL)
+type MySQLClusterConfig struct {
+	//Primary 主库, 写和事务使用
+	Primary conf.MysqlConfig `yaml:"primary"`
+	//Replicas 从库, 读使用
+	Replicas []MySQLReplicaConfig `yaml:"replicas"`
+	//MaxLag 从库的最大延迟(Seconds_Behind_Master), 超过时不读, 0不检查延迟
+	MaxLag time.Duration `yaml:"max_lag"`
+	//CheckInterval 从库的检查间隔(默认5s)
+	CheckInterval time.Duration `yaml:"check_interval"`
+}
+
+//MySQLReplicaConfig 从库配置
+type MySQLReplicaConfig struct {
+	conf.MysqlConfig `yaml:",inline"`
+	//Weight 权重(默认1)
+	Weight int `yaml:"weight"`
+}
+
+//MySQLReplicaStatus 从库的状态
+type MySQLReplicaStatus struct {
+	Name    string `json:"name"`
+	Weight  int    `json:"weight"`
+	Healthy bool   `json:"healthy"`
+	Lag     string `json:"lag"`
+	Error   string `json:"error,omitempty"`
+}
+
+type mysqlReplica struct {
+	name    string
+	db      *sql.DB
+	weight  int
+	mu      sync.RWMutex
+	healthy bool
+	lag     time.Duration
+	err     error
+}
+
+//MySQLRouter mysql读写分离: 写和事务使用主库, 读使用健康的从库(按权重), 没有健康的从库时使用主库
+//路由的*gorm.DB(DB())没有*sql.DB, 调用DB().DB()会panic, 连接池使用Primary().DB()和Replicas()
+type MySQLRouter struct {
+	db       *gorm.DB
+	primary  *gorm.DB
+	replicas []*mysqlReplica
+	maxLag   time.Duration
+	log      *log.Factory
+	done     chan struct{}
+	once     sync.Once
+	err      error
+}
+
+//newMySQLRouter 创建主库, 从库和路由的*gorm.DB
+func newMySQLRouter(ctx context.Context, key string, cfg *MySQLClusterConfig, log *log.Factory, inst *depInstrument) (*MySQLRouter, error) {
+	primary, err := conf.MySQLClient(&cfg.Primary)
+	if err != nil {
+		return nil, err
+	}
+	primary.SetLogger(gormzap.New(log.ZapLogger))
+	inst.gorm(key, primary)
+	r := &MySQLRouter{
+		primary: primary,
+		maxLag:  cfg.MaxLag,
+		log:     log,
+		done:    make(chan struct{}),
+	}
+	for i := range cfg.Replicas {
+		rc := &cfg.Replicas[i]
+		db, err := conf.MySQLClient(&rc.MysqlConfig)
+		if err != nil {
+			_ = r.Close()
+			return nil, err
+		}
+		name := rc.Addr
+		if name == "" {
+			name = "replica[" + strconv.Itoa(i) + "]"
+		}
+		weight := rc.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		r.replicas = append(r.replicas, &mysqlReplica{name: name, db: db.DB(), weight: weight})
+	}
+	if err := r.open(ctx, key, cfg, inst); err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+//open 创建路由的*gorm.DB, 检查一次从库后定时检查
+func (c *MySQLRouter) open(ctx context.Context, key string, cfg *MySQLClusterConfig, inst *depInstrument) error {
+	var err error
+	c.db, err = gorm.Open("mysql", &mysqlConn{router: c})
+	if err != nil {
+		return err
+	}
+	c.db.LogMode(cfg.Primary.DebugSQL)
+	c.db.SingularTable(true)
+	c.db.SetLogger(gormzap.New(c.log.ZapLogger))
+	inst.gorm(key, c.db)
+	//写之后同一个请求的读使用主库(WithMySQLSticky)
+	cb := c.db.Callback()
+	cb.Create().After("gorm:create").Register("micro:sticky_create", markMySQLWrite)
+	cb.Update().After("gorm:update").Register("micro:sticky_update", markMySQLWrite)
+	cb.Delete().After("gorm:delete").Register("micro:sticky_delete", markMySQLWrite)
+	c.check(ctx)
+	interval := cfg.CheckInterval
+	if interval <= 0 {
+		interval = defaultReplicaCheckInterval
+	}
+	if len(c.replicas) > 0 {
+		go c.watch(interval)
+	}
+	return nil
+}
+
+//DB 读写分离的*gorm.DB(GetMySQL返回), 不能调用它的DB()(panic)
+func (c *MySQLRouter) DB() *gorm.DB {
+	return c.db
+}
+
+//Primary 主库, Primary().DB()为主库的连接池
+func (c *MySQLRouter) Primary() *gorm.DB {
+	return c.primary
+}
+
+//Replicas 从库的连接池(配置顺序), 用于设置连接数等
+func (c *MySQLRouter) Replicas() []*sql.DB {
+	v := make([]*sql.DB, len(c.replicas))
+	for i, rep := range c.replicas {
+		v[i] = rep.db
+	}
+	return v
+}
+
+//Context 绑定请求context的*gorm.DB, 请求中已经写过(WithMySQLSticky)或者强制主库(WithMySQLPrimary)时使用主库
+func (c *MySQLRouter) Context(ctx context.Context) *gorm.DB {
+	if mysqlSticky(ctx) {
+		return MySQLWithContext(ctx, c.primary)
+	}
+	return MySQLWithContext(ctx, c.db)
+}
+
+//Lag 检查从库的状态和延迟
+func (c *MySQLRouter) Lag(ctx context.Context) []*MySQLReplicaStatus {
+	c.check(ctx)
+	v := make([]*MySQLReplicaStatus, len(c.replicas))
+	for i, rep := range c.replicas {
+		rep.mu.RLock()
+		v[i] = &MySQLReplicaStatus{
+			Name:    rep.name,
+			Weight:  rep.weight,
+			Healthy: rep.healthy,
+			Lag:     rep.lag.String(),
+			Error:   errString(rep.err),
+		}
+		rep.mu.RUnlock()
+	}
+	return v
+}
+
+//Close 关闭主库和从库
+func (c *MySQLRouter) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.err = c.primary.Close()
+		for _, rep := range c.replicas {
+			c.err = multierr.Append(c.err, rep.db.Close())
+		}
+	})
+	return c.err
+}
+
+func (c *MySQLRouter) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.TODO(), interval)
+			c.check(ctx)
+			cancel()
+		}
+	}
+}
+
+//check 检查从库的连接和延迟
+func (c *MySQLRouter) check(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, rep := range c.replicas {
+		wg.Add(1)
+		go func(rep *mysqlReplica) {
+			defer wg.Done()
+			var lag time.Duration
+			err := rep.db.PingContext(ctx)
+			if err == nil && c.maxLag > 0 {
+				lag, err = replicaLag(ctx, rep.db)
+				if err == nil && lag > c.maxLag {
+					err = errors.New("replica lag " + lag.String() + " exceeds " + c.maxLag.String())
+				}
+			}
+			rep.mu.Lock()
+			changed := rep.healthy != (err == nil)
+			rep.healthy = err == nil
+			rep.lag = lag
+			rep.err = err
+			rep.mu.Unlock()
+			if changed && err != nil {
+				c.log.Normal().Warn("mysql replica unhealthy", zap.String("replica", rep.name), zap.Error(err))
+			} else if changed {
+				c.log.Normal().Info("mysql replica healthy", zap.String("replica", rep.name))
+			}
+		}(rep)
+	}
+	wg.Wait()
+}
+
+//replicaLag 从库的延迟(SHOW SLAVE STATUS的Seconds_Behind_Master)
+func replicaLag(ctx context.Context, db *sql.DB) (time.Duration, error) {
+	rows, err := db.QueryContext(ctx, "SHOW SLAVE STATUS")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, ErrReplicationStopped
+	}
+	vals := make([]sql.RawBytes, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		return 0, err
+	}
+	for i, col := range cols {
+		if col != "Seconds_Behind_Master" && col != "Seconds_Behind_Source" {
+			continue
+		}
+		if vals[i] == nil {
+			return 0, ErrReplicationStopped
+		}
+		n, err := strconv.Atoi(string(vals[i]))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * time.Second, nil
+	}
+	return 0, ErrReplicationStopped
+}
+
+//replica 按权重选择健康的从库, 没有时返回nil
+func (c *MySQLRouter) replica() *sql.DB {
+	total := 0
+	healthy := make([]*mysqlReplica, 0, len(c.replicas))
+	for _, rep := range c.replicas {
+		rep.mu.RLock()
+		if rep.healthy {
+			healthy = append(healthy, rep)
+			total += rep.weight
+		}
+		rep.mu.RUnlock()
+	}
+	if total == 0 {
+		return nil
+	}
+	n := rand.Intn(total)
+	for _, rep := range healthy {
+		if n < rep.weight {
+			return rep.db
+		}
+		n -= rep.weight
+	}
+	return nil
+}
+
+//mysqlPool gorm.DB的连接池, 读写分离的*gorm.DB返回主库(它的DB()会panic), 事务返回nil
+func mysqlPool(db *gorm.DB) *sql.DB {
+	switch v := db.CommonDB().(type) {
+	case *sql.DB:
+		return v
+	case *mysqlConn:
+		return v.router.primary.DB()
+	}
+	return nil
+}
+
+//mysqlConn 路由的连接(gorm.SQLCommon): Exec, Prepare和事务使用主库, Query使用从库
+type mysqlConn struct {
+	router *MySQLRouter
+}
+
+func (c *mysqlConn) reader() gorm.SQLCommon {
+	if db := c.router.replica(); db != nil {
+		return db
+	}
+	return c.router.primary.DB()
+}
+
+func (c *mysqlConn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.router.primary.DB().Exec(query, args...)
+}
+
+func (c *mysqlConn) Prepare(query string) (*sql.Stmt, error) {
+	return c.router.primary.DB().Prepare(query)
+}
+
+func (c *mysqlConn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.reader().Query(query, args...)
+}
+
+func (c *mysqlConn) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.reader().QueryRow(query, args...)
+}
+
+func (c *mysqlConn) Begin() (*sql.Tx, error) {
+	return c.router.primary.DB().Begin()
+}
+
+func (c *mysqlConn) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return c.router.primary.DB().BeginTx(ctx, opts)
+}
+
+//Close 关闭路由的*gorm.DB时关闭主库和从库
+func (c *mysqlConn) Close() error {
+	return c.router.Close()
+}
+
+type mysqlStickyKey struct{}
+
+//WithMySQLSticky 请求context中写(create, update, delete)之后的读使用主库(读写分离的GetMySQLContext), 在请求开始时调用
+func WithMySQLSticky(ctx context.Context) context.Context {
+	return context.WithValue(ctx, mysqlStickyKey{}, new(int32))
+}
+
+//WithMySQLPrimary 请求context中的读写都使用主库
+func WithMySQLPrimary(ctx context.Context) context.Context {
+	v := int32(1)
+	return context.WithValue(ctx, mysqlStickyKey{}, &v)
+}
+
+func mysqlSticky(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	v, ok := ctx.Value(mysqlStickyKey{}).(*int32)
+	return ok && atomic.LoadInt32(v) == 1
+}
+
+//markMySQLWrite gorm回调, 标记请求context已经写过
+func markMySQLWrite(scope *gorm.Scope) {
+	v, ok := scope.Get(gormContextKey)
+	if !ok {
+		return
+	}
+	ctx, ok := v.(context.Context)
+	if !ok || ctx == nil {
+		return
+	}
+	if sticky, ok := ctx.Value(mysqlStickyKey{}).(*int32); ok {
+		atomic.StoreInt32(sticky, 1)
+	}
+}
@@ -0,0 +1,277 @@
+package micro
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/whatisfaker/zaptrace/log"
+)
+
+//routerDriver 记录每个dsn执行的sql, down中的dsn ping失败
+type routerDriver struct {
+	mu      sync.Mutex
+	queries map[string][]string
+	down    map[string]bool
+}
+
+var testRouterDriver = &routerDriver{queries: make(map[string][]string), down: make(map[string]bool)}
+
+func init() {
+	sql.Register("micro_router_test", testRouterDriver)
+}
+
+func (c *routerDriver) Open(dsn string) (driver.Conn, error) {
+	return &routerConn{driver: c, dsn: dsn}, nil
+}
+
+func (c *routerDriver) record(dsn string, query string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queries[dsn] = append(c.queries[dsn], query)
+}
+
+//take 返回并清空dsn执行的sql
+func (c *routerDriver) take(dsn string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v := c.queries[dsn]
+	delete(c.queries, dsn)
+	return v
+}
+
+func (c *routerDriver) setDown(dsn string, down bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.down[dsn] = down
+}
+
+type routerConn struct {
+	driver *routerDriver
+	dsn    string
+}
+
+func (c *routerConn) Prepare(query string) (driver.Stmt, error) {
+	return &routerStmt{conn: c, query: query}, nil
+}
+
+func (c *routerConn) Close() error {
+	return nil
+}
+
+func (c *routerConn) Begin() (driver.Tx, error) {
+	return c, nil
+}
+
+func (c *routerConn) Commit() error {
+	return nil
+}
+
+func (c *routerConn) Rollback() error {
+	return nil
+}
+
+func (c *routerConn) Ping(ctx context.Context) error {
+	c.driver.mu.Lock()
+	defer c.driver.mu.Unlock()
+	if c.driver.down[c.dsn] {
+		return errors.New(c.dsn + " down")
+	}
+	return nil
+}
+
+type routerStmt struct {
+	conn  *routerConn
+	query string
+}
+
+func (c *routerStmt) Close() error {
+	return nil
+}
+
+func (c *routerStmt) NumInput() int {
+	return -1
+}
+
+func (c *routerStmt) Exec(args []driver.Value) (driver.Result, error) {
+	c.conn.driver.record(c.conn.dsn, c.query)
+	return routerResult{}, nil
+}
+
+func (c *routerStmt) Query(args []driver.Value) (driver.Rows, error) {
+	c.conn.driver.record(c.conn.dsn, c.query)
+	return &routerRows{}, nil
+}
+
+type routerResult struct{}
+
+func (routerResult) LastInsertId() (int64, error) {
+	return 1, nil
+}
+
+func (routerResult) RowsAffected() (int64, error) {
+	return 1, nil
+}
+
+type routerRows struct{}
+
+func (c *routerRows) Columns() []string {
+	return []string{"id", "name"}
+}
+
+func (c *routerRows) Close() error {
+	return nil
+}
+
+func (c *routerRows) Next(dest []driver.Value) error {
+	return io.EOF
+}
+
+type routerItem struct {
+	ID   int64 `gorm:"primary_key"`
+	Name string
+}
+
+//newTestMySQLRouter 使用记录sql的驱动创建读写分离, 返回主库和从库的dsn
+func newTestMySQLRouter(t *testing.T, replicas int) (*MySQLRouter, string, []string) {
+	t.Helper()
+	primaryDSN := t.Name() + "/primary"
+	sqlDB, err := sql.Open("micro_router_test", primaryDSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, err := gorm.Open("mysql", sqlDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &MySQLRouter{
+		primary: primary,
+		log:     log.NewStdLogger("error"),
+		done:    make(chan struct{}),
+	}
+	names := make([]string, replicas)
+	for i := range names {
+		names[i] = t.Name() + "/replica" + string(rune('0'+i))
+		db, err := sql.Open("micro_router_test", names[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.replicas = append(r.replicas, &mysqlReplica{name: names[i], db: db, weight: 1})
+	}
+	if err := r.open(context.Background(), "db", &MySQLClusterConfig{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = r.Close()
+		for _, name := range names {
+			testRouterDriver.setDown(name, false)
+			testRouterDriver.take(name)
+		}
+		testRouterDriver.take(primaryDSN)
+	})
+	testRouterDriver.take(primaryDSN)
+	return r, primaryDSN, names
+}
+
+func hasQuery(queries []string, prefix string) bool {
+	for _, q := range queries {
+		if strings.HasPrefix(q, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMySQLRouterReadWrite(t *testing.T) {
+	r, primary, replicas := newTestMySQLRouter(t, 1)
+	var items []routerItem
+	if err := r.DB().Find(&items).Error; err != nil {
+		t.Fatal(err)
+	}
+	if q := testRouterDriver.take(replicas[0]); !hasQuery(q, "SELECT") {
+		t.Fatalf("replica queries %v, want SELECT", q)
+	}
+	if q := testRouterDriver.take(primary); len(q) != 0 {
+		t.Fatalf("read on primary %v", q)
+	}
+	if err := r.DB().Create(&routerItem{Name: "a"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if q := testRouterDriver.take(primary); !hasQuery(q, "INSERT") {
+		t.Fatalf("primary queries %v, want INSERT", q)
+	}
+	if q := testRouterDriver.take(replicas[0]); len(q) != 0 {
+		t.Fatalf("write on replica %v", q)
+	}
+	if mysqlPool(r.DB()) != r.Primary().DB() {
+		t.Fatal("router pool is not the primary pool")
+	}
+}
+
+func TestMySQLRouterUnhealthyReplica(t *testing.T) {
+	r, primary, replicas := newTestMySQLRouter(t, 2)
+	testRouterDriver.setDown(replicas[0], true)
+	r.check(context.Background())
+	status := r.Lag(context.Background())
+	if status[0].Healthy || !status[1].Healthy {
+		t.Fatalf("replica status %+v %+v", status[0], status[1])
+	}
+	for i := 0; i < 10; i++ {
+		var items []routerItem
+		if err := r.DB().Find(&items).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q := testRouterDriver.take(replicas[0]); hasQuery(q, "SELECT") {
+		t.Fatalf("read on unhealthy replica %v", q)
+	}
+	if q := testRouterDriver.take(replicas[1]); !hasQuery(q, "SELECT") {
+		t.Fatalf("replica queries %v, want SELECT", q)
+	}
+	//没有健康的从库时读主库
+	testRouterDriver.setDown(replicas[1], true)
+	r.check(context.Background())
+	var items []routerItem
+	if err := r.DB().Find(&items).Error; err != nil {
+		t.Fatal(err)
+	}
+	if q := testRouterDriver.take(primary); !hasQuery(q, "SELECT") {
+		t.Fatalf("primary queries %v, want SELECT", q)
+	}
+}
+
+func TestMySQLRouterSticky(t *testing.T) {
+	r, primary, replicas := newTestMySQLRouter(t, 1)
+	ctx := WithMySQLSticky(context.Background())
+	var items []routerItem
+	if err := r.Context(ctx).Find(&items).Error; err != nil {
+		t.Fatal(err)
+	}
+	if q := testRouterDriver.take(replicas[0]); !hasQuery(q, "SELECT") {
+		t.Fatalf("read before write on %v, want replica", q)
+	}
+	if err := r.Context(ctx).Create(&routerItem{Name: "a"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Context(ctx).Find(&items).Error; err != nil {
+		t.Fatal(err)
+	}
+	if q := testRouterDriver.take(primary); !hasQuery(q, "INSERT") || !hasQuery(q, "SELECT") {
+		t.Fatalf("primary queries %v, want INSERT and SELECT", q)
+	}
+	if q := testRouterDriver.take(replicas[0]); len(q) != 0 {
+		t.Fatalf("read after write on replica %v", q)
+	}
+	if err := r.Context(WithMySQLPrimary(context.Background())).Find(&items).Error; err != nil {
+		t.Fatal(err)
+	}
+	if q := testRouterDriver.take(primary); !hasQuery(q, "SELECT") {
+		t.Fatalf("primary queries %v, want SELECT", q)
+	}
+}
@@ -1,14 +1,18 @@
 package micro
 
 import (
+	"net"
 	"strings"
+	"time"
 
 	"github.com/whatisfaker/zaptrace/log"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 const (
 	ccTypeNacos int8 = iota + 1
 	ccTypeFile
+	ccTypeMemory
 
 	scTypeNacos int8 = iota + 1
 	scTypeNoop
@@ -17,19 +21,34 @@ const (
 )
 
 type options struct {
-	applicationID string
-	addr          string
-	configKey     string
-	confPath      string
-	ccType        int8
-	scType        int8
-	namespace     string
-	logLevel      string
-	logger        *log.Factory
-	mysqlTracer   bool
-	redisTracer   bool
-	mongoTracer   bool
-	influxTracer  bool
+	applicationID  string
+	addr           string
+	configKey      string
+	confPath       string
+	ccType         int8
+	scType         int8
+	namespace      string
+	logLevel       string
+	logger         *log.Factory
+	depTracers     []string
+	slowThresholds map[string]time.Duration
+	resilience     bool
+	resilienceCfg  *ResilienceConfig
+	memConfig      interface{}
+	listen         func(string, string) (net.Listener, error)
+	metricsListen  string
+	adminListen    string
+	watchInterval  time.Duration
+	depReloadGrace time.Duration
+	depInit        *depInit
+	healthInterval time.Duration
+	healthGrace    time.Duration
+	auditOpts      []AuditOption
+	tracing        string
+	otlpEndpoint   string
+	otelExporter   sdktrace.SpanExporter
+	noGlobalTracer bool
+	noSignal       bool
 }
 
 type Option interface {
@@ -65,6 +84,132 @@ func FileConfigCenter(path string) Option {
 	})
 }
 
+//MemoryConfigCenter 使用内存配置中心(测试使用), initial为初始配置
+func MemoryConfigCenter(initial interface{}) Option {
+	return newOption(func(o *options) {
+		o.ccType = ccTypeMemory
+		o.memConfig = initial
+	})
+}
+
+//NoopServiceCenter 使用空的服务中心(不注册服务)
+func NoopServiceCenter() Option {
+	return newOption(func(o *options) {
+		o.scType = scTypeNoop
+	})
+}
+
+//ListenFunc 自定义服务的监听方式(默认net.Listen, 测试时可替换为内存listener), 不能为nil
+func ListenFunc(f func(network string, address string) (net.Listener, error)) Option {
+	return newOption(func(o *options) {
+		o.listen = f
+	})
+}
+
+//NoGlobalTracer RunWith不设置opentracing和OpenTelemetry的全局tracer(OpenTelemetry模式下服务仍使用创建的provider, 测试使用)
+func NoGlobalTracer() Option {
+	return newOption(func(o *options) {
+		o.noGlobalTracer = true
+	})
+}
+
+//NoSignalHandler RunWith不处理SIGINT/SIGTERM, 由ctx控制退出(测试使用)
+func NoSignalHandler() Option {
+	return newOption(func(o *options) {
+		o.noSignal = true
+	})
+}
+
+//MetricsListen 在独立端口上提供prometheus指标(/metrics)
+func MetricsListen(addr string) Option {
+	return newOption(func(o *options) {
+		o.metricsListen = addr
+	})
+}
+
+//AdminListen 在独立端口上提供管理/诊断接口(pprof, expvar, /metrics, /admin/loglevel, /admin/services, /admin/config, /admin/deps, /admin/registry)
+func AdminListen(addr string) Option {
+	return newOption(func(o *options) {
+		o.adminListen = addr
+	})
+}
+
+//HealthInterval 就绪检查的间隔(默认10s), 就绪状态变化时更新grpc health和注册中心, 0关闭(不检查, 一直就绪)
+func HealthInterval(interval time.Duration) Option {
+	return newOption(func(o *options) {
+		o.healthInterval = interval
+	})
+}
+
+//HealthStartupGrace 启动后第一次就绪之前不在注册中心标记实例不健康的最长时间(默认30s), 超过后仍不就绪时标记, 0不等待
+//grpc health和/healthz不受影响, 第一次检查通过之前都不就绪
+func HealthStartupGrace(d time.Duration) Option {
+	return newOption(func(o *options) {
+		o.healthGrace = d
+	})
+}
+
+//DefaultAudit 管理器默认的审计管道(没有ParamAudit的服务的GinAudit使用, 默认不存储)
+func DefaultAudit(opts ...AuditOption) Option {
+	return newOption(func(o *options) {
+		o.auditOpts = append(o.auditOpts, opts...)
+	})
+}
+
+//WatchConfig 定时检查配置中心, 配置变化时重新加载追踪采样, 限流, grpc容错, 依赖等(ReloadConfig)
+func WatchConfig(interval time.Duration) Option {
+	return newOption(func(o *options) {
+		o.watchInterval = interval
+	})
+}
+
+//DepInitTimeout 依赖的创建超时: 每个依赖每次创建的超时(默认30s, 也用于重连和热更新), ParseConfig并发创建所有依赖的超时(默认2m), 0不限制
+func DepInitTimeout(perDep time.Duration, total time.Duration) Option {
+	return newOption(func(o *options) {
+		o.depInit.timeout = perDep
+		o.depInit.total = total
+	})
+}
+
+//DepInitRetry 启动时依赖创建失败的重试次数(默认2)和指数退避时间(默认500ms到5s)
+func DepInitRetry(retries int, backoffBase time.Duration, backoffMax time.Duration) Option {
+	return newOption(func(o *options) {
+		o.depInit.retries = retries
+		o.depInit.backoffBase = backoffBase
+		o.depInit.backoffMax = backoffMax
+	})
+}
+
+//DepReloadGrace 配置变化替换依赖后, 旧的依赖等待关闭的时间(默认30s)
+func DepReloadGrace(grace time.Duration) Option {
+	return newOption(func(o *options) {
+		o.depReloadGrace = grace
+	})
+}
+
+//Tracing 选择追踪后端(TracingJaeger, TracingOTel)
+func Tracing(backend string) Option {
+	return newOption(func(o *options) {
+		o.tracing = backend
+	})
+}
+
+//OpenTelemetry 使用OpenTelemetry追踪, endpoint为OTLP(grpc)收集器地址(空则使用OTEL_EXPORTER_OTLP_ENDPOINT或默认localhost:4317)
+func OpenTelemetry(endpoint string) Option {
+	return newOption(func(o *options) {
+		o.tracing = TracingOTel
+		o.otlpEndpoint = endpoint
+	})
+}
+
+//OTelSpanExporter 使用OpenTelemetry追踪并指定span导出(例如测试使用tracetest.NewInMemoryExporter())
+func OTelSpanExporter(exporter sdktrace.SpanExporter) Option {
+	return newOption(func(o *options) {
+		o.tracing = TracingOTel
+		o.otelExporter = exporter
+	})
+}
+
 //NacosAddr
 func NacosAddr(e string) Option {
 	return newOption(func(o *options) {
@@ -84,33 +229,61 @@ func ConfigKey(key string) Option {
 	})
 }
 
-//Logger 设置日志
+//Logger 设置日志(micro.LoggerFrom(ctx)获取请求的日志)
 func Logger(logger *log.Factory) Option {
 	return newOption(func(o *options) {
 		o.logger = logger
 	})
 }
 
-func EnableMySQLTracer() Option {
+//EnableTracer 依赖(DepMySQL, DepRedis等或者自定义名称例如elastic)使用独立的tracer
+func EnableTracer(dep string) Option {
 	return newOption(func(o *options) {
-		o.mysqlTracer = true
+		for _, v := range o.depTracers {
+			if v == dep {
+				return
+			}
+		}
+		o.depTracers = append(o.depTracers, dep)
 	})
 }
 
+func EnableMySQLTracer() Option {
+	return EnableTracer(DepMySQL)
+}
+
 func EnableRedisTracer() Option {
-	return newOption(func(o *options) {
-		o.redisTracer = true
-	})
+	return EnableTracer(DepRedis)
 }
 
 func EnableMongoTracer() Option {
+	return EnableTracer(DepMongo)
+}
+
+func EnableInfluxTracer() Option {
+	return EnableTracer(DepInflux)
+}
+
+func EnableKafkaTracer() Option {
+	return EnableTracer(DepKafka)
+}
+
+//DepSlowThreshold 依赖(DepMySQL, DepRedis等)的慢调用日志阈值(默认500ms), 0关闭慢调用日志
+func DepSlowThreshold(dep string, threshold time.Duration) Option {
 	return newOption(func(o *options) {
-		o.mongoTracer = true
+		if o.slowThresholds == nil {
+			o.slowThresholds = make(map[string]time.Duration)
+		}
+		o.slowThresholds[dep] = threshold
 	})
 }
 
-func EnableInfluxTracer() Option {
+//EnableGRPCResilience grpc客户端(GetGRPCConn)启用超时/重试/熔断, 不传配置时使用默认策略, 配置中没有设置(0)的字段使用默认值(可通过ReloadResilience从配置中心加载)
+func EnableGRPCResilience(cfg ...*ResilienceConfig) Option {
 	return newOption(func(o *options) {
-		o.influxTracer = true
+		o.resilience = true
+		if len(cfg) > 0 {
+			o.resilienceCfg = cfg[0]
+		}
 	})
 }
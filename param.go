@@ -13,9 +13,10 @@ const (
 )
 
 type paramMap struct {
-	webHealthCheck string
-	webValidateCN  bool
-	//webGinAuditMW   func(*auditlog.AuditLog, *gin.Context)
+	webHealthCheck   string
+	webValidateCN    bool
+	webAuditFunc     func(*auditlog.AuditLog, *gin.Context)
+	audit            *Auditor
 	enableTracer     bool
 	ignoreTracePath  []string
 	discoveryIP      string
@@ -27,6 +28,25 @@ type paramMap struct {
 	tcpIdleTime      time.Duration
 	tcpBufSizeMin    int
 	tcpBufSizeMax    int
+	tcpPreambles     [][]byte
+	limit            *LimitConfig
+	webMetrics       string
+	webLogLevel      string
+	webProbes        bool
+	grpcHealth       bool
+
+	consumerConcurrency int
+	consumerRetries     int
+	consumerBackoff     time.Duration
+	consumerMaxBackoff  time.Duration
+	consumerDeadLetter  string
+}
+
+func (c *paramMap) limitConfig() *LimitConfig {
+	if c.limit == nil {
+		c.limit = &LimitConfig{}
+	}
+	return c.limit
 }
 
 type Param interface {
@@ -92,6 +112,50 @@ func ParamWebHealthCheck(enable bool, path ...string) Param {
 	})
 }
 
+//ParamWebMetrics web服务提供prometheus指标的路由(默认关闭, 打开时路径默认为/metrics)
+func ParamWebMetrics(enable bool, path ...string) Param {
+	return newParam(func(m *paramMap) {
+		if enable {
+			m.webMetrics = defaultMetricsPath
+			if len(path) > 0 && path[0] != "" {
+				m.webMetrics = path[0]
+			}
+			m.ignoreTracePath = append(m.ignoreTracePath, m.webMetrics)
+		} else {
+			m.webMetrics = ""
+		}
+	})
+}
+
+//ParamWebProbes web服务打开存活/就绪检查的路由/livez, /readyz(默认打开)
+func ParamWebProbes(enable bool) Param {
+	return newParam(func(m *paramMap) {
+		m.webProbes = enable
+	})
+}
+
+//ParamGRPCHealth grpc服务提供grpc.health.v1.Health(默认打开, initFunc已经注册时不重复注册), 状态跟随管理器的就绪检查
+func ParamGRPCHealth(enable bool) Param {
+	return newParam(func(m *paramMap) {
+		m.grpcHealth = enable
+	})
+}
+
+//ParamWebLogLevel web服务提供查看/修改日志级别的路由(默认关闭, 打开时路径默认为/admin/loglevel)
+func ParamWebLogLevel(enable bool, path ...string) Param {
+	return newParam(func(m *paramMap) {
+		if enable {
+			m.webLogLevel = defaultLogLevelPath
+			if len(path) > 0 && path[0] != "" {
+				m.webLogLevel = path[0]
+			}
+			m.ignoreTracePath = append(m.ignoreTracePath, m.webLogLevel)
+		} else {
+			m.webLogLevel = ""
+		}
+	})
+}
+
 //ParamWebValidateCN web服务国际化使用中文(默认开)
 func ParamWebValidateCN(enable bool) Param {
 	return newParam(func(m *paramMap) {
@@ -99,9 +163,17 @@ func ParamWebValidateCN(enable bool) Param {
 	})
 }
 
+//ParamWebGinAuditFunc 设置服务的GinAudit记录的处理函数(同步调用, 默认空)
 func ParamWebGinAuditFunc(f func(*auditlog.AuditLog, *gin.Context)) Param {
 	return newParam(func(m *paramMap) {
-		auditlog.MWAuditlogHandler = f
+		m.webAuditFunc = f
+	})
+}
+
+//ParamAudit 服务的审计管道(NewAuditor): gin服务的GinAudit路由使用, grpc服务审计所有调用
+func ParamAudit(a *Auditor) Param {
+	return newParam(func(m *paramMap) {
+		m.audit = a
 	})
 }
 
@@ -117,6 +189,13 @@ func ParamTCPRoute(fn func([]byte) int) Param {
 	})
 }
 
+//ParamTCPPreamble tcp codec的消息开头(magic), 单端口服务(RegisterMux)按开头识别tcp连接, 可以有多个
+func ParamTCPPreamble(preambles ...[]byte) Param {
+	return newParam(func(m *paramMap) {
+		m.tcpPreambles = append(m.tcpPreambles, preambles...)
+	})
+}
+
 func ParamTCPManualShutdown() Param {
 	return newParam(func(m *paramMap) {
 		m.tcpManulShutdown = true
@@ -137,3 +216,60 @@ func ParamTCPBufferSize(min int, max ...int) Param {
 		}
 	})
 }
+
+//ParamRateLimit 服务限流(每秒请求数/突发数), gin返回429, grpc返回RESOURCE_EXHAUSTED, tcp按新建连接限制
+func ParamRateLimit(rps float64, burst int) Param {
+	return newParam(func(m *paramMap) {
+		l := m.limitConfig()
+		l.RPS = rps
+		l.Burst = burst
+	})
+}
+
+//ParamMaxConcurrent 服务最大并发数(tcp为最大连接数)
+func ParamMaxConcurrent(n int) Param {
+	return newParam(func(m *paramMap) {
+		m.limitConfig().MaxConcurrent = n
+	})
+}
+
+//ParamLimitPerRoute 默认限流规则按路由(gin)/方法(grpc)分别计数
+func ParamLimitPerRoute() Param {
+	return newParam(func(m *paramMap) {
+		m.limitConfig().PerRoute = true
+	})
+}
+
+//ParamRouteLimit 单独设置某个路由(gin FullPath)或方法(grpc FullMethod)的限流规则
+func ParamRouteLimit(route string, rule LimitRule) Param {
+	return newParam(func(m *paramMap) {
+		l := m.limitConfig()
+		if l.Routes == nil {
+			l.Routes = make(map[string]LimitRule)
+		}
+		l.Routes[route] = rule
+	})
+}
+
+//ParamConsumerConcurrency 消费者的并发数(默认1, RabbitMQ每个并发一个channel)
+func ParamConsumerConcurrency(n int) Param {
+	return newParam(func(m *paramMap) {
+		m.consumerConcurrency = n
+	})
+}
+
+//ParamConsumerRetry 处理失败的重试次数(默认3, 0不重试)和退避时间(默认200ms, 每次加倍, 最大maxBackoff)
+func ParamConsumerRetry(retries int, backoff time.Duration, maxBackoff time.Duration) Param {
+	return newParam(func(m *paramMap) {
+		m.consumerRetries = retries
+		m.consumerBackoff = backoff
+		m.consumerMaxBackoff = maxBackoff
+	})
+}
+
+//ParamConsumerDeadLetter 重试后仍然失败(或者拒绝)的消息发送到死信队列, 没有设置时记录错误日志后丢弃
+func ParamConsumerDeadLetter(queue string) Param {
+	return newParam(func(m *paramMap) {
+		m.consumerDeadLetter = queue
+	})
+}
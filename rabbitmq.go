@@ -0,0 +1,61 @@
+package micro
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/streadway/amqp"
+	"github.com/whatisfaker/conf"
+	confamqp "github.com/whatisfaker/conf/amqp"
+)
+
+//rabbitMQDep ParseConfig创建的rabbitmq依赖: amqp.Client(自动ack的Consume)和手动ack的channel(RabbitMQSource)使用独立的连接
+type rabbitMQDep struct {
+	confamqp.Client
+	url  string
+	mu   sync.Mutex
+	conn *amqp.Connection
+}
+
+//rabbitMQURL 同amqp.NewRabbitMQClient的连接地址
+func rabbitMQURL(cfg *conf.RabbitMQConfig) string {
+	if cfg.URI != "" {
+		return cfg.URI
+	}
+	user, password := cfg.Username, cfg.Password
+	if user == "" {
+		user = "guest"
+		password = "guest"
+	}
+	return fmt.Sprintf("amqp://%s:%s@%s/", user, password, cfg.Address)
+}
+
+//channel 打开新的channel, 连接断开时重新连接
+func (c *rabbitMQDep) channel() (*amqp.Channel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.url == "" {
+		return nil, errors.New("rabbitmq client is closed")
+	}
+	if c.conn == nil || c.conn.IsClosed() {
+		conn, err := amqp.Dial(c.url)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	}
+	return c.conn.Channel()
+}
+
+//CloseConn 关闭amqp.Client和channel的连接
+func (c *rabbitMQDep) CloseConn() {
+	c.Client.CloseConn()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.url = ""
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+}
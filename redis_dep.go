@@ -0,0 +1,121 @@
+package micro
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+//RedisPoolConfig redis的连接参数(默认值同conf.RedisConfig)
+type RedisPoolConfig struct {
+	Passwd       string        `yaml:"password"`
+	DB           int           `yaml:"db"`
+	DialTimeout  time.Duration `yaml:"dialtimeout"`
+	ReadTimeout  time.Duration `yaml:"readtimeout"`
+	WriteTimeout time.Duration `yaml:"writetimeout"`
+	PoolSize     int           `yaml:"poolsize"`
+	PoolTimeout  time.Duration `yaml:"pooltimeout"`
+	MaxRetries   int           `yaml:"max_retries"`
+}
+
+func (c RedisPoolConfig) withDefaults() RedisPoolConfig {
+	if c.DialTimeout == 0 {
+		c.DialTimeout = 10 * time.Second
+	}
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = 3 * time.Second
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = 10 * time.Second
+	}
+	if c.PoolSize == 0 {
+		c.PoolSize = 10
+	}
+	if c.PoolTimeout == 0 {
+		c.PoolTimeout = 20 * time.Second
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = 3
+	}
+	return c
+}
+
+//RedisSentinelConfig redis哨兵(failover)配置, ParseConfig创建自动切换主节点的客户端(GetRedis)
+type RedisSentinelConfig struct {
+	//MasterName 哨兵监控的主节点名称
+	MasterName string `yaml:"master_name"`
+	//Addrs 哨兵地址
+	Addrs []string `yaml:"addrs"`
+	//SentinelPassword 哨兵的密码
+	SentinelPassword string `yaml:"sentinel_password"`
+	RedisPoolConfig  `yaml:",inline"`
+}
+
+//RedisShardsConfig redis客户端分片配置(按key的hash一致性分片), ParseConfig创建分片的客户端(GetRedis)
+type RedisShardsConfig struct {
+	//Shards 分片名称和地址, 名称决定key的分布, 更换地址时保持名称不变
+	Shards map[string]string `yaml:"shards"`
+	//HeartbeatFrequency 分片的检查间隔(默认500ms), 不可用的分片暂时移除
+	HeartbeatFrequency time.Duration `yaml:"heartbeat_frequency"`
+	RedisPoolConfig    `yaml:",inline"`
+}
+
+func newRedisSentinelDep(env *DepEnv, cfg interface{}) (interface{}, error) {
+	s := cfg.(*RedisSentinelConfig)
+	if s.MasterName == "" || len(s.Addrs) == 0 {
+		return nil, errors.New("miss redis sentinel master_name or addrs")
+	}
+	p := s.RedisPoolConfig.withDefaults()
+	client := redis.NewFailoverClient(&redis.FailoverOptions{
+		MasterName:       s.MasterName,
+		SentinelAddrs:    s.Addrs,
+		SentinelPassword: s.SentinelPassword,
+		Password:         p.Passwd,
+		DB:               p.DB,
+		DialTimeout:      p.DialTimeout,
+		ReadTimeout:      p.ReadTimeout,
+		WriteTimeout:     p.WriteTimeout,
+		PoolSize:         p.PoolSize,
+		PoolTimeout:      p.PoolTimeout,
+		MaxRetries:       p.MaxRetries,
+	})
+	env.inst.redis(env.Key, client)
+	return client, nil
+}
+
+func newRedisShardsDep(env *DepEnv, cfg interface{}) (interface{}, error) {
+	s := cfg.(*RedisShardsConfig)
+	if len(s.Shards) == 0 {
+		return nil, errors.New("miss redis shards")
+	}
+	p := s.RedisPoolConfig.withDefaults()
+	client := redis.NewRing(&redis.RingOptions{
+		Addrs:              s.Shards,
+		HeartbeatFrequency: s.HeartbeatFrequency,
+		Password:           p.Passwd,
+		DB:                 p.DB,
+		DialTimeout:        p.DialTimeout,
+		ReadTimeout:        p.ReadTimeout,
+		WriteTimeout:       p.WriteTimeout,
+		PoolSize:           p.PoolSize,
+		PoolTimeout:        p.PoolTimeout,
+		MaxRetries:         p.MaxRetries,
+	})
+	env.inst.redis(env.Key, client)
+	return client, nil
+}
+
+//RedisWithContext 绑定请求的context(单节点, 哨兵, 集群, 分片的客户端), 之后的调用自动成为请求的子span
+func RedisWithContext(ctx context.Context, client redis.Cmdable) redis.Cmdable {
+	switch c := client.(type) {
+	case *redis.Client:
+		return c.WithContext(ctx)
+	case *redis.ClusterClient:
+		return c.WithContext(ctx)
+	case *redis.Ring:
+		return c.WithContext(ctx)
+	}
+	return client
+}
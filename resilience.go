@@ -0,0 +1,372 @@
+package micro
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	breakerClosed int32 = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+//ResilienceConfig grpc客户端的容错策略(配置中心key: grpc_resilience), 没有设置(0)的字段使用默认值, 负数关闭
+type ResilienceConfig struct {
+	//Timeout 默认的调用超时(调用方未设置deadline时生效)
+	Timeout time.Duration `yaml:"timeout"`
+	//MethodTimeout 按方法设置超时(/package.Service/Method)
+	MethodTimeout map[string]time.Duration `yaml:"method_timeout"`
+	//MaxRetries 最大重试次数(UNAVAILABLE/RESOURCE_EXHAUSTED)
+	MaxRetries int `yaml:"max_retries"`
+	//BackoffBase 重试退避基础时间
+	BackoffBase time.Duration `yaml:"backoff_base"`
+	//BackoffMax 重试退避最大时间
+	BackoffMax time.Duration `yaml:"backoff_max"`
+	//RetryBudget 重试预算(每次请求增加的重试额度, 0.2表示重试最多占请求的20%)
+	RetryBudget float64 `yaml:"retry_budget"`
+	//MinRetriesPerSecond 每秒保底的重试次数
+	MinRetriesPerSecond int `yaml:"min_retries_per_second"`
+	//RetryBurst 重试预算的最大额度(令牌桶容量), 小于MinRetriesPerSecond时为MinRetriesPerSecond
+	RetryBurst int `yaml:"retry_burst"`
+	//BreakerThreshold 连续失败多少次熔断
+	BreakerThreshold int `yaml:"breaker_threshold"`
+	//BreakerOpenTime 熔断持续时间, 之后进入半开状态
+	BreakerOpenTime time.Duration `yaml:"breaker_open_time"`
+	//BreakerHalfOpenProbes 半开状态下允许的探测请求数
+	BreakerHalfOpenProbes int `yaml:"breaker_half_open_probes"`
+}
+
+//DefaultResilienceConfig 默认的容错策略
+func DefaultResilienceConfig() *ResilienceConfig {
+	return &ResilienceConfig{
+		Timeout:               5 * time.Second,
+		MaxRetries:            2,
+		BackoffBase:           50 * time.Millisecond,
+		BackoffMax:            time.Second,
+		RetryBudget:           0.2,
+		MinRetriesPerSecond:   10,
+		RetryBurst:            10,
+		BreakerThreshold:      5,
+		BreakerOpenTime:       10 * time.Second,
+		BreakerHalfOpenProbes: 1,
+	}
+}
+
+//withDefaults 没有设置(0)的字段使用默认值, 负数关闭(超时, 重试, 熔断)
+func (c *ResilienceConfig) withDefaults() *ResilienceConfig {
+	d := DefaultResilienceConfig()
+	if c == nil {
+		return d
+	}
+	v := *c
+	if v.Timeout == 0 {
+		v.Timeout = d.Timeout
+	}
+	if v.MaxRetries == 0 {
+		v.MaxRetries = d.MaxRetries
+	}
+	if v.BackoffBase == 0 {
+		v.BackoffBase = d.BackoffBase
+	}
+	if v.BackoffMax == 0 {
+		v.BackoffMax = d.BackoffMax
+	}
+	if v.RetryBudget == 0 {
+		v.RetryBudget = d.RetryBudget
+	}
+	if v.MinRetriesPerSecond == 0 {
+		v.MinRetriesPerSecond = d.MinRetriesPerSecond
+	}
+	if v.RetryBurst == 0 {
+		v.RetryBurst = d.RetryBurst
+	}
+	if v.BreakerThreshold == 0 {
+		v.BreakerThreshold = d.BreakerThreshold
+	}
+	if v.BreakerOpenTime == 0 {
+		v.BreakerOpenTime = d.BreakerOpenTime
+	}
+	if v.BreakerHalfOpenProbes == 0 {
+		v.BreakerHalfOpenProbes = d.BreakerHalfOpenProbes
+	}
+	return &v
+}
+
+func (c *ResilienceConfig) timeout(method string) time.Duration {
+	if d, ok := c.MethodTimeout[method]; ok {
+		return d
+	}
+	return c.Timeout
+}
+
+//backoff 带抖动的指数退避(full jitter)
+func (c *ResilienceConfig) backoff(attempt int) time.Duration {
+	d := c.BackoffBase << uint(attempt)
+	if d <= 0 || (c.BackoffMax > 0 && d > c.BackoffMax) {
+		d = c.BackoffMax
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+type resilience struct {
+	cfg      atomic.Value
+	breakers sync.Map
+	budgets  sync.Map
+}
+
+func newResilience(cfg *ResilienceConfig) *resilience {
+	c := &resilience{}
+	c.update(cfg)
+	return c
+}
+
+//update 更新策略(和默认策略合并)
+func (c *resilience) update(cfg *ResilienceConfig) {
+	c.cfg.Store(cfg.withDefaults())
+}
+
+func (c *resilience) config() *ResilienceConfig {
+	return c.cfg.Load().(*ResilienceConfig)
+}
+
+func (c *resilience) breaker(target string) *breaker {
+	v, _ := c.breakers.LoadOrStore(target, &breaker{})
+	return v.(*breaker)
+}
+
+//budget 目标服务的重试预算, 创建时有MinRetriesPerSecond的额度
+func (c *resilience) budget(target string, cfg *ResilienceConfig) *retryBudget {
+	if v, ok := c.budgets.Load(target); ok {
+		return v.(*retryBudget)
+	}
+	v, _ := c.budgets.LoadOrStore(target, &retryBudget{tokens: float64(cfg.MinRetriesPerSecond), last: time.Now()})
+	return v.(*retryBudget)
+}
+
+func (c *resilience) unaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		cfg := c.config()
+		if _, ok := ctx.Deadline(); !ok {
+			if d := cfg.timeout(method); d > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, d)
+				defer cancel()
+			}
+		}
+		br := c.breaker(cc.Target())
+		budget := c.budget(cc.Target(), cfg)
+		budget.deposit(cfg, time.Now())
+		for attempt := 0; ; attempt++ {
+			if !br.allow(cfg, time.Now()) {
+				return status.Error(codes.Unavailable, ErrCircuitOpen.Error())
+			}
+			err := invoker(ctx, method, req, reply, cc, opts...)
+			br.done(cfg, err, time.Now())
+			if err == nil || !retryable(err) || attempt >= cfg.MaxRetries || !budget.withdraw(cfg, time.Now()) {
+				return err
+			}
+			select {
+			case <-time.After(cfg.backoff(attempt)):
+			case <-ctx.Done():
+				return err
+			}
+		}
+	}
+}
+
+//streamClientInterceptor 流式调用只对建立流进行重试和熔断, 超时仅对MethodTimeout中配置的方法生效(流结束时释放)
+func (c *resilience) streamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		cfg := c.config()
+		if _, ok := ctx.Deadline(); !ok {
+			if d, ok := cfg.MethodTimeout[method]; ok && d > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, d)
+				stream, err := c.newStream(ctx, cfg, desc, cc, method, streamer, opts...)
+				if err != nil {
+					cancel()
+					return nil, err
+				}
+				return &cancelClientStream{ClientStream: stream, cancel: cancel}, nil
+			}
+		}
+		return c.newStream(ctx, cfg, desc, cc, method, streamer, opts...)
+	}
+}
+
+//newStream 建立流, 失败时按策略重试和熔断
+func (c *resilience) newStream(ctx context.Context, cfg *ResilienceConfig, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	br := c.breaker(cc.Target())
+	budget := c.budget(cc.Target(), cfg)
+	budget.deposit(cfg, time.Now())
+	for attempt := 0; ; attempt++ {
+		if !br.allow(cfg, time.Now()) {
+			return nil, status.Error(codes.Unavailable, ErrCircuitOpen.Error())
+		}
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		br.done(cfg, err, time.Now())
+		if err == nil || !retryable(err) || attempt >= cfg.MaxRetries || !budget.withdraw(cfg, time.Now()) {
+			return stream, err
+		}
+		select {
+		case <-time.After(cfg.backoff(attempt)):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+//cancelClientStream 流结束(RecvMsg返回错误, 包括io.EOF)时取消超时的context
+type cancelClientStream struct {
+	grpc.ClientStream
+	cancel context.CancelFunc
+}
+
+func (c *cancelClientStream) RecvMsg(m interface{}) error {
+	err := c.ClientStream.RecvMsg(m)
+	if err != nil {
+		c.cancel()
+	}
+	return err
+}
+
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+func breakerFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+//breaker 按目标服务的熔断器(关闭->打开->半开), now为调用的时间
+type breaker struct {
+	mu       sync.Mutex
+	state    int32
+	failures int
+	probes   int
+	openedAt time.Time
+}
+
+func (c *breaker) allow(cfg *ResilienceConfig, now time.Time) bool {
+	if cfg.BreakerThreshold <= 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case breakerOpen:
+		if now.Sub(c.openedAt) < cfg.BreakerOpenTime {
+			return false
+		}
+		c.state = breakerHalfOpen
+		c.probes = 0
+		fallthrough
+	case breakerHalfOpen:
+		if c.probes >= cfg.BreakerHalfOpenProbes {
+			return false
+		}
+		c.probes++
+	}
+	return true
+}
+
+func (c *breaker) done(cfg *ResilienceConfig, err error, now time.Time) {
+	if cfg.BreakerThreshold <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !breakerFailure(err) {
+		c.state = breakerClosed
+		c.failures = 0
+		return
+	}
+	c.failures++
+	if c.state == breakerHalfOpen || c.failures >= cfg.BreakerThreshold {
+		c.state = breakerOpen
+		c.openedAt = now
+	}
+}
+
+//retryBudget 重试预算(令牌桶), 防止重试放大故障: 每次请求增加RetryBudget, 每秒增加MinRetriesPerSecond, 最多RetryBurst
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (c *retryBudget) refill(cfg *ResilienceConfig, now time.Time) {
+	rate := float64(cfg.MinRetriesPerSecond)
+	if rate < 0 {
+		rate = 0
+	}
+	max := float64(cfg.RetryBurst)
+	if max < rate {
+		max = rate
+	}
+	if now.After(c.last) {
+		c.tokens += now.Sub(c.last).Seconds() * rate
+		c.last = now
+	}
+	if c.tokens > max {
+		c.tokens = max
+	}
+}
+
+func (c *retryBudget) deposit(cfg *ResilienceConfig, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens += cfg.RetryBudget
+	c.refill(cfg, now)
+}
+
+func (c *retryBudget) withdraw(cfg *ResilienceConfig, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refill(cfg, now)
+	if c.tokens < 1 {
+		return false
+	}
+	c.tokens--
+	return true
+}
+
+//ReloadResilience 从配置中心(grpc_resilience)重新加载grpc客户端容错策略, 配置中没有时恢复EnableGRPCResilience的策略(没有传入时为DefaultResilienceConfig)
+func (c *MSManager) ReloadResilience(ctx context.Context) error {
+	v := &struct {
+		GRPCResilience *ResilienceConfig `yaml:"grpc_resilience"`
+	}{}
+	err := c.confCenter.GetConfig(ctx, v)
+	c.metrics.configReloaded("resilience", err)
+	if err != nil {
+		return err
+	}
+	if v.GRPCResilience == nil {
+		c.resilience.update(c.options.resilienceCfg)
+		return nil
+	}
+	c.resilience.update(v.GRPCResilience)
+	return nil
+}
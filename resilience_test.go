@@ -0,0 +1,208 @@
+package micro
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	errUnavailable = status.Error(codes.Unavailable, "unavailable")
+	errInvalid     = status.Error(codes.InvalidArgument, "invalid")
+)
+
+func TestBreaker(t *testing.T) {
+	cfg := (&ResilienceConfig{BreakerThreshold: 2, BreakerOpenTime: time.Second, BreakerHalfOpenProbes: 1}).withDefaults()
+	start := time.Unix(1000, 0)
+	//每一步: 距离开始的时间, allow的结果, 请求的结果(allow为true时)
+	steps := []struct {
+		name  string
+		at    time.Duration
+		allow bool
+		err   error
+		state int32
+	}{
+		{"closed success", 0, true, nil, breakerClosed},
+		{"non breaker error", 0, true, errInvalid, breakerClosed},
+		{"first failure", 0, true, errUnavailable, breakerClosed},
+		{"threshold opens", 0, true, errUnavailable, breakerOpen},
+		{"open rejects", 500 * time.Millisecond, false, nil, breakerOpen},
+		{"half open probe fails", time.Second, true, errUnavailable, breakerOpen},
+		{"reopened rejects", 1500 * time.Millisecond, false, nil, breakerOpen},
+		{"half open probe", 2 * time.Second, true, nil, breakerClosed},
+		{"closed again", 2 * time.Second, true, errUnavailable, breakerClosed},
+	}
+	br := &breaker{}
+	for _, s := range steps {
+		now := start.Add(s.at)
+		if got := br.allow(cfg, now); got != s.allow {
+			t.Fatalf("%s: allow %v, want %v", s.name, got, s.allow)
+		}
+		if s.allow {
+			br.done(cfg, s.err, now)
+		}
+		if br.state != s.state {
+			t.Fatalf("%s: state %d, want %d", s.name, br.state, s.state)
+		}
+	}
+}
+
+func TestBreakerHalfOpenProbes(t *testing.T) {
+	cfg := (&ResilienceConfig{BreakerThreshold: 1, BreakerOpenTime: time.Second, BreakerHalfOpenProbes: 2}).withDefaults()
+	now := time.Unix(1000, 0)
+	br := &breaker{}
+	br.done(cfg, errUnavailable, now)
+	now = now.Add(time.Second)
+	//半开状态只允许BreakerHalfOpenProbes个探测
+	for i, want := range []bool{true, true, false} {
+		if got := br.allow(cfg, now); got != want {
+			t.Fatalf("probe %d: allow %v, want %v", i, got, want)
+		}
+	}
+	br.done(cfg, nil, now)
+	if !br.allow(cfg, now) {
+		t.Fatal("breaker not closed after successful probe")
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	cfg := (&ResilienceConfig{BreakerThreshold: -1}).withDefaults()
+	br := &breaker{}
+	now := time.Unix(1000, 0)
+	for i := 0; i < 10; i++ {
+		br.done(cfg, errUnavailable, now)
+	}
+	if !br.allow(cfg, now) {
+		t.Fatal("disabled breaker rejected")
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	start := time.Unix(1000, 0)
+	tests := []struct {
+		name string
+		cfg  *ResilienceConfig
+		//初始额度, 请求数(deposit), 经过的时间
+		tokens   float64
+		requests int
+		elapsed  time.Duration
+		want     int
+	}{
+		{"seeded", &ResilienceConfig{MinRetriesPerSecond: 3}, 3, 0, 0, 3},
+		{"empty", &ResilienceConfig{MinRetriesPerSecond: -1}, 0, 0, time.Second, 0},
+		{"ratio of requests", &ResilienceConfig{MinRetriesPerSecond: -1, RetryBudget: 0.25}, 0, 8, 0, 2},
+		{"refill per second", &ResilienceConfig{MinRetriesPerSecond: 2}, 0, 0, 2 * time.Second, 4},
+		{"burst cap", &ResilienceConfig{MinRetriesPerSecond: 1, RetryBurst: 5}, 0, 0, time.Minute, 5},
+		{"cap at least per second", &ResilienceConfig{MinRetriesPerSecond: 8, RetryBurst: 2}, 0, 0, time.Minute, 8},
+		{"deposits capped", &ResilienceConfig{MinRetriesPerSecond: -1, RetryBurst: 3, RetryBudget: 1}, 0, 10, 0, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg.withDefaults()
+			b := &retryBudget{tokens: tt.tokens, last: start}
+			for i := 0; i < tt.requests; i++ {
+				b.deposit(cfg, start)
+			}
+			now := start.Add(tt.elapsed)
+			got := 0
+			for b.withdraw(cfg, now) {
+				got++
+				if got > 1000 {
+					t.Fatal("budget never exhausted")
+				}
+			}
+			if got != tt.want {
+				t.Fatalf("withdrew %d retries, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResilienceBackoff(t *testing.T) {
+	cfg := (&ResilienceConfig{BackoffBase: 10 * time.Millisecond, BackoffMax: 50 * time.Millisecond}).withDefaults()
+	for attempt, max := range []time.Duration{10, 20, 40, 50, 50} {
+		max *= time.Millisecond
+		for i := 0; i < 100; i++ {
+			if d := cfg.backoff(attempt); d < 0 || d >= max {
+				t.Fatalf("attempt %d: backoff %v, want [0, %v)", attempt, d, max)
+			}
+		}
+	}
+}
+
+func TestResilienceWithDefaults(t *testing.T) {
+	cfg := (&ResilienceConfig{MaxRetries: -1, Timeout: time.Second}).withDefaults()
+	d := DefaultResilienceConfig()
+	if cfg.Timeout != time.Second || cfg.MaxRetries != -1 {
+		t.Fatalf("configured fields overwritten: %+v", cfg)
+	}
+	if cfg.BreakerThreshold != d.BreakerThreshold || cfg.RetryBurst != d.RetryBurst || cfg.BackoffBase != d.BackoffBase {
+		t.Fatalf("zero fields not defaulted: %+v", cfg)
+	}
+}
+
+func TestResilienceUnaryRetry(t *testing.T) {
+	cc, err := grpc.Dial("passthrough:///resilience", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	r := newResilience(&ResilienceConfig{MaxRetries: 2, BackoffBase: time.Millisecond, BackoffMax: time.Millisecond})
+	interceptor := r.unaryClientInterceptor()
+	calls := 0
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		calls++
+		if _, ok := ctx.Deadline(); !ok {
+			return errors.New("no default timeout")
+		}
+		if calls < 3 {
+			return errUnavailable
+		}
+		return nil
+	}
+	if err := interceptor(context.Background(), "/pkg.Service/Method", nil, nil, cc, invoker); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Fatalf("called %d times, want 3", calls)
+	}
+	calls = 0
+	invalid := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		calls++
+		return errInvalid
+	}
+	if err := interceptor(context.Background(), "/pkg.Service/Method", nil, nil, cc, invalid); status.Code(err) != codes.InvalidArgument || calls != 1 {
+		t.Fatalf("non retryable error: %v after %d calls", err, calls)
+	}
+}
+
+func TestReloadResilienceReset(t *testing.T) {
+	m, err := NewMSManager(NoopServiceCenter(), MemoryConfigCenter(map[string]interface{}{
+		"grpc_resilience": map[string]interface{}{"max_retries": 5},
+	}), LogLevel("error"), EnableGRPCResilience())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := m.ReloadResilience(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.resilience.config().MaxRetries; n != 5 {
+		t.Fatalf("max retries %d, want 5", n)
+	}
+	//删除grpc_resilience后恢复默认策略
+	if err := m.ConfigCenter().SetConfig(ctx, map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ReloadResilience(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.resilience.config().MaxRetries; n != DefaultResilienceConfig().MaxRetries {
+		t.Fatalf("max retries %d after removing config, want default", n)
+	}
+}
@@ -0,0 +1,253 @@
+package micro
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+
+	"github.com/uber/jaeger-client-go"
+	"github.com/whatisfaker/zaptrace/log"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+//采样类型(同jaeger的sampler type)
+const (
+	SamplerConst         = "const"
+	SamplerProbabilistic = "probabilistic"
+	SamplerRateLimiting  = "ratelimiting"
+)
+
+//TracingConfig 追踪配置(配置中心key: tracing)
+type TracingConfig struct {
+	//Sampler 默认采样, 为空时使用追踪后端的默认设置(jaeger为JAEGER_SAMPLER_*环境变量)
+	Sampler SamplerConfig `yaml:"sampler"`
+	//Routes 按路由(gin注册的路由如/users/:id, grpc的方法/package.Service/Method)覆盖采样
+	Routes map[string]SamplerConfig `yaml:"routes"`
+	//AgentAddr jaeger agent地址(host:port)或者OTLP收集器地址, 启动时生效
+	AgentAddr string `yaml:"agent_addr"`
+	//Tags 追踪的全局标签, 启动时生效
+	Tags map[string]string `yaml:"tags"`
+}
+
+//SamplerConfig 采样设置
+type SamplerConfig struct {
+	//Type const, probabilistic, ratelimiting
+	Type string `yaml:"type"`
+	//Param const: 0/1, probabilistic: 采样率(0~1), ratelimiting: 每秒采样数
+	Param float64 `yaml:"param"`
+}
+
+//decider 根据trace id(低64位)决定是否采样
+type decider interface {
+	sample(id uint64) bool
+}
+
+type constDecider bool
+
+func (c constDecider) sample(uint64) bool {
+	return bool(c)
+}
+
+//probabilisticDecider 同jaeger的ProbabilisticSampler, 同一trace id在各服务的决定一致
+type probabilisticDecider uint64
+
+func (c probabilisticDecider) sample(id uint64) bool {
+	return id&math.MaxInt64 < uint64(c)
+}
+
+type rateLimitingDecider struct {
+	limiter *rate.Limiter
+}
+
+func (c *rateLimitingDecider) sample(uint64) bool {
+	return c.limiter.Allow()
+}
+
+func newDecider(cfg SamplerConfig) (decider, error) {
+	switch cfg.Type {
+	case SamplerConst:
+		return constDecider(cfg.Param != 0), nil
+	case SamplerProbabilistic:
+		if cfg.Param < 0 || cfg.Param > 1 {
+			return nil, fmt.Errorf("invalid probabilistic sampler param %v", cfg.Param)
+		}
+		return probabilisticDecider(uint64(float64(math.MaxInt64) * cfg.Param)), nil
+	case SamplerRateLimiting:
+		burst := int(cfg.Param)
+		if burst < 1 {
+			burst = 1
+		}
+		return &rateLimitingDecider{limiter: rate.NewLimiter(rate.Limit(cfg.Param), burst)}, nil
+	}
+	return nil, fmt.Errorf("unsupported sampler type %q", cfg.Type)
+}
+
+type samplerRules struct {
+	def    decider
+	defCfg SamplerConfig
+	routes map[string]decider
+	cfgs   map[string]SamplerConfig
+}
+
+//sampler 可以动态更新的采样(配置中心tracing), 没有匹配的规则时交给追踪后端的默认采样
+type sampler struct {
+	rules atomic.Value
+}
+
+func newSampler() *sampler {
+	c := &sampler{}
+	c.rules.Store(&samplerRules{})
+	return c
+}
+
+func (c *sampler) update(cfg *TracingConfig) error {
+	rules := &samplerRules{
+		routes: make(map[string]decider),
+		cfgs:   make(map[string]SamplerConfig),
+	}
+	if cfg != nil {
+		var err error
+		if cfg.Sampler.Type != "" {
+			rules.def, err = newDecider(cfg.Sampler)
+			if err != nil {
+				return err
+			}
+			rules.defCfg = cfg.Sampler
+		}
+		for route, v := range cfg.Routes {
+			d, err := newDecider(v)
+			if err != nil {
+				return fmt.Errorf("route %s: %w", route, err)
+			}
+			route = samplerRoute(route)
+			rules.routes[route] = d
+			rules.cfgs[route] = v
+		}
+	}
+	c.rules.Store(rules)
+	return nil
+}
+
+//samplerRoute 统一两种后端的span名称和配置的路由:
+//jaeger "HTTP GET /users/:id", otel "/users/:id" -> users/:id, "/pkg.Service/Method"(jaeger), "pkg.Service/Method"(otel) -> pkg.Service/Method
+func samplerRoute(operation string) string {
+	if strings.HasPrefix(operation, "HTTP ") {
+		if v := strings.SplitN(operation, " ", 3); len(v) == 3 {
+			operation = v[2]
+		}
+	}
+	return strings.TrimPrefix(operation, "/")
+}
+
+//decide ok为false表示没有规则, 使用后端的默认采样
+func (c *sampler) decide(id uint64, operation string) (sampled bool, cfg SamplerConfig, ok bool) {
+	rules := c.rules.Load().(*samplerRules)
+	route := samplerRoute(operation)
+	if d, ok := rules.routes[route]; ok {
+		return d.sample(id), rules.cfgs[route], true
+	}
+	if rules.def != nil {
+		return rules.def.sample(id), rules.defCfg, true
+	}
+	return false, SamplerConfig{}, false
+}
+
+//jaegerSampler jaeger的采样适配
+type jaegerSampler struct {
+	sampler  *sampler
+	fallback jaeger.Sampler
+}
+
+func (c *jaegerSampler) IsSampled(id jaeger.TraceID, operation string) (bool, []jaeger.Tag) {
+	if sampled, cfg, ok := c.sampler.decide(id.Low, operation); ok {
+		return sampled, []jaeger.Tag{
+			jaeger.NewTag(jaeger.SamplerTypeTagKey, cfg.Type),
+			jaeger.NewTag(jaeger.SamplerParamTagKey, cfg.Param),
+		}
+	}
+	return c.fallback.IsSampled(id, operation)
+}
+
+func (c *jaegerSampler) Close() {
+	c.fallback.Close()
+}
+
+func (c *jaegerSampler) Equal(other jaeger.Sampler) bool {
+	return false
+}
+
+//otelSampler OpenTelemetry的采样适配(根span), 有父span时由ParentBased跟随父span
+type otelSampler struct {
+	sampler  *sampler
+	fallback sdktrace.Sampler
+}
+
+func (c *otelSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	sampled, _, ok := c.sampler.decide(binary.BigEndian.Uint64(p.TraceID[8:]), p.Name)
+	if !ok {
+		return c.fallback.ShouldSample(p)
+	}
+	decision := sdktrace.Drop
+	if sampled {
+		decision = sdktrace.RecordAndSample
+	}
+	return sdktrace.SamplingResult{
+		Decision:   decision,
+		Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState(),
+	}
+}
+
+func (c *otelSampler) Description() string {
+	return "MicroSampler"
+}
+
+//jaegerLogger jaeger的日志适配
+type jaegerLogger struct {
+	logger log.Logger
+}
+
+func (c jaegerLogger) Error(msg string) {
+	c.logger.Error(msg)
+}
+
+func (c jaegerLogger) Infof(msg string, args ...interface{}) {
+	c.logger.Info(fmt.Sprintf(msg, args...))
+}
+
+func (c jaegerLogger) Debugf(msg string, args ...interface{}) {
+	c.logger.Debug(fmt.Sprintf(msg, args...))
+}
+
+//tracingConfig 启动时从配置中心获取追踪配置, 获取失败时使用默认设置
+func (c *MSManager) tracingConfig(ctx context.Context) *TracingConfig {
+	v := &struct {
+		Tracing *TracingConfig `yaml:"tracing"`
+	}{}
+	if err := c.confCenter.GetConfig(ctx, v); err != nil {
+		c.log.Normal().Warn("get tracing config", zap.Error(err))
+		return nil
+	}
+	if err := c.tracers.sampler.update(v.Tracing); err != nil {
+		c.log.Normal().Warn("invalid tracing sampler config", zap.Error(err))
+	}
+	return v.Tracing
+}
+
+//ReloadTracing 从配置中心(tracing)重新加载采样设置(AgentAddr和Tags需要重启)
+func (c *MSManager) ReloadTracing(ctx context.Context) error {
+	v := &struct {
+		Tracing *TracingConfig `yaml:"tracing"`
+	}{}
+	err := c.confCenter.GetConfig(ctx, v)
+	if err == nil {
+		err = c.tracers.sampler.update(v.Tracing)
+	}
+	c.metrics.configReloaded("tracing", err)
+	return err
+}
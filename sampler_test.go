@@ -0,0 +1,104 @@
+package micro
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/uber/jaeger-client-go"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSamplerRoute(t *testing.T) {
+	tests := []struct {
+		operation string
+		want      string
+	}{
+		{"HTTP GET /users/:id", "users/:id"},
+		{"/users/:id", "users/:id"},
+		{"HTTP GET route not found", "route not found"},
+		{"/pkg.Service/Method", "pkg.Service/Method"},
+		{"pkg.Service/Method", "pkg.Service/Method"},
+	}
+	for _, tt := range tests {
+		if got := samplerRoute(tt.operation); got != tt.want {
+			t.Fatalf("samplerRoute(%q) = %q, want %q", tt.operation, got, tt.want)
+		}
+	}
+}
+
+func TestSamplerRules(t *testing.T) {
+	s := newSampler()
+	err := s.update(&TracingConfig{
+		Sampler: SamplerConfig{Type: SamplerConst, Param: 0},
+		Routes: map[string]SamplerConfig{
+			"/users/:id":          {Type: SamplerConst, Param: 1},
+			"/pkg.Service/Method": {Type: SamplerConst, Param: 1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//每种后端的span名称(jaeger, otel)按同一个规则采样
+	tests := []struct {
+		name   string
+		jaeger string
+		otel   string
+		want   bool
+	}{
+		{"gin route", "HTTP GET /users/:id", "/users/:id", true},
+		{"grpc method", "/pkg.Service/Method", "pkg.Service/Method", true},
+		{"default", "HTTP GET /orders", "/orders", false},
+	}
+	js := &jaegerSampler{sampler: s, fallback: jaeger.NewConstSampler(true)}
+	ots := &otelSampler{sampler: s, fallback: sdktrace.AlwaysSample()}
+	for _, tt := range tests {
+		if got, _ := js.IsSampled(jaeger.TraceID{Low: 1}, tt.jaeger); got != tt.want {
+			t.Fatalf("%s: jaeger sampled %v, want %v", tt.name, got, tt.want)
+		}
+		r := ots.ShouldSample(sdktrace.SamplingParameters{TraceID: trace.TraceID{15: 1}, Name: tt.otel})
+		if got := r.Decision == sdktrace.RecordAndSample; got != tt.want {
+			t.Fatalf("%s: otel sampled %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if err := s.update(&TracingConfig{Routes: map[string]SamplerConfig{"/a": {Type: "unknown"}}}); err == nil {
+		t.Fatal("invalid route sampler accepted")
+	}
+	//没有规则时交给后端的默认采样
+	if err := s.update(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := s.decide(1, "/users/:id"); ok {
+		t.Fatal("rule left after reset")
+	}
+}
+
+func TestGinSpanName(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	prev := opentracing.GlobalTracer()
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(prev)
+	r := gin.New()
+	r.Use((&tracers{}).ginMiddleware("web", nil))
+	r.GET("/users/:id", func(ctx *gin.Context) {
+		ctx.Status(http.StatusOK)
+	})
+	for _, path := range []string{"/users/1", "/missing"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	//span名称使用路由(同otelgin)而不是请求路径
+	for i, want := range []string{"HTTP GET /users/:id", "HTTP GET route not found"} {
+		if spans[i].OperationName != want {
+			t.Fatalf("span %d: %q, want %q", i, spans[i].OperationName, want)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package micro
 
-import "context"
+import (
+	"context"
+	"sync"
+)
 
 const (
 	defaultMSWeight uint32 = 50
@@ -42,3 +45,43 @@ type ServiceCenter interface {
 	//ServiceInstances 获取服务信息
 	ServiceInstances(context.Context, string, string) ([]*MicroServiceInfo, error)
 }
+
+//registerHooks 注册过程的回调
+type registerHooks struct {
+	//registered 注册成功(Register继续阻塞维持心跳)
+	registered func()
+	//heartbeatFailed 心跳失败(Register返回心跳的错误)
+	heartbeatFailed func(error)
+}
+
+//registerNotifier Register阻塞到服务退出的注册中心, 注册成功时回调
+type registerNotifier interface {
+	registerWith(ctx context.Context, svc MicroService, hooks *registerHooks) error
+}
+
+//StartNotifier 可选的MicroService接口, Started返回的channel在Start开始接收请求(例如监听端口)后关闭
+//RunWith在关闭之前把服务的状态设为starting, 之后为running; 没有实现时Start调用后即为running
+type StartNotifier interface {
+	Started() <-chan struct{}
+}
+
+//startSignal 实现StartNotifier(gin, grpc, tcp, mux服务监听端口后关闭)
+type startSignal struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func newStartSignal() *startSignal {
+	return &startSignal{ch: make(chan struct{})}
+}
+
+func (c *startSignal) Started() <-chan struct{} {
+	return c.ch
+}
+
+//markStarted 开始接收请求, 多次调用只关闭一次
+func (c *startSignal) markStarted() {
+	c.once.Do(func() {
+		close(c.ch)
+	})
+}
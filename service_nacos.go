@@ -2,6 +2,7 @@ package micro
 
 import (
 	"context"
+	"sync"
 
 	"github.com/magicdvd/nacos-client"
 	"github.com/whatisfaker/zaptrace/log"
@@ -9,8 +10,10 @@ import (
 )
 
 type nacosSC struct {
-	client nacos.ServiceCmdable
-	log    *log.Factory
+	client    nacos.ServiceCmdable
+	log       *log.Factory
+	mu        sync.Mutex
+	unhealthy map[MicroService]bool
 }
 
 var _ ServiceCenter = (*nacosSC)(nil)
@@ -21,32 +24,84 @@ func newNacosSC(addr string, namespace string, log *log.Factory) (*nacosSC, erro
 		return nil, err
 	}
 	return &nacosSC{
-		client: client,
-		log:    log,
+		client:    client,
+		log:       log,
+		unhealthy: make(map[MicroService]bool),
 	}, nil
 }
 
+var _ registerNotifier = (*nacosSC)(nil)
+
 func (c *nacosSC) Register(ctx context.Context, svc MicroService) error {
+	return c.registerWith(ctx, svc, &registerHooks{})
+}
+
+//registerWith 注册实例后阻塞到ctx结束或者心跳错误, 注册成功和心跳失败时回调hooks
+func (c *nacosSC) registerWith(ctx context.Context, svc MicroService, hooks *registerHooks) error {
+	if c.isUnhealthy(svc) {
+		//不就绪, 恢复时由SetHealthy注册
+		<-ctx.Done()
+		return ctx.Err()
+	}
 	ip, port := svc.Discovery()
 	c.log.Trace(ctx).Debug("register service", zap.String("name", svc.Name()), zap.String("ip", ip), zap.Uint("port", port), zap.Uint32("weight", svc.Weight()), zap.String("group", svc.Group()), zap.Any("metadata", svc.Metadata()))
 	err := c.client.RegisterInstance(ip, port, svc.Name(), nacos.ParamWeight(float64(svc.Weight())), nacos.ParamMetadata(svc.Metadata()), nacos.ParamGroupName(svc.Group()))
 	if err != nil {
 		return err
 	}
+	if hooks.registered != nil {
+		hooks.registered()
+	}
 	ch := c.client.HeartBeatErr()
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case err, ok := <-ch:
-			if !ok {
-				return nil
+			if ok && err != nil {
+				if hooks.heartbeatFailed != nil {
+					hooks.heartbeatFailed(err)
+				}
+				return err
+			}
+			//不就绪时注销(SetHealthy)的实例在恢复时重新注册, 等待退出
+			if c.isUnhealthy(svc) {
+				ch = nil
+				continue
 			}
-			return err
+			return nil
 		}
 	}
 }
 
+func (c *nacosSC) isUnhealthy(svc MicroService) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.unhealthy[svc]
+}
+
+//SetHealthy 不就绪时从注册中心注销实例, 恢复时重新注册
+func (c *nacosSC) SetHealthy(ctx context.Context, svc MicroService, healthy bool) error {
+	c.mu.Lock()
+	unhealthy := c.unhealthy[svc]
+	if healthy == !unhealthy {
+		c.mu.Unlock()
+		return nil
+	}
+	if healthy {
+		delete(c.unhealthy, svc)
+	} else {
+		c.unhealthy[svc] = true
+	}
+	c.mu.Unlock()
+	ip, port := svc.Discovery()
+	c.log.Trace(ctx).Info("set service health", zap.String("name", svc.Name()), zap.String("ip", ip), zap.Uint("port", port), zap.Bool("healthy", healthy))
+	if healthy {
+		return c.client.RegisterInstance(ip, port, svc.Name(), nacos.ParamWeight(float64(svc.Weight())), nacos.ParamMetadata(svc.Metadata()), nacos.ParamGroupName(svc.Group()))
+	}
+	return c.client.DeregisterInstance(ip, port, svc.Name(), nacos.ParamWeight(float64(svc.Weight())), nacos.ParamMetadata(svc.Metadata()), nacos.ParamGroupName(svc.Group()))
+}
+
 func (c *nacosSC) Deregister(ctx context.Context, svc MicroService) error {
 	ip, port := svc.Discovery()
 	c.log.Trace(ctx).Debug("deregister service", zap.String("name", svc.Name()), zap.String("ip", ip), zap.Uint("port", port), zap.Uint32("weight", svc.Weight()), zap.String("group", svc.Group()), zap.Any("metadata", svc.Metadata()))
@@ -11,6 +11,7 @@ import (
 )
 
 type msTCP struct {
+	*startSignal
 	params      *paramMap
 	srv         *ms.Server
 	listen      string
@@ -18,7 +19,11 @@ type msTCP struct {
 	port        uint
 	name        string
 	log         *log.Factory
+	msLog       *log.Factory
 	initFunc    func(context.Context, *ms.Server)
+	limit       *limiter
+	netListen   func(string, string) (net.Listener, error)
+	metrics     *metrics
 }
 
 var _ MicroService = (*msTCP)(nil)
@@ -35,11 +40,15 @@ func newTCPMicroService(name string, listen string, initFunc func(context.Contex
 		v.apply(p)
 	}
 	c := &msTCP{
-		params:   p,
-		name:     name,
-		listen:   listen,
-		log:      log,
-		initFunc: initFunc,
+		startSignal: newStartSignal(),
+		params:      p,
+		name:        name,
+		listen:      listen,
+		log:         log,
+		msLog:       log.With(zap.String("ms", "tcp")),
+		initFunc:    initFunc,
+		netListen:   net.Listen,
+		limit:       newLimiter(p.limit),
 	}
 	var err error
 	c.discoveryIP, c.port, err = split2ipport(listen, p.discoveryIP)
@@ -49,9 +58,30 @@ func newTCPMicroService(name string, listen string, initFunc func(context.Contex
 	return c, nil
 }
 
+func (c *msTCP) attach(m *MSManager) {
+	c.netListen = m.options.listen
+	c.metrics = m.metrics
+	m.logs.register(LogTCP, c.log)
+	m.logs.register(LogTCP, c.msLog)
+}
+
+func (c *msTCP) limiters() []*limiter {
+	return []*limiter{c.limit}
+}
+
 func (c *msTCP) Start(ctx context.Context) error {
+	tcpListen, err := c.netListen("tcp", c.listen)
+	if err != nil {
+		return err
+	}
+	c.markStarted()
+	return c.serve(ctx, tcpListen)
+}
+
+//serve 在指定的listener上提供服务
+func (c *msTCP) serve(ctx context.Context, tcpListen net.Listener) error {
 	opts := make([]ms.ServerOption, 0)
-	opts = append(opts, ms.BufferSize(1024), ms.Logger(NewZapLogger(c.log.With(zap.String("ms", "tcp")))))
+	opts = append(opts, ms.BufferSize(1024), ms.Logger(NewZapLogger(c.msLog)))
 	if c.params.tcpCodec != nil {
 		opts = append(opts, ms.Codec(c.params.tcpCodec))
 	}
@@ -69,14 +99,15 @@ func (c *msTCP) Start(ctx context.Context) error {
 		}
 	}
 	c.srv = ms.NewServer(opts...)
+	//不会自动包装处理函数, 需要在initFunc中使用TCPInterceptor(ctx, route, handler)传递请求ID, 生成请求的日志上下文
+	ctx = withServiceLog(ctx, c.log)
 	if c.initFunc != nil {
 		c.initFunc(ctx, c.srv)
 	}
-	tcpListen, err := net.Listen("tcp", c.listen)
-	if err != nil {
-		return err
+	if c.metrics != nil {
+		tcpListen = c.metrics.tcpListener(c.name, tcpListen)
 	}
-	return c.srv.Serve(ctx, tcpListen)
+	return c.srv.Serve(ctx, &limitListener{Listener: tcpListen, limiter: c.limit})
 }
 
 func (c *msTCP) Name() string {
@@ -114,6 +145,6 @@ func (c *MSManager) RegisterTCP(name string, listen string, initFunc func(contex
 		c.log.Normal().Error("register tcp", zap.Error(err), zap.String("name", name), zap.String("listen", listen))
 		return err
 	}
-	c.svcs = append(c.svcs, svc)
+	c.Register(svc)
 	return nil
 }
@@ -0,0 +1,224 @@
+package testkit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/whatisfaker/micro"
+)
+
+//KafkaBroker 进程内的kafka broker(每个topic一个分区), 用于测试生产者和消费循环
+type KafkaBroker struct {
+	mu      sync.Mutex
+	topics  map[string][]kafka.Message
+	fetched map[string]map[string]int64
+	commits map[string]map[string]int64
+	notify  chan struct{}
+}
+
+//NewKafkaBroker 创建内存broker
+func NewKafkaBroker() *KafkaBroker {
+	return &KafkaBroker{
+		topics:  make(map[string][]kafka.Message),
+		fetched: make(map[string]map[string]int64),
+		commits: make(map[string]map[string]int64),
+		notify:  make(chan struct{}),
+	}
+}
+
+//Register 替换KafkaProducerConfig和KafkaConsumerConfig的依赖(进程内全局生效), 之后ParseConfig创建连接内存broker的生产者和消费者
+//返回的restore恢复原来的依赖, 例如defer broker.Register()()
+func (c *KafkaBroker) Register() (restore func()) {
+	restoreProducer := micro.RegisterDepProvider(micro.KafkaProducerConfig{}, func(env *micro.DepEnv, cfg interface{}) (interface{}, error) {
+		return env.InstrumentKafka(c.Producer(cfg.(*micro.KafkaProducerConfig).Topic)), nil
+	}, closeKafka, nil)
+	restoreConsumer := micro.RegisterDepProvider(micro.KafkaConsumerConfig{}, func(env *micro.DepEnv, cfg interface{}) (interface{}, error) {
+		s := cfg.(*micro.KafkaConsumerConfig)
+		return c.Consumer(s.GroupID, s.Topics...), nil
+	}, closeKafka, nil)
+	return func() {
+		restoreConsumer()
+		restoreProducer()
+	}
+}
+
+func closeKafka(ctx context.Context, dep interface{}) error {
+	return dep.(io.Closer).Close()
+}
+
+//Producer 创建生产者, topic为默认的topic
+func (c *KafkaBroker) Producer(topic string) micro.KafkaProducer {
+	return &kafkaProducer{broker: c, topic: topic}
+}
+
+//Consumer 创建消费者, 同一个group的消费者共享消费位置, 创建时从提交的offset开始(同消费组的rebalance, 没有提交的消息重新消费)
+func (c *KafkaBroker) Consumer(group string, topics ...string) micro.KafkaConsumer {
+	c.mu.Lock()
+	pos := make(map[string]int64)
+	for topic, offset := range c.commits[group] {
+		pos[topic] = offset
+	}
+	c.fetched[group] = pos
+	c.mu.Unlock()
+	return &kafkaConsumer{broker: c, group: group, topics: topics, closed: make(chan struct{})}
+}
+
+//Messages topic的所有消息
+func (c *KafkaBroker) Messages(topic string) []kafka.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v := make([]kafka.Message, len(c.topics[topic]))
+	copy(v, c.topics[topic])
+	return v
+}
+
+//Committed group在topic提交的offset(下一条消费的消息), 没有提交时为0
+func (c *KafkaBroker) Committed(group string, topic string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.commits[group][topic]
+}
+
+//WaitCommitted 等待group在topic提交的offset达到offset
+func (c *KafkaBroker) WaitCommitted(ctx context.Context, group string, topic string, offset int64) error {
+	for {
+		c.mu.Lock()
+		done := c.commits[group][topic] >= offset
+		notify := c.notify
+		c.mu.Unlock()
+		if done {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-notify:
+		}
+	}
+}
+
+//broadcast 通知等待的消费者(调用时持有锁)
+func (c *KafkaBroker) broadcast() {
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+func (c *KafkaBroker) write(msgs []kafka.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for _, msg := range msgs {
+		msg.Partition = 0
+		msg.Offset = int64(len(c.topics[msg.Topic]))
+		if msg.Time.IsZero() {
+			msg.Time = now
+		}
+		c.topics[msg.Topic] = append(c.topics[msg.Topic], msg)
+	}
+	c.broadcast()
+}
+
+//fetch group在topics中下一条消息, 没有时返回等待的channel
+func (c *KafkaBroker) fetch(group string, topics []string) (kafka.Message, bool, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pos, ok := c.fetched[group]
+	if !ok {
+		pos = make(map[string]int64)
+		c.fetched[group] = pos
+	}
+	for _, topic := range topics {
+		if n := pos[topic]; n < int64(len(c.topics[topic])) {
+			pos[topic] = n + 1
+			return c.topics[topic][n], true, nil
+		}
+	}
+	return kafka.Message{}, false, c.notify
+}
+
+func (c *KafkaBroker) commit(group string, msgs []kafka.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	offsets, ok := c.commits[group]
+	if !ok {
+		offsets = make(map[string]int64)
+		c.commits[group] = offsets
+	}
+	for _, msg := range msgs {
+		if msg.Offset+1 > offsets[msg.Topic] {
+			offsets[msg.Topic] = msg.Offset + 1
+		}
+	}
+	c.broadcast()
+}
+
+type kafkaProducer struct {
+	broker *KafkaBroker
+	topic  string
+}
+
+func (c *kafkaProducer) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	v := make([]kafka.Message, len(msgs))
+	for i, msg := range msgs {
+		if msg.Topic == "" {
+			msg.Topic = c.topic
+		} else if c.topic != "" {
+			return errors.New("kafka.(*Writer): Topic must not be specified for both Writer and Message")
+		}
+		if msg.Topic == "" {
+			return errors.New("kafka.(*Writer): Topic must be specified for Writer or Message")
+		}
+		v[i] = msg
+	}
+	c.broker.write(v)
+	return nil
+}
+
+func (c *kafkaProducer) Close() error {
+	return nil
+}
+
+type kafkaConsumer struct {
+	broker *KafkaBroker
+	group  string
+	topics []string
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *kafkaConsumer) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	for {
+		select {
+		case <-c.closed:
+			return kafka.Message{}, io.EOF
+		default:
+		}
+		msg, ok, notify := c.broker.fetch(c.group, c.topics)
+		if ok {
+			return msg, nil
+		}
+		select {
+		case <-ctx.Done():
+			return kafka.Message{}, ctx.Err()
+		case <-c.closed:
+			return kafka.Message{}, io.EOF
+		case <-notify:
+		}
+	}
+}
+
+func (c *kafkaConsumer) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	c.broker.commit(c.group, msgs)
+	return nil
+}
+
+func (c *kafkaConsumer) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
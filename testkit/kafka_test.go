@@ -0,0 +1,150 @@
+package testkit
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/whatisfaker/micro"
+)
+
+type kafkaTestConfig struct {
+	Orders micro.KafkaConsumerConfig `nacos:"orders"`
+	Events micro.KafkaProducerConfig `nacos:"events"`
+}
+
+//startKafkaConsume 连接内存broker, 后台运行ConsumeKafka
+func startKafkaConsume(t *testing.T, broker *KafkaBroker, handler micro.KafkaHandler, opts ...micro.KafkaConsumeOption) (context.CancelFunc, <-chan error) {
+	t.Helper()
+	t.Cleanup(broker.Register())
+	kit, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deps, err := kit.Manager().ParseConfig(&kafkaTestConfig{
+		Orders: micro.KafkaConsumerConfig{GroupID: "order-service", Topics: []string{"orders"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = deps.Close(context.TODO())
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- kit.Manager().ConsumeKafka(deps, "orders", handler, opts...)(ctx)
+	}()
+	return cancel, done
+}
+
+func waitDone(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("consume loop did not return")
+		return nil
+	}
+}
+
+func TestConsumeKafkaCommit(t *testing.T) {
+	broker := NewKafkaBroker()
+	var handled int32
+	cancel, done := startKafkaConsume(t, broker, func(ctx context.Context, msg kafka.Message) error {
+		atomic.AddInt32(&handled, 1)
+		return nil
+	})
+	ctx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+	defer stop()
+	if err := broker.Producer("orders").WriteMessages(ctx, kafka.Message{Value: []byte("a")}, kafka.Message{Value: []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.WaitCommitted(ctx, "order-service", "orders", 2); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := waitDone(t, done); err != nil {
+		t.Fatalf("consume loop returned %v", err)
+	}
+	if n := atomic.LoadInt32(&handled); n != 2 {
+		t.Fatalf("handled %d messages, want 2", n)
+	}
+}
+
+func TestConsumeKafkaFailedNotCommitted(t *testing.T) {
+	broker := NewKafkaBroker()
+	var attempts int32
+	cancel, done := startKafkaConsume(t, broker, func(ctx context.Context, msg kafka.Message) error {
+		atomic.AddInt32(&attempts, 1)
+		return errors.New("boom")
+	}, micro.KafkaRetries(2, time.Millisecond))
+	defer cancel()
+	if err := broker.Producer("orders").WriteMessages(context.Background(), kafka.Message{Value: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitDone(t, done); !errors.Is(err, micro.ErrKafkaMessageFailed) {
+		t.Fatalf("consume loop returned %v, want ErrKafkaMessageFailed", err)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Fatalf("handled %d times, want 3", n)
+	}
+	if n := broker.Committed("order-service", "orders"); n != 0 {
+		t.Fatalf("committed offset %d, want 0", n)
+	}
+}
+
+func TestConsumeKafkaDeadLetter(t *testing.T) {
+	broker := NewKafkaBroker()
+	cancel, done := startKafkaConsume(t, broker, func(ctx context.Context, msg kafka.Message) error {
+		return errors.New("boom")
+	}, micro.KafkaRetries(0, 0), micro.KafkaDeadLetter("events", "orders-dlq"))
+	ctx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+	defer stop()
+	if err := broker.Producer("orders").WriteMessages(ctx, kafka.Message{Key: []byte("k"), Value: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.WaitCommitted(ctx, "order-service", "orders", 1); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := waitDone(t, done); err != nil {
+		t.Fatalf("consume loop returned %v", err)
+	}
+	dlq := broker.Messages("orders-dlq")
+	if len(dlq) != 1 || string(dlq[0].Value) != "a" || string(dlq[0].Key) != "k" {
+		t.Fatalf("dead letter messages %v", dlq)
+	}
+	found := false
+	for _, h := range dlq[0].Headers {
+		if h.Key == "x-dead-letter-error" && string(h.Value) == "boom" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("dead letter headers %v", dlq[0].Headers)
+	}
+}
+
+func TestConsumeKafkaSkipFailed(t *testing.T) {
+	broker := NewKafkaBroker()
+	cancel, done := startKafkaConsume(t, broker, func(ctx context.Context, msg kafka.Message) error {
+		return errors.New("boom")
+	}, micro.KafkaRetries(0, 0), micro.KafkaSkipFailed())
+	ctx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+	defer stop()
+	if err := broker.Producer("orders").WriteMessages(ctx, kafka.Message{Value: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.WaitCommitted(ctx, "order-service", "orders", 1); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := waitDone(t, done); err != nil {
+		t.Fatalf("consume loop returned %v", err)
+	}
+}
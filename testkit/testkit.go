@@ -0,0 +1,120 @@
+//Package testkit 在进程内(内存listener)启动注册的微服务, 用于集成测试, 不占用真实端口
+package testkit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/whatisfaker/micro"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const bufSize = 1024 * 1024
+
+var ErrNotStarted = errors.New("testkit is not started")
+
+//Kit 测试用的微服务运行环境(空服务中心 + 内存配置中心 + 内存listener, 不设置全局tracer和信号处理)
+type Kit struct {
+	mgr       *micro.MSManager
+	mu        sync.Mutex
+	listeners map[string]*bufconn.Listener
+	cancel    context.CancelFunc
+	done      chan error
+}
+
+//New 创建测试环境, cfg为内存配置中心的初始配置(可为nil)
+func New(cfg interface{}, opts ...micro.Option) (*Kit, error) {
+	c := &Kit{
+		listeners: make(map[string]*bufconn.Listener),
+	}
+	options := []micro.Option{
+		micro.NoopServiceCenter(),
+		micro.MemoryConfigCenter(cfg),
+		micro.ListenFunc(c.listen),
+		micro.NoGlobalTracer(),
+		micro.NoSignalHandler(),
+	}
+	mgr, err := micro.NewMSManager(append(options, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	c.mgr = mgr
+	return c, nil
+}
+
+//Manager 获取微服务管理器(用于RegisterGin/RegisterGRPC/RegisterTCP等)
+func (c *Kit) Manager() *micro.MSManager {
+	return c.mgr
+}
+
+//Start 后台启动所有注册的服务
+func (c *Kit) Start(ctx context.Context, name string, fns ...func(context.Context) error) {
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.done = make(chan error, 1)
+	go func() {
+		c.done <- c.mgr.RunWith(ctx, name, fns...)
+	}()
+}
+
+//Stop 停止所有服务并等待退出
+func (c *Kit) Stop() error {
+	if c.cancel == nil {
+		return ErrNotStarted
+	}
+	c.cancel()
+	select {
+	case err := <-c.done:
+		return err
+	case <-time.After(10 * time.Second):
+		return context.DeadlineExceeded
+	}
+}
+
+func (c *Kit) listener(address string) *bufconn.Listener {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.listeners[address]
+	if !ok {
+		l = bufconn.Listen(bufSize)
+		c.listeners[address] = l
+	}
+	return l
+}
+
+func (c *Kit) listen(network string, address string) (net.Listener, error) {
+	return c.listener(address), nil
+}
+
+//Dial 连接注册时使用的listen地址(原始连接, 例如tcp服务), 服务开始Accept前阻塞
+func (c *Kit) Dial(listen string) (net.Conn, error) {
+	return c.listener(listen).Dial()
+}
+
+//GRPCConn 获取连接到listen地址上grpc服务的客户端连接
+func (c *Kit) GRPCConn(ctx context.Context, listen string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	l := c.listener(listen)
+	options := []grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return l.Dial()
+		}),
+	}
+	return grpc.DialContext(ctx, "passthrough:///"+listen, append(options, opts...)...)
+}
+
+//HTTPClient 获取请求listen地址上gin服务的http客户端(url中的host任意)
+func (c *Kit) HTTPClient(listen string) *http.Client {
+	l := c.listener(listen)
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(context.Context, string, string) (net.Conn, error) {
+				return l.Dial()
+			},
+		},
+	}
+}
@@ -0,0 +1,281 @@
+package testkit
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opentracing/opentracing-go"
+	"github.com/whatisfaker/micro"
+	"github.com/whatisfaker/ms"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+//startKit 后台启动注册的服务, 测试结束时停止
+func startKit(t *testing.T, kit *Kit) {
+	t.Helper()
+	kit.Start(context.Background(), "test")
+	t.Cleanup(func() {
+		if err := kit.Stop(); err != nil {
+			t.Errorf("stop: %v", err)
+		}
+	})
+}
+
+//waitState 等待服务的状态
+func waitState(t *testing.T, kit *Kit, name string, state string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, s := range kit.Manager().Services() {
+			if s.Name == name && s.State == state {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("service %s is not %s: %+v", name, state, kit.Manager().Services())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func get(t *testing.T, client *http.Client, url string) (int, string) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestGin(t *testing.T) {
+	kit, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kit.Manager().RegisterGin("web", "127.0.0.1:8080", func(ctx context.Context, r *gin.Engine) {
+		r.GET("/ping", func(ctx *gin.Context) {
+			ctx.String(http.StatusOK, "pong")
+		})
+	}, micro.ParamRateLimit(0.001, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	startKit(t, kit)
+	client := kit.HTTPClient("127.0.0.1:8080")
+	if code, body := get(t, client, "http://web/ping"); code != http.StatusOK || body != "pong" {
+		t.Fatalf("ping: %d %s", code, body)
+	}
+	waitState(t, kit, "web", micro.ServiceRunning)
+	if code, _ := get(t, client, "http://web/ping"); code != http.StatusTooManyRequests {
+		t.Fatalf("ping over limit: %d, want 429", code)
+	}
+	//探针不限流
+	for i := 0; i < 3; i++ {
+		if code, body := get(t, client, "http://web/livez"); code != http.StatusOK {
+			t.Fatalf("livez: %d %s", code, body)
+		}
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	kit, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kit.Manager().RegisterGRPC("rpc", "127.0.0.1:9090", func(ctx context.Context, s *grpc.Server) {}); err != nil {
+		t.Fatal(err)
+	}
+	startKit(t, kit)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := kit.GRPCConn(ctx, "127.0.0.1:9090")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	for {
+		resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status == healthpb.HealthCheckResponse_SERVING {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	waitState(t, kit, "rpc", micro.ServiceRunning)
+	if opentracing.IsGlobalTracerRegistered() {
+		t.Fatal("testkit set the global tracer")
+	}
+}
+
+func TestTCP(t *testing.T) {
+	kit, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kit.Manager().RegisterTCP("tcp", "127.0.0.1:7070", func(ctx context.Context, s *ms.Server) {}); err != nil {
+		t.Fatal(err)
+	}
+	startKit(t, kit)
+	//Dial在服务Accept之后返回
+	done := make(chan error, 1)
+	go func() {
+		conn, err := kit.Dial("127.0.0.1:7070")
+		if err == nil {
+			conn.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tcp service did not accept")
+	}
+	waitState(t, kit, "tcp", micro.ServiceRunning)
+}
+
+func TestStopNotStarted(t *testing.T) {
+	kit, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kit.Stop(); !errors.Is(err, ErrNotStarted) {
+		t.Fatalf("stop: %v, want ErrNotStarted", err)
+	}
+}
+
+//readClosed 连接被关闭时返回true, 保持连接(被tcp服务接收)时超时返回false
+func readClosed(t *testing.T, conn net.Conn, data []byte) bool {
+	t.Helper()
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return true
+}
+
+//tcpMessage 消息开头之后补齐到grpc匹配需要读取的长度
+func tcpMessage(preamble string) []byte {
+	return []byte(preamble + strings.Repeat("\x00", 64))
+}
+
+func TestMux(t *testing.T) {
+	kit, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kit.Manager().RegisterMux("mux", "127.0.0.1:6060", func(ctx context.Context, r *gin.Engine) {
+		r.GET("/ping", func(ctx *gin.Context) {
+			ctx.String(http.StatusOK, "pong")
+		})
+	}, func(ctx context.Context, s *grpc.Server) {}, func(ctx context.Context, s *ms.Server) {}, micro.ParamTCPPreamble([]byte("MS")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	startKit(t, kit)
+	if code, body := get(t, kit.HTTPClient("127.0.0.1:6060"), "http://mux/ping"); code != http.StatusOK || body != "pong" {
+		t.Fatalf("ping: %d %s", code, body)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := kit.GRPCConn(ctx, "127.0.0.1:6060")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true)); err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := kit.Dial("127.0.0.1:6060")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	if readClosed(t, tcp, tcpMessage("MS")) {
+		t.Fatal("tcp connection with preamble closed")
+	}
+	//都不匹配的连接关闭
+	other, err := kit.Dial("127.0.0.1:6060")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if !readClosed(t, other, tcpMessage("XX")) {
+		t.Fatal("unmatched connection not closed")
+	}
+}
+
+func TestMuxTCPDefault(t *testing.T) {
+	kit, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kit.Manager().RegisterMux("mux", "127.0.0.1:6060", nil, nil, func(ctx context.Context, s *ms.Server) {}); err != nil {
+		t.Fatal(err)
+	}
+	startKit(t, kit)
+	//没有消息开头时其余的连接都交给tcp服务
+	conn, err := kit.Dial("127.0.0.1:6060")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if readClosed(t, conn, tcpMessage("XX")) {
+		t.Fatal("tcp connection closed without preamble")
+	}
+}
+
+func TestMuxSharedLimit(t *testing.T) {
+	kit, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kit.Manager().RegisterMux("mux", "127.0.0.1:6060", func(ctx context.Context, r *gin.Engine) {
+		r.GET("/ping", func(ctx *gin.Context) {
+			ctx.String(http.StatusOK, "pong")
+		})
+	}, func(ctx context.Context, s *grpc.Server) {}, nil, micro.ParamRateLimit(0.001, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	startKit(t, kit)
+	if code, _ := get(t, kit.HTTPClient("127.0.0.1:6060"), "http://mux/ping"); code != http.StatusOK {
+		t.Fatalf("ping: %d", code)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := kit.GRPCConn(ctx, "127.0.0.1:6060")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	//http已经用完端口的限额
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true))
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("grpc after http: %v, want ResourceExhausted", err)
+	}
+}
@@ -0,0 +1,218 @@
+package micro
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	otgrpc "github.com/opentracing-contrib/go-grpc"
+	"github.com/opentracing/opentracing-go"
+	"github.com/uber/jaeger-client-go"
+	"github.com/uber/jaeger-client-go/config"
+	"github.com/whatisfaker/gin-contrib/nethttp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otbridge "go.opentelemetry.io/otel/bridge/opentracing"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+const (
+	//TracingJaeger 使用jaeger(opentracing)追踪, 默认
+	TracingJaeger = "jaeger"
+	//TracingOTel 使用OpenTelemetry追踪(OTLP导出, W3C traceparent传播)
+	TracingOTel = "otel"
+)
+
+//tracers 服务和客户端使用的追踪后端, RunWith时初始化
+type tracers struct {
+	otel       bool
+	sampler    *sampler
+	cfg        *TracingConfig
+	sdk        *sdktrace.TracerProvider
+	provider   trace.TracerProvider
+	propagator propagation.TextMapPropagator
+}
+
+//closerFunc io.Closer的函数适配
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+//newTracer 根据追踪后端创建tracer, OpenTelemetry模式下返回桥接的opentracing tracer(MySQLStartSpan等继续可用)
+func (c *MSManager) newTracer(ctx context.Context, name string) (opentracing.Tracer, io.Closer, error) {
+	tc := c.tracingConfig(ctx)
+	if tc == nil {
+		tc = &TracingConfig{}
+	}
+	c.tracers.cfg = tc
+	if !c.tracers.otel {
+		return c.newJaegerTracer(name)
+	}
+	var spanProcessor sdktrace.TracerProviderOption
+	if c.options.otelExporter != nil {
+		spanProcessor = sdktrace.WithSyncer(c.options.otelExporter)
+	} else {
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithInsecure()}
+		if c.options.otlpEndpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(c.options.otlpEndpoint))
+		} else if tc.AgentAddr != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(tc.AgentAddr))
+		}
+		exporter, err := otlptracegrpc.New(ctx, opts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		spanProcessor = sdktrace.WithBatcher(exporter)
+	}
+	attrs := []attribute.KeyValue{semconv.ServiceNameKey.String(name)}
+	for k, v := range tc.Tags {
+		attrs = append(attrs, attribute.String(k, v))
+	}
+	tp := sdktrace.NewTracerProvider(
+		spanProcessor,
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, attrs...)),
+		sdktrace.WithSampler(sdktrace.ParentBased(&otelSampler{sampler: c.tracers.sampler, fallback: sdktrace.AlwaysSample()})),
+	)
+	propagator := propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+	bridge, provider := otbridge.NewTracerPair(tp.Tracer(name))
+	bridge.SetTextMapPropagator(propagator)
+	if !c.options.noGlobalTracer {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	}
+	c.tracers.sdk = tp
+	c.tracers.provider = provider
+	c.tracers.propagator = propagator
+	return bridge, closerFunc(func() error {
+		cctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+		defer cancel()
+		return tp.Shutdown(cctx)
+	}), nil
+}
+
+//newJaegerTracer jaeger的tracer(JAEGER_*环境变量), 配置中心的tracing设置覆盖agent地址, 标签和采样
+func (c *MSManager) newJaegerTracer(name string) (opentracing.Tracer, io.Closer, error) {
+	cfg, err := config.FromEnv()
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.ServiceName = name
+	if tc := c.tracers.cfg; tc != nil {
+		if tc.AgentAddr != "" {
+			cfg.Reporter.LocalAgentHostPort = tc.AgentAddr
+		}
+		for k, v := range tc.Tags {
+			cfg.Tags = append(cfg.Tags, opentracing.Tag{Key: k, Value: v})
+		}
+	}
+	fallback, err := cfg.Sampler.NewSampler(name, jaeger.NewNullMetrics())
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg.NewTracer(
+		config.Logger(jaegerLogger{c.log.Normal()}),
+		config.Sampler(&jaegerSampler{sampler: c.tracers.sampler, fallback: fallback}),
+	)
+}
+
+//newDepTracer 依赖(mysql, redis等)独立的tracer, OpenTelemetry模式下共用同一个TracerProvider(以name区分instrumentation)
+func (c *MSManager) newDepTracer(name string) (opentracing.Tracer, io.Closer, error) {
+	if !c.tracers.otel || c.tracers.sdk == nil {
+		return c.newJaegerTracer(name)
+	}
+	bridge, _ := otbridge.NewTracerPair(c.tracers.sdk.Tracer(name))
+	bridge.SetTextMapPropagator(c.tracers.propagator)
+	return bridge, closerFunc(func() error { return nil }), nil
+}
+
+//ginMiddleware gin的追踪中间件, ignorePath中的路由不追踪
+func (c *tracers) ginMiddleware(name string, ignorePath []string) gin.HandlerFunc {
+	if c == nil || !c.otel {
+		//span名称使用路由(同otelgin), 采样规则按路由匹配
+		opts := []nethttp.MWOption{nethttp.OperationNameFunc(func(r *http.Request) string {
+			return ginSpanName(r.Method, ginRoute(r.Context()))
+		})}
+		if len(ignorePath) > 0 {
+			opts = append(opts, nethttp.MWOmitURI(ignorePath...))
+		}
+		mw := nethttp.Middleware(opentracing.GlobalTracer(), opts...)
+		return func(ctx *gin.Context) {
+			ctx.Request = ctx.Request.WithContext(context.WithValue(ctx.Request.Context(), ginRouteKey{}, ctx.FullPath()))
+			mw(ctx)
+		}
+	}
+	opts := make([]otelgin.Option, 0)
+	if c.provider != nil {
+		opts = append(opts, otelgin.WithTracerProvider(c.provider), otelgin.WithPropagators(c.propagator))
+	}
+	mw := otelgin.Middleware(name, opts...)
+	ignore := make(map[string]struct{})
+	for _, v := range ignorePath {
+		ignore[v] = struct{}{}
+	}
+	return func(ctx *gin.Context) {
+		if _, ok := ignore[ctx.Request.URL.Path]; ok {
+			ctx.Next()
+			return
+		}
+		mw(ctx)
+	}
+}
+
+type ginRouteKey struct{}
+
+func ginRoute(ctx context.Context) string {
+	v, _ := ctx.Value(ginRouteKey{}).(string)
+	return v
+}
+
+//ginSpanName jaeger的gin span名称: HTTP GET /users/:id, 没有匹配的路由时同otelgin
+func ginSpanName(method string, route string) string {
+	if route == "" {
+		return "HTTP " + method + " route not found"
+	}
+	return "HTTP " + method + " " + route
+}
+
+//grpcOptions RunWith之前创建的拦截器使用otel的全局设置(后续会委托给RunWith设置的provider)
+func (c *tracers) grpcOptions() []otelgrpc.Option {
+	if c.provider == nil {
+		return nil
+	}
+	return []otelgrpc.Option{otelgrpc.WithTracerProvider(c.provider), otelgrpc.WithPropagators(c.propagator)}
+}
+
+func (c *tracers) serverInterceptors() (grpc.UnaryServerInterceptor, grpc.StreamServerInterceptor) {
+	if c == nil || !c.otel {
+		tracer := opentracing.GlobalTracer()
+		return otgrpc.OpenTracingServerInterceptor(tracer), otgrpc.OpenTracingStreamServerInterceptor(tracer)
+	}
+	opts := c.grpcOptions()
+	return otelgrpc.UnaryServerInterceptor(opts...), otelgrpc.StreamServerInterceptor(opts...)
+}
+
+//clientInterceptors grpc客户端追踪, opentracing为noop时返回nil
+func (c *tracers) clientInterceptors() (grpc.UnaryClientInterceptor, grpc.StreamClientInterceptor) {
+	if c == nil || !c.otel {
+		tracer := opentracing.GlobalTracer()
+		switch tracer.(type) {
+		case opentracing.NoopTracer, *opentracing.NoopTracer:
+			return nil, nil
+		}
+		return otgrpc.OpenTracingClientInterceptor(tracer), otgrpc.OpenTracingStreamClientInterceptor(tracer)
+	}
+	opts := c.grpcOptions()
+	return otelgrpc.UnaryClientInterceptor(opts...), otelgrpc.StreamClientInterceptor(opts...)
+}